@@ -45,6 +45,12 @@ type Config struct {
 	TLS              TLSConfig
 	DialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
 	SrcIP            string
+	// Destination CIDRs the SrcIP is used for, all destinations when empty
+	SrcIPSubnets []string
+	// Source port range (min-max) of the connections bound to SrcIP
+	SrcPortRange string
+	// SOCKS5 or HTTP CONNECT proxy the connections to the endpoints go through
+	UpstreamProxy string
 }
 
 //TLSConfig for a Client
@@ -178,14 +184,36 @@ func NewClient(c *Config) (*Client, error) {
 		HostKeyCallback: client.verifyServer,
 		Timeout:         settings.EnvDuration("SSH_TIMEOUT", 30*time.Second),
 	}
+	srcIP, err := tunnel.ParseSrcIP(c.SrcIP)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid source IP (%s)", err)
+	}
+	srcIPSubnets, err := tunnel.ParseSubnets(c.SrcIPSubnets)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid source IP subnet (%s)", err)
+	}
+	srcPorts, err := tunnel.ParsePortRange(c.SrcPortRange)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid source port range (%s)", err)
+	}
+	var upstreamProxy *url.URL
+	if c.UpstreamProxy != "" {
+		if upstreamProxy, err = tunnel.ParseUpstreamProxy(c.UpstreamProxy); err != nil {
+			return nil, fmt.Errorf("Invalid upstream proxy (%s)", err)
+		}
+	}
 	//prepare client tunnel
 	client.tunnel = tunnel.New(tunnel.Config{
-		Logger:    client.Logger,
-		Inbound:   true, //client always accepts inbound
-		Outbound:  true, //client always accepts outbound
-		Socks:     hasReverse && hasSocks,
-		KeepAlive: client.config.KeepAlive,
-		SrcIP:     net.ParseIP(client.config.SrcIP),
+		Logger:        client.Logger,
+		Inbound:       true, //client always accepts inbound
+		Outbound:      true, //client always accepts outbound
+		Socks:         hasReverse && hasSocks,
+		KeepAlive:     client.config.KeepAlive,
+		SrcIP:         srcIP,
+		SrcIPSubnets:  srcIPSubnets,
+		SrcPorts:      srcPorts,
+		UpstreamProxy: upstreamProxy,
+		Version:       chshare.BuildVersion,
 	})
 	return client, nil
 }
@@ -257,7 +285,13 @@ func (c *Client) Start(ctx context.Context) error {
 		if len(clientInbound) == 0 {
 			return nil
 		}
-		return c.tunnel.BindRemotes(ctx, clientInbound)
+		err := c.tunnel.BindRemotes(ctx, clientInbound)
+		//the connection loop reconnects on its own
+		var lost *tunnel.ErrConnectionLost
+		if errors.As(err, &lost) {
+			return lost.Err
+		}
+		return err
 	})
 
 	if os.Getenv("FETCH_REMOTES_VIA_API") == "true" {
@@ -344,5 +378,8 @@ func (c *Client) Close() error {
 	if c.stop != nil {
 		c.stop()
 	}
+	if c.tunnel != nil {
+		c.tunnel.Close()
+	}
 	return nil
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/inverse-inc/packetfence/go/chisel/share/cnet"
 	"github.com/inverse-inc/packetfence/go/chisel/share/cos"
 	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+	"github.com/inverse-inc/packetfence/go/chisel/share/tunnel"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -97,7 +98,8 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	conn := cnet.NewWebSocketConn(wsConn)
 	// perform SSH handshake on net.Conn
 	c.Debugf("Handshaking...")
-	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
+	kex := tunnel.NewKexRecorder(conn, true)
+	sshConn, chans, reqs, err := ssh.NewClientConn(kex, "", c.sshConfig)
 	if err != nil {
 		e := err.Error()
 		if strings.Contains(e, "unable to authenticate") {
@@ -136,7 +138,7 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	c.Infof("Connected (Latency %s)", time.Since(t0))
 	//connected, handover ssh connection for tunnel to use, and block
 	retry = true
-	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
+	err = c.tunnel.BindSSH(ctx, tunnel.WithSSHInfo(sshConn, kex.SSHInfo()), reqs, chans)
 	if n, ok := err.(net.Error); ok && !n.Temporary() {
 		retry = false
 	}
@@ -35,6 +35,10 @@ type Config struct {
 	Reverse   bool
 	KeepAlive time.Duration
 	TLS       TLSConfig
+	// Idle timeout of the connections to the internal SOCKS5 proxy
+	SocksIdleTimeout time.Duration
+	// Pass the SOCKS5 hostnames unresolved to the dialer of the endpoints
+	SocksRemoteResolve bool
 }
 
 // Server respresent a chisel service
@@ -168,6 +172,7 @@ func (s *Server) StartContext(ctx context.Context, host, port string) error {
 	}
 
 	s.setupRedisClient(ctx)
+	go s.serveCoA(ctx)
 
 	return s.httpServer.GoServe(ctx, l, h)
 }
@@ -0,0 +1,64 @@
+package chserver
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/inverse-inc/go-utils/sharedutils"
+	"github.com/inverse-inc/packetfence/go/chisel/share/radius_proxy"
+	"github.com/inverse-inc/packetfence/go/chisel/share/tunnel"
+)
+
+// serveCoA listens for the CoA and Disconnect requests of PacketFence and
+// forwards them through the tunnel of the connector the NAS is behind.
+// It is disabled unless PFCONNECTOR_COA_LISTEN holds the address to listen on,
+// only the sources of PFCONNECTOR_COA_ALLOWED_SOURCES (loopback by default) are accepted
+func (s *Server) serveCoA(ctx context.Context) {
+	addr := os.Getenv("PFCONNECTOR_COA_LISTEN")
+	if addr == "" {
+		s.Debugf("CoA forwarding disabled")
+		return
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err != nil || host == "" {
+		s.Infof("Invalid CoA listen address %q, expected an IP and a port", addr)
+		return
+	}
+
+	sources, err := radius_proxy.ParseCoASources(sharedutils.EnvOrDefault("PFCONNECTOR_COA_ALLOWED_SOURCES", "127.0.0.1,::1"))
+	if err != nil {
+		s.Infof("Unable to listen for CoA requests: %s", err)
+		return
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		s.Infof("Unable to listen for CoA requests on %s: %s", addr, err)
+		return
+	}
+
+	s.Infof("Listening for CoA requests on %s", addr)
+	l := s.Logger.Fork("coa")
+	if err := radius_proxy.ServeCoA(ctx, l, conn, sources, forwardCoA); err != nil {
+		s.Infof("Stopped listening for CoA requests: %s", err)
+	}
+}
+
+func forwardCoA(nasIP net.IP, payload []byte) ([]byte, error) {
+	var tun *tunnel.Tunnel
+	activeTunnels.Range(func(k, v interface{}) bool {
+		t := v.(*tunnel.Tunnel)
+		if t.IsActive() && t.HasNAS(nasIP) {
+			tun = t
+			return false
+		}
+		return true
+	})
+
+	if tun == nil {
+		return nil, radius_proxy.UnknownNASErr
+	}
+
+	return tun.ForwardCoA(nasIP, payload)
+}
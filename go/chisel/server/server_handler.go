@@ -103,7 +103,8 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	conn := cnet.NewWebSocketConn(wsConn)
 	// perform SSH handshake on net.Conn
 	l.Debugf("Handshaking with %s...", req.RemoteAddr)
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	kex := tunnel.NewKexRecorder(conn, false)
+	sshConn, chans, reqs, err := ssh.NewServerConn(kex, s.sshConfig)
 	if err != nil {
 		s.Debugf("Failed to handshake (%s)", err)
 		return
@@ -181,20 +182,28 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	pfconfigdriver.FetchDecodeSocket(req.Context(), &localSecret)
 	//successfuly validated config!
 	r.Reply(true, nil)
+	boundConn := tunnel.WithSSHInfo(sshConn, kex.SSHInfo())
 	//tunnel per ssh connection
 	tunnel := tunnel.New(tunnel.Config{
-		Logger:       l,
-		Inbound:      s.config.Reverse,
-		Outbound:     true, //server always accepts outbound
-		Socks:        s.config.Socks5,
-		KeepAlive:    s.config.KeepAlive,
-		RadiusSecret: localSecret.Element,
+		Logger:              l,
+		Inbound:             s.config.Reverse,
+		Outbound:            true, //server always accepts outbound
+		Socks:               s.config.Socks5,
+		KeepAlive:           s.config.KeepAlive,
+		RadiusSecret:        localSecret.Element,
+		SocksIdleTimeout:    s.config.SocksIdleTimeout,
+		SocksRemoteResolve:  s.config.SocksRemoteResolve,
+		MaxProxies:          settings.EnvInt("MAX_PROXIES", 0),
+		MaxProxyConns:       settings.EnvInt("MAX_PROXY_CONNS", 0),
+		EndpointIdleTimeout: settings.EnvDuration("ENDPOINT_IDLE_TIMEOUT", 0),
+		EndpointDeadline:    settings.EnvDuration("ENDPOINT_DEADLINE", 0),
+		Version:             chshare.BuildVersion,
 	})
 	//bind
 	eg, ctx := errgroup.WithContext(req.Context())
 	eg.Go(func() error {
 		//connected, handover ssh connection for tunnel to use, and block
-		return tunnel.BindSSH(ctx, sshConn, reqs, chans)
+		return tunnel.BindSSH(ctx, boundConn, reqs, chans)
 	})
 	eg.Go(func() error {
 		//connected, setup reversed-remotes?
@@ -216,6 +225,7 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 	err = eg.Wait()
+	tunnel.Close()
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		l.Debugf("Closed connection (%s)", err)
 	} else {
@@ -1,20 +1,29 @@
 package cio
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"time"
 )
 
 //Logger is pkg/log Logger with prefixing and 2 log levels
 type Logger struct {
 	Info, Debug bool
+	//JSON logs the events as JSON objects instead of text lines
+	JSON bool
 	//internal
 	prefix      string
 	logger      *log.Logger
 	info, debug *bool
+	jsonOutput  *bool
 }
 
+//Fields of a logged event, the component and event keys are always set
+type Fields map[string]interface{}
+
 func NewLogger(prefix string) *Logger {
 	return NewLoggerFlag(prefix, log.Ldate|log.Ltime)
 }
@@ -30,24 +39,28 @@ func NewLoggerFlag(prefix string, flag int) *Logger {
 }
 
 func (l *Logger) Printf(f string, args ...interface{}) {
+	if l.IsJSON() {
+		l.writeJSON("log", nil, fmt.Sprintf(f, args...))
+		return
+	}
 	l.logger.Printf(l.prefix+": "+f, args...)
 }
 
 func (l *Logger) Infof(f string, args ...interface{}) {
 	if l.IsInfo() {
-		l.logger.Printf(l.prefix+": "+f, args...)
+		l.Printf(f, args...)
 	}
 }
 
 func (l *Logger) Debugf(f string, args ...interface{}) {
 	if l.IsDebug() {
-		l.logger.Printf(l.prefix+": "+f, args...)
+		l.Printf(f, args...)
 	}
 }
 
 func (l *Logger) IfDebug(f func() string) {
 	if l.IsDebug() {
-		l.logger.Printf(l.prefix + ": " + f())
+		l.Printf("%s", f())
 	}
 }
 
@@ -78,9 +91,65 @@ func (l *Logger) Fork(prefix string, args ...interface{}) *Logger {
 	} else {
 		ll.debug = &l.Debug
 	}
+	ll.JSON = l.JSON
+	if l.jsonOutput != nil {
+		ll.jsonOutput = l.jsonOutput
+	} else {
+		ll.jsonOutput = &l.JSON
+	}
+	ll.logger.SetOutput(l.logger.Writer())
 	return ll
 }
 
+//SetOutput sets the destination of the logger, forks created afterwards inherit it
+func (l *Logger) SetOutput(w io.Writer) {
+	l.logger.SetOutput(w)
+}
+
+//InfoEventf logs a lifecycle event at the info level,
+//see Eventf
+func (l *Logger) InfoEventf(event string, fields Fields, f string, args ...interface{}) {
+	if l.IsInfo() {
+		l.Eventf(event, fields, f, args...)
+	}
+}
+
+//DebugEventf logs a lifecycle event at the debug level,
+//see Eventf
+func (l *Logger) DebugEventf(event string, fields Fields, f string, args ...interface{}) {
+	if l.IsDebug() {
+		l.Eventf(event, fields, f, args...)
+	}
+}
+
+//Eventf logs a lifecycle event as a JSON object with the component (prefix),
+//event and fields keys when JSON is enabled, or as the formatted text line otherwise
+func (l *Logger) Eventf(event string, fields Fields, f string, args ...interface{}) {
+	if !l.IsJSON() {
+		l.Printf(f, args...)
+		return
+	}
+	l.writeJSON(event, fields, fmt.Sprintf(f, args...))
+}
+
+//writeJSON writes a single line JSON object, plain log lines use the "log" event
+func (l *Logger) writeJSON(event string, fields Fields, message string) {
+	entry := make(Fields, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["component"] = l.prefix
+	entry["event"] = event
+	entry["message"] = message
+	b, err := json.Marshal(entry)
+	if err != nil {
+		l.logger.Printf("%s: %s (%s)", l.prefix, message, err)
+		return
+	}
+	l.logger.Writer().Write(append(b, '\n'))
+}
+
 func (l *Logger) Prefix() string {
 	return l.prefix
 }
@@ -92,3 +161,7 @@ func (l *Logger) IsInfo() bool {
 func (l *Logger) IsDebug() bool {
 	return l.Debug || (l.debug != nil && *l.debug)
 }
+
+func (l *Logger) IsJSON() bool {
+	return l.JSON || (l.jsonOutput != nil && *l.jsonOutput)
+}
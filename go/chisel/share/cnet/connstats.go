@@ -2,13 +2,18 @@ package cnet
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
 //ConnCount is a connection counter
 type ConnCount struct {
 	count int32
-	open  int32
+	//the lifecycle counters move together under the lock
+	mut     sync.Mutex
+	opening int32
+	open    int32
+	closing int32
 }
 
 func (c *ConnCount) New() int32 {
@@ -16,13 +21,68 @@ func (c *ConnCount) New() int32 {
 }
 
 func (c *ConnCount) Open() {
-	atomic.AddInt32(&c.open, 1)
+	c.mut.Lock()
+	c.open++
+	c.mut.Unlock()
 }
 
 func (c *ConnCount) Close() {
-	atomic.AddInt32(&c.open, -1)
+	c.mut.Lock()
+	c.open--
+	c.mut.Unlock()
+}
+
+//Opening counts a connection being established
+func (c *ConnCount) Opening() {
+	c.mut.Lock()
+	c.opening++
+	c.mut.Unlock()
+}
+
+//Opened moves a connection from opening to open
+func (c *ConnCount) Opened() {
+	c.mut.Lock()
+	c.opening--
+	c.open++
+	c.mut.Unlock()
+}
+
+//Abort forgets a connection that failed while opening
+func (c *ConnCount) Abort() {
+	c.mut.Lock()
+	c.opening--
+	c.mut.Unlock()
+}
+
+//Closing moves a connection from open to closing
+func (c *ConnCount) Closing() {
+	c.mut.Lock()
+	c.open--
+	c.closing++
+	c.mut.Unlock()
+}
+
+//Closed forgets a connection once its teardown is done
+func (c *ConnCount) Closed() {
+	c.mut.Lock()
+	c.closing--
+	c.mut.Unlock()
+}
+
+//OpenCount returns the number of open connections
+func (c *ConnCount) OpenCount() int32 {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.open
+}
+
+//Counts returns a consistent snapshot of the opening, open and closing connections
+func (c *ConnCount) Counts() (opening, open, closing int32) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.opening, c.open, c.closing
 }
 
 func (c *ConnCount) String() string {
-	return fmt.Sprintf("[%d/%d]", atomic.LoadInt32(&c.open), atomic.LoadInt32(&c.count))
+	return fmt.Sprintf("[%d/%d]", c.OpenCount(), atomic.LoadInt32(&c.count))
 }
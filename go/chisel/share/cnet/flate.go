@@ -0,0 +1,49 @@
+package cnet
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// NewFlateRWC compresses the data written to the RWC and
+// decompresses the data read from it with DEFLATE. Each write
+// is flushed so the peer does not wait for a full block.
+func NewFlateRWC(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	w, _ := flate.NewWriter(rwc, flate.BestSpeed)
+	return &flateRWC{
+		ReadWriteCloser: rwc,
+		r:               flate.NewReader(rwc),
+		w:               w,
+	}
+}
+
+type flateRWC struct {
+	io.ReadWriteCloser
+	r  io.ReadCloser
+	mu sync.Mutex
+	w  *flate.Writer
+}
+
+func (c *flateRWC) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *flateRWC) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *flateRWC) Close() error {
+	//ends the stream unless a write is blocked, closing the RWC unblocks it
+	if c.mu.TryLock() {
+		c.w.Close()
+		c.mu.Unlock()
+	}
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,29 @@
+package cnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFlateRWC(t *testing.T) {
+	conn, peer := net.Pipe()
+	c := NewFlateRWC(conn)
+	p := NewFlateRWC(peer)
+	defer p.Close()
+
+	data := bytes.Repeat([]byte("compressible data "), 1000)
+	go func() {
+		c.Write(data[:10])
+		c.Write(data[10:])
+		c.Close()
+	}()
+	received, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("Cannot read the compressed stream: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Expected %d bytes, got %d altered bytes", len(data), len(received))
+	}
+}
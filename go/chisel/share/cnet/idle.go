@@ -0,0 +1,46 @@
+package cnet
+
+import (
+	"io"
+	"time"
+)
+
+// NewIdleRWC closes the RWC once no bytes
+// have been read or written for the given timeout
+func NewIdleRWC(rwc io.ReadWriteCloser, timeout time.Duration) io.ReadWriteCloser {
+	c := &idleRWC{
+		ReadWriteCloser: rwc,
+		timeout:         timeout,
+	}
+	c.timer = time.AfterFunc(timeout, func() {
+		rwc.Close()
+	})
+	return c
+}
+
+type idleRWC struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func (c *idleRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleRWC) Close() error {
+	c.timer.Stop()
+	return c.ReadWriteCloser.Close()
+}
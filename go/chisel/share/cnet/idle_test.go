@@ -0,0 +1,36 @@
+package cnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleRWC(t *testing.T) {
+	idleConn, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	activeConn, activePeer := net.Pipe()
+	defer activePeer.Close()
+	idle := NewIdleRWC(idleConn, 100*time.Millisecond)
+	active := NewIdleRWC(activeConn, 100*time.Millisecond)
+	defer active.Close()
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := activePeer.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := active.Write([]byte{1}); err != nil {
+			t.Fatalf("Active connection was closed: %s", err)
+		}
+	}
+
+	if _, err := idle.Write([]byte{1}); err == nil {
+		t.Fatalf("Idle connection was not closed")
+	}
+}
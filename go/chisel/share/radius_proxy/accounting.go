@@ -0,0 +1,48 @@
+package radius_proxy
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2866"
+)
+
+// isInterimUpdate reports if the packet is an accounting interim update
+func isInterimUpdate(p *radius.Packet) bool {
+	return p.Code == radius.CodeAccountingRequest &&
+		rfc2866.AcctStatusType_Get(p) == rfc2866.AcctStatusType_Value_InterimUpdate
+}
+
+// accountingSessionID returns the session key of an accounting packet
+func accountingSessionID(p *radius.Packet) string {
+	id := rfc2866.AcctSessionID_GetString(p)
+	if id == "" {
+		return ""
+	}
+
+	return "acct:" + id
+}
+
+// interimBackend extends the session of the interim update and returns its backend,
+// the session is created on the backend picked for the packet when it does not exist
+func (b *Backends) interimBackend(p *radius.Packet) *Backend {
+	id := accountingSessionID(p)
+	if id == "" {
+		return nil
+	}
+
+	be, err := b.sessions.GetSessionBackend(id)
+	if err == nil && be != nil {
+		b.lock.RLock()
+		present := b.backends[be.addr] == be
+		b.lock.RUnlock()
+		if present {
+			return be
+		}
+	}
+
+	be = b.pickBackend(p)
+	if be != nil {
+		b.sessions.Add(id, b.sessionTimeout, be)
+	}
+
+	return be
+}
@@ -0,0 +1,50 @@
+package radius_proxy
+
+import (
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+func testInterimUpdate(t *testing.T, sessionID string) *radius.Packet {
+	p := radius.New(radius.CodeAccountingRequest, testSecret)
+	rfc2865.UserName_SetString(p, "bob")
+	rfc2866.AcctStatusType_Set(p, rfc2866.AcctStatusType_Value_InterimUpdate)
+	if err := rfc2866.AcctSessionID_SetString(p, sessionID); err != nil {
+		t.Fatalf("Cannot set Acct-Session-Id: %s", err)
+	}
+
+	return p
+}
+
+func TestInterimUpdateExtendsSession(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	addr := testProxyPacket(t, rp, testInterimUpdate(t, "abc"))
+
+	rs, err := rp.backends.sessions.session("acct:abc")
+	if err != nil {
+		t.Fatalf("Expected a session for the interim update: %s", err)
+	}
+
+	if rs.backend.Addr() != addr {
+		t.Errorf("Expected the session on the handling backend %s, got %s", addr, rs.backend.Addr())
+	}
+
+	rs.lock.Lock()
+	rs.endTime = time.Now().Add(time.Second)
+	endTime := rs.endTime
+	rs.lock.Unlock()
+
+	if next := testProxyPacket(t, rp, testInterimUpdate(t, "abc")); next != addr {
+		t.Errorf("Expected the interim update to stay on %s, got %s", addr, next)
+	}
+
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	if !rs.endTime.After(endTime) {
+		t.Errorf("Expected the interim update to push out the session end time")
+	}
+}
@@ -2,31 +2,126 @@ package radius_proxy
 
 import (
 	"hash/fnv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 )
 
+// DefaultBackendGroup is the group of the backends added without a group
+// and of the packets whose realm and EAP type are not mapped to a group
+const DefaultBackendGroup = ""
+
 type Backend struct {
-	addr string
+	addr      string
+	group     string
+	unhealthy int32
+	// UnixNano time of the last packet proxied to the backend
+	lastSeen int64
+	breaker  breaker
+}
+
+// BackendStatus is a snapshot of the state of a backend
+type BackendStatus struct {
+	Addr     string
+	Group    string
+	Healthy  bool
+	Sessions int
+	// Time of the last packet proxied to the backend, zero when none was
+	LastSeen time.Time
+	// The breaker of the backend routes the packets around it
+	BreakerOpen bool
 }
 
 func NewBackend(addr string) *Backend {
+	return NewGroupBackend(DefaultBackendGroup, addr)
+}
+
+func NewGroupBackend(group, addr string) *Backend {
 	be := &Backend{
-		addr: addr,
+		addr:  addr,
+		group: group,
 	}
 
 	return be
 }
 
+func (be *Backend) Addr() string {
+	return be.addr
+}
+
+func (be *Backend) Group() string {
+	return be.group
+}
+
+// Healthy reports if the last health check of the backend succeeded,
+// backends are healthy until checked
+func (be *Backend) Healthy() bool {
+	return atomic.LoadInt32(&be.unhealthy) == 0
+}
+
+// setHealthy updates the health of the backend and returns the previous one
+func (be *Backend) setHealthy(healthy bool) bool {
+	var unhealthy int32
+	if !healthy {
+		unhealthy = 1
+	}
+
+	return atomic.SwapInt32(&be.unhealthy, unhealthy) == 0
+}
+
+// LastSeen returns the time of the last packet proxied to the backend
+func (be *Backend) LastSeen() time.Time {
+	lastSeen := atomic.LoadInt64(&be.lastSeen)
+	if lastSeen == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, lastSeen)
+}
+
+func (be *Backend) touch() {
+	atomic.StoreInt64(&be.lastSeen, time.Now().UnixNano())
+}
+
+// BackendSelector picks the backend of a packet that has no session yet
+type BackendSelector interface {
+	Select(packet *radius.Packet, backends []*Backend) *Backend
+}
+
+// HashBackendSelector spreads the packets on the backends using
+// a hash of the User-Name and Calling-Station-Id
+type HashBackendSelector struct{}
+
+func (HashBackendSelector) Select(packet *radius.Packet, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	hash := fnv.New32()
+	username := rfc2865.UserName_Get(packet)
+	callingStation := rfc2865.CallingStationID_Get(packet)
+	hash.Write(username)
+	hash.Write([]byte{','})
+	hash.Write(callingStation)
+	return backends[int(hash.Sum32())%len(backends)]
+}
+
 type Backends struct {
 	lock           *sync.RWMutex
 	keys           []string
 	backends       map[string]*Backend
 	sessions       *SessionBackend
 	sessionTimeout time.Duration
+	selector       BackendSelector
+	realms         map[string]string
+	eapTypes       map[uint8]string
+	// Consecutive failures opening the breaker of a backend, 0 disables the breakers
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 func NewBackends(timeout time.Duration, addrs ...string) *Backends {
@@ -35,6 +130,9 @@ func NewBackends(timeout time.Duration, addrs ...string) *Backends {
 		backends:       map[string]*Backend{},
 		sessions:       NewSessionBackend(),
 		sessionTimeout: timeout,
+		selector:       HashBackendSelector{},
+		realms:         map[string]string{},
+		eapTypes:       map[uint8]string{},
 	}
 
 	for _, a := range addrs {
@@ -45,50 +143,235 @@ func NewBackends(timeout time.Duration, addrs ...string) *Backends {
 }
 
 func (b *Backends) getBackend(p *radius.Packet) *Backend {
-	be := b.sessions.GetBackend(p)
-	if be != nil {
+	be, err := b.sessionBackend(p)
+	if err == nil {
 		return be
 	}
 
-	return b.pickBackend(p)
+	if err != BackendGoneErr {
+		return b.pickBackend(p)
+	}
+
+	// Re-pin the session within its group instead of treating the packet as a new request
+	group, _ := b.sessions.GetGroup(p)
+	be = b.pickGroupBackend(p, group)
+	if be != nil {
+		b.sessions.SetBackend(p, be)
+	}
+
+	return be
+}
+
+// sessionBackend returns the backend of the session of the packet,
+// BackendGoneErr is returned when it was deleted since the session started
+func (b *Backends) sessionBackend(p *radius.Packet) (*Backend, error) {
+	be, err := b.sessions.GetBackend(p)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if be == nil || b.backends[be.addr] != be {
+		return nil, BackendGoneErr
+	}
+
+	return be, nil
 }
 
+// pickBackend picks a backend in the group of the realm of the User-Name,
+// or of the EAP type of the packet when the realm is not mapped
 func (b *Backends) pickBackend(p *radius.Packet) *Backend {
+	b.lock.RLock()
+	group := b.realmGroup(p)
+	if group == DefaultBackendGroup {
+		group = b.eapGroup(p)
+	}
+	b.lock.RUnlock()
+	return b.pickGroupBackend(p, group)
+}
+
+// pickGroupBackend picks a backend of the group,
+// the default group is used when the group has no backends
+func (b *Backends) pickGroupBackend(p *radius.Packet, group string) *Backend {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 	if len(b.backends) == 0 {
 		return nil
 	}
 
-	i := b.loadBalanceIndex(p)
-	return b.backends[b.keys[i]]
+	members := b.groupBackends(group)
+	if len(members) == 0 && group != DefaultBackendGroup {
+		members = b.groupBackends(DefaultBackendGroup)
+	}
+
+	now := time.Now()
+	backends := make([]*Backend, 0, len(members))
+	for _, be := range members {
+		if be.Healthy() && !b.breakerOpen(be, now) {
+			backends = append(backends, be)
+		}
+	}
+
+	// Better try an unhealthy backend than dropping the packet
+	if len(backends) == 0 {
+		backends = members
+	}
+
+	be := b.selector.Select(p, backends)
+	if be != nil && b.breakerThreshold > 0 {
+		be.breaker.trial(now, b.breakerCooldown)
+	}
+
+	return be
 }
 
-func (b *Backends) loadBalanceIndex(packet *radius.Packet) int {
-	hash := fnv.New32()
-	username := rfc2865.UserName_Get(packet)
-	callingStation := rfc2865.CallingStationID_Get(packet)
-	hash.Write(username)
-	hash.Write([]byte{','})
-	hash.Write(callingStation)
-	return int(hash.Sum32()) % len(b.keys)
+func (b *Backends) groupBackends(group string) []*Backend {
+	backends := make([]*Backend, 0, len(b.keys))
+	for _, k := range b.keys {
+		if be := b.backends[k]; be.group == group {
+			backends = append(backends, be)
+		}
+	}
+
+	return backends
+}
+
+// realmGroup returns the group of the realm suffix of the User-Name (user@realm)
+func (b *Backends) realmGroup(p *radius.Packet) string {
+	username := rfc2865.UserName_GetString(p)
+	i := strings.LastIndex(username, "@")
+	if i == -1 {
+		return DefaultBackendGroup
+	}
+
+	if group, found := b.realms[strings.ToLower(username[i+1:])]; found {
+		return group
+	}
+
+	return DefaultBackendGroup
+}
+
+// SetRealmGroup routes the packets of the realm to the backends of the group
+func (b *Backends) SetRealmGroup(realm, group string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.realms[strings.ToLower(realm)] = group
+}
+
+// ready reports if a backend is present, and healthy when requireHealthy is set
+func (b *Backends) ready(requireHealthy bool) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, be := range b.backends {
+		if !requireHealthy || be.Healthy() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get returns the backend of the address, nil when there is none
+func (b *Backends) get(addr string) *Backend {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.backends[addr]
+}
+
+func (b *Backends) all() []*Backend {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	backends := make([]*Backend, len(b.keys))
+	for i, k := range b.keys {
+		backends[i] = b.backends[k]
+	}
+
+	return backends
 }
 
+// status returns a snapshot of the backends along with their active sessions
+func (b *Backends) status() []BackendStatus {
+	backends := b.all()
+	sessions := b.sessions.countByBackend()
+	now := time.Now()
+	status := make([]BackendStatus, len(backends))
+	for i, be := range backends {
+		status[i] = BackendStatus{
+			Addr:        be.addr,
+			Group:       be.group,
+			Healthy:     be.Healthy(),
+			Sessions:    sessions[be],
+			LastSeen:    be.LastSeen(),
+			BreakerOpen: b.breakerOpen(be, now),
+		}
+	}
+
+	return status
+}
+
+func (b *Backends) SetSelector(selector BackendSelector) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if selector == nil {
+		selector = HashBackendSelector{}
+	}
+
+	b.selector = selector
+}
+
+// Add adds a backend to the default group, adding an address already present is a no-op
 func (b *Backends) Add(addr string) {
+	b.AddToGroup(DefaultBackendGroup, addr)
+}
+
+// AddToGroup adds a backend to the group, an address belongs to a single group
+func (b *Backends) AddToGroup(group, addr string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.add(addr)
+	b.addToGroup(group, addr)
 }
 
 func (b *Backends) add(addr string) {
+	b.addToGroup(DefaultBackendGroup, addr)
+}
+
+func (b *Backends) addToGroup(group, addr string) {
 	if _, found := b.backends[addr]; found {
 		return
 	}
 
-	b.backends[addr] = NewBackend(addr)
+	b.backends[addr] = NewGroupBackend(group, addr)
 	b.keys = append(b.keys, addr)
 }
 
+// SetGroup replaces the backends of the group at once, the backends kept
+// in the group are preserved along with their sessions
+func (b *Backends) SetGroup(group string, addrs []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	wanted := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		wanted[addr] = true
+	}
+
+	keys := make([]string, 0, len(b.keys)+len(addrs))
+	for _, k := range b.keys {
+		if be := b.backends[k]; be.group == group && !wanted[k] {
+			delete(b.backends, k)
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	b.keys = keys
+	for _, addr := range addrs {
+		b.addToGroup(group, addr)
+	}
+}
+
+// Delete removes every instance of the address from the backends
 func (b *Backends) Delete(addr string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -97,13 +380,13 @@ func (b *Backends) Delete(addr string) {
 		return
 	}
 
-	for i, k := range b.keys {
+	keys := b.keys[:0]
+	for _, k := range b.keys {
 		if k != addr {
-			continue
+			keys = append(keys, k)
 		}
-
-		b.keys = append(b.keys[:i], b.keys[i+1:]...)
-		delete(b.backends, addr)
-		break
 	}
+
+	b.keys = keys
+	delete(b.backends, addr)
 }
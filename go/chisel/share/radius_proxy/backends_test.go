@@ -0,0 +1,245 @@
+package radius_proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+var testSecret = []byte("secret")
+
+// realmSelector routes users of a realm to a backend
+type realmSelector map[string]string
+
+func (s realmSelector) Select(packet *radius.Packet, backends []*Backend) *Backend {
+	username := rfc2865.UserName_GetString(packet)
+	i := strings.LastIndex(username, "@")
+	if i == -1 {
+		return nil
+	}
+
+	addr := s[username[i+1:]]
+	for _, be := range backends {
+		if be.Addr() == addr {
+			return be
+		}
+	}
+
+	return nil
+}
+
+func testProxy(addrs ...string) *Proxy {
+	return NewProxy(
+		&ProxyConfig{
+			Addrs:          addrs,
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+		},
+	)
+}
+
+func testPacket(t *testing.T, username string) *radius.Packet {
+	p := radius.New(radius.CodeAccessRequest, testSecret)
+	if err := rfc2865.UserName_SetString(p, username); err != nil {
+		t.Fatalf("Cannot set User-Name: %s", err)
+	}
+
+	return p
+}
+
+func testProxyPacket(t *testing.T, rp *Proxy, p *radius.Packet) string {
+	payload, err := p.Encode()
+	if err != nil {
+		t.Fatalf("Cannot encode packet: %s", err)
+	}
+
+	_, addr, err := rp.ProxyPacket(payload, "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy packet: %s", err)
+	}
+
+	return addr
+}
+
+func TestBackendSelector(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.SetBackendSelector(realmSelector{"a.example": "10.0.0.1:1812", "b.example": "10.0.0.2:1812"})
+
+	if addr := testProxyPacket(t, rp, testPacket(t, "bob@a.example")); addr != "10.0.0.1:1812" {
+		t.Errorf("Expected realm a.example to go to 10.0.0.1:1812, got %s", addr)
+	}
+
+	if addr := testProxyPacket(t, rp, testPacket(t, "bob@b.example")); addr != "10.0.0.2:1812" {
+		t.Errorf("Expected realm b.example to go to 10.0.0.2:1812, got %s", addr)
+	}
+
+	// An established session keeps its backend whatever the selector says
+	rp.backends.sessions.Add("session", time.Minute, rp.backends.backends["10.0.0.1:1812"])
+	p := testPacket(t, "bob@b.example")
+	rfc2865.ProxyState_SetString(p, "session")
+	if addr := testProxyPacket(t, rp, p); addr != "10.0.0.1:1812" {
+		t.Errorf("Expected the session backend 10.0.0.1:1812, got %s", addr)
+	}
+}
+
+func TestSessionBackendErrors(t *testing.T) {
+	b := NewBackends(time.Minute, "10.0.0.1:1812", "10.0.0.2:1812")
+
+	p := testPacket(t, "bob")
+	if _, err := b.sessionBackend(p); err != NoSessionErr {
+		t.Errorf("Expected NoSessionErr without Proxy-State, got %v", err)
+	}
+
+	rfc2865.ProxyState_SetString(p, "unknown")
+	if _, err := b.sessionBackend(p); err != NoSessionErr {
+		t.Errorf("Expected NoSessionErr for an unknown session, got %v", err)
+	}
+
+	gone := b.backends["10.0.0.1:1812"]
+	b.sessions.Add("session", time.Minute, gone)
+	rfc2865.ProxyState_SetString(p, "session")
+	if be, err := b.sessionBackend(p); err != nil || be != gone {
+		t.Errorf("Expected the session backend, got %v %v", be, err)
+	}
+
+	b.Delete("10.0.0.1:1812")
+	if _, err := b.sessionBackend(p); err != BackendGoneErr {
+		t.Errorf("Expected BackendGoneErr, got %v", err)
+	}
+
+	// The session is re-pinned to an available backend
+	be := b.getBackend(p)
+	if be == nil || be.Addr() != "10.0.0.2:1812" {
+		t.Fatalf("Expected the session to move to 10.0.0.2:1812, got %v", be)
+	}
+
+	if repinned, err := b.sessionBackend(p); err != nil || repinned != be {
+		t.Errorf("Session was not re-pinned, got %v %v", repinned, err)
+	}
+}
+
+func TestRealmBackendGroups(t *testing.T) {
+	rp := NewProxy(
+		&ProxyConfig{
+			Addrs:          []string{"10.0.0.1:1812"},
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+			Groups: map[string][]string{
+				"corp":  {"10.0.1.1:1812", "10.0.1.2:1812"},
+				"guest": {"10.0.2.1:1812"},
+			},
+			Realms: map[string]string{"corp": "corp", "GUEST": "guest"},
+		},
+	)
+
+	corp := map[string]bool{"10.0.1.1:1812": true, "10.0.1.2:1812": true}
+	if addr := testProxyPacket(t, rp, testPacket(t, "bob@corp")); !corp[addr] {
+		t.Errorf("Expected bob@corp to go to the corp group, got %s", addr)
+	}
+	if addr := testProxyPacket(t, rp, testPacket(t, "alice@guest")); addr != "10.0.2.1:1812" {
+		t.Errorf("Expected alice@guest to go to the guest group, got %s", addr)
+	}
+	if addr := testProxyPacket(t, rp, testPacket(t, "carol@unknown")); addr != "10.0.0.1:1812" {
+		t.Errorf("Expected an unmatched realm to go to the default group, got %s", addr)
+	}
+
+	// Retransmits stay in the group of the session when its backend is gone
+	p := testPacket(t, "bob@corp")
+	payload, _ := p.Encode()
+	proxied, first, err := rp.ProxyPacket(payload, "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy packet: %s", err)
+	}
+	session, err := radius.Parse(proxied, testSecret)
+	if err != nil {
+		t.Fatalf("Cannot parse the proxied packet: %s", err)
+	}
+
+	rp.DeleteBackend(first)
+	rfc2865.ProxyState_SetString(p, rfc2865.ProxyState_GetString(session))
+	rfc2865.UserName_SetString(p, "bob@guest")
+	if addr := testProxyPacket(t, rp, p); !corp[addr] || addr == first {
+		t.Errorf("Expected the retransmit to stay in the corp group, got %s", addr)
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.AddGroupBackend("corp", "10.0.1.1:1812")
+	b := rp.backends
+	kept := b.backends["10.0.0.1:1812"]
+	b.sessions.Add("kept", time.Minute, kept)
+	b.sessions.Add("removed", time.Minute, b.backends["10.0.0.2:1812"])
+
+	rp.SetBackends([]string{"10.0.0.1:1812", "10.0.0.3:1812"})
+
+	p := testPacket(t, "bob")
+	rfc2865.ProxyState_SetString(p, "kept")
+	if be, err := b.sessionBackend(p); err != nil || be != kept {
+		t.Errorf("Expected the session of the kept backend to be intact, got %v %v", be, err)
+	}
+
+	rfc2865.ProxyState_SetString(p, "removed")
+	if _, err := b.sessionBackend(p); err != BackendGoneErr {
+		t.Errorf("Expected BackendGoneErr for the session of a removed backend, got %v", err)
+	}
+
+	addrs := []string{}
+	for _, be := range b.all() {
+		addrs = append(addrs, be.Group()+"/"+be.Addr())
+	}
+	if strings.Join(addrs, ",") != "/10.0.0.1:1812,corp/10.0.1.1:1812,/10.0.0.3:1812" {
+		t.Errorf("Unexpected backends %v", addrs)
+	}
+}
+
+func TestAddBackendDuplicate(t *testing.T) {
+	rp := testProxy()
+	for i := 0; i < 3; i++ {
+		rp.AddBackend("10.0.0.1:1812")
+	}
+	rp.AddBackend("10.0.0.2:1812")
+
+	if status := rp.Backends(); len(status) != 2 || status[0].Addr != "10.0.0.1:1812" || status[1].Addr != "10.0.0.2:1812" {
+		t.Errorf("Expected the duplicate address once, got %v", status)
+	}
+
+	rp.DeleteBackend("10.0.0.1:1812")
+	if status := rp.Backends(); len(status) != 1 || status[0].Addr != "10.0.0.2:1812" {
+		t.Errorf("Expected every instance of the address to be deleted, got %v", status)
+	}
+}
+
+func TestBackendsStatus(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812")
+	rp.AddBackend("10.0.0.2:1812")
+	rp.SetBackendSelector(realmSelector{"a.example": "10.0.0.2:1812"})
+	start := time.Now()
+	testProxyPacket(t, rp, testPacket(t, "bob@a.example"))
+
+	status := rp.Backends()
+	if len(status) != 2 || status[0].Addr != "10.0.0.1:1812" || status[1].Addr != "10.0.0.2:1812" {
+		t.Fatalf("Unexpected backends %+v", status)
+	}
+
+	if !status[0].LastSeen.IsZero() || status[0].Sessions != 0 {
+		t.Errorf("Expected an unused backend, got %+v", status[0])
+	}
+
+	if status[1].LastSeen.Before(start) || status[1].Sessions != 1 || !status[1].Healthy {
+		t.Errorf("Expected a healthy backend with a session, got %+v", status[1])
+	}
+
+	rp.DeleteBackend("10.0.0.1:1812")
+	rp.AddBackend("10.0.0.3:1812")
+	status = rp.Backends()
+	if len(status) != 2 || status[0].Addr != "10.0.0.2:1812" || status[1].Addr != "10.0.0.3:1812" {
+		t.Errorf("Unexpected backends after the update %+v", status)
+	}
+}
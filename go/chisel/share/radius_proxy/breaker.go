@@ -0,0 +1,86 @@
+package radius_proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBreakerCooldown is the time the packets are routed around a backend once its breaker opens
+const DefaultBreakerCooldown = 30 * time.Second
+
+// ErrNoReply is reported for the backends that did not answer a packet in time
+var ErrNoReply = errors.New("No reply from the backend")
+
+// breaker of a backend, it opens after the threshold of consecutive failures.
+// The backend is then excluded from the selection for the cooldown, after which
+// a single trial packet is sent to it (half-open). The breaker closes on the
+// success of the trial and opens again on its failure.
+type breaker struct {
+	failures int32
+	// UnixNano time the breaker opened or its last trial started, 0 when closed
+	openedAt int64
+}
+
+// open reports if the backend must be routed around
+func (br *breaker) open(now time.Time, cooldown time.Duration) bool {
+	openedAt := atomic.LoadInt64(&br.openedAt)
+	return openedAt != 0 && now.UnixNano()-openedAt < int64(cooldown)
+}
+
+// trial starts the trial of a half-open breaker, the backend is routed
+// around again until the result of the trial or the end of the cooldown
+func (br *breaker) trial(now time.Time, cooldown time.Duration) bool {
+	openedAt := atomic.LoadInt64(&br.openedAt)
+	if openedAt == 0 || now.UnixNano()-openedAt < int64(cooldown) {
+		return false
+	}
+
+	return atomic.CompareAndSwapInt64(&br.openedAt, openedAt, now.UnixNano())
+}
+
+// success closes the breaker and returns if it was open
+func (br *breaker) success() bool {
+	atomic.StoreInt32(&br.failures, 0)
+	return atomic.SwapInt64(&br.openedAt, 0) != 0
+}
+
+// failure counts a consecutive failure and returns if it opened the breaker
+func (br *breaker) failure(now time.Time, threshold int) bool {
+	if atomic.AddInt32(&br.failures, 1) < int32(threshold) {
+		return false
+	}
+
+	return atomic.SwapInt64(&br.openedAt, now.UnixNano()) == 0
+}
+
+// breakerOpen reports if the breaker of the backend routes the packets around it
+func (b *Backends) breakerOpen(be *Backend, now time.Time) bool {
+	return b.breakerThreshold > 0 && be.breaker.open(now, b.breakerCooldown)
+}
+
+// ReportResult records the result of a packet proxied to the backend of addr
+// for its breaker, err is nil when the backend answered
+func (rp *Proxy) ReportResult(addr string, err error) {
+	b := rp.backends
+	if b.breakerThreshold <= 0 {
+		return
+	}
+
+	be := b.get(addr)
+	if be == nil {
+		return
+	}
+
+	if err == nil {
+		if be.breaker.success() {
+			rp.Infof("Backend %s answered, closing its breaker", addr)
+		}
+
+		return
+	}
+
+	if be.breaker.failure(time.Now(), b.breakerThreshold) {
+		rp.Infof("Backend %s failed %d times in a row, opening its breaker for %s: %s", addr, b.breakerThreshold, b.breakerCooldown, err)
+	}
+}
@@ -0,0 +1,89 @@
+package radius_proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+)
+
+// firstSelector picks the first backend available
+type firstSelector struct{}
+
+func (firstSelector) Select(packet *radius.Packet, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	return backends[0]
+}
+
+func TestBreaker(t *testing.T) {
+	rp := NewProxy(
+		&ProxyConfig{
+			Addrs:            []string{"10.0.0.1:1812", "10.0.0.2:1812"},
+			Secret:           testSecret,
+			SessionTimeout:   time.Minute,
+			Logger:           cio.NewLogger("test"),
+			Selector:         firstSelector{},
+			BreakerThreshold: 3,
+			BreakerCooldown:  50 * time.Millisecond,
+		},
+	)
+	expectBackend := func(step, expected string) {
+		t.Helper()
+		if addr := testProxyPacket(t, rp, testPacket(t, "bob")); addr != expected {
+			t.Errorf("%s: expected the packet to go to %s, got %s", step, expected, addr)
+		}
+	}
+
+	failure := errors.New("timeout")
+	rp.ReportResult("10.0.0.1:1812", failure)
+	rp.ReportResult("10.0.0.1:1812", failure)
+	expectBackend("below the threshold", "10.0.0.1:1812")
+
+	rp.ReportResult("10.0.0.1:1812", failure)
+	expectBackend("open", "10.0.0.2:1812")
+	if status := rp.Backends(); !status[0].BreakerOpen || status[1].BreakerOpen {
+		t.Errorf("Expected only the breaker of the failing backend to be open, got %v", status)
+	}
+
+	// half-open, a single trial is sent to the backend
+	time.Sleep(60 * time.Millisecond)
+	expectBackend("trial", "10.0.0.1:1812")
+	expectBackend("trial in progress", "10.0.0.2:1812")
+
+	// the trial fails, the breaker opens again
+	rp.ReportResult("10.0.0.1:1812", failure)
+	expectBackend("failed trial", "10.0.0.2:1812")
+
+	time.Sleep(60 * time.Millisecond)
+	expectBackend("second trial", "10.0.0.1:1812")
+	rp.ReportResult("10.0.0.1:1812", nil)
+	expectBackend("recovered", "10.0.0.1:1812")
+	expectBackend("recovered", "10.0.0.1:1812")
+	if status := rp.Backends(); status[0].BreakerOpen {
+		t.Errorf("Expected the breaker to be closed, got %v", status)
+	}
+
+	// the failures must be consecutive
+	rp.ReportResult("10.0.0.1:1812", failure)
+	rp.ReportResult("10.0.0.1:1812", failure)
+	rp.ReportResult("10.0.0.1:1812", nil)
+	rp.ReportResult("10.0.0.1:1812", failure)
+	expectBackend("not consecutive", "10.0.0.1:1812")
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.SetBackendSelector(firstSelector{})
+	for i := 0; i < 10; i++ {
+		rp.ReportResult("10.0.0.1:1812", ErrNoReply)
+	}
+
+	if addr := testProxyPacket(t, rp, testPacket(t, "bob")); addr != "10.0.0.1:1812" {
+		t.Errorf("Expected no breaker without threshold, got %s", addr)
+	}
+}
@@ -0,0 +1,175 @@
+package radius_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// CoAPort is the port of the NAS receiving CoA and Disconnect requests (RFC 5176)
+const CoAPort = 3799
+
+// CoAForwardFunc sends a CoA or Disconnect request to the NAS and returns its ACK/NAK
+type CoAForwardFunc func(nasIP net.IP, payload []byte) ([]byte, error)
+
+var UnknownNASErr = errors.New("No connector known for the NAS")
+
+// trackNAS remembers the NAS sending requests through this proxy
+func (rp *Proxy) trackNAS(p *radius.Packet) {
+	ip := rfc2865.NASIPAddress_Get(p)
+	if ip == nil {
+		return
+	}
+
+	rp.nases.Store(ip.String(), time.Now())
+}
+
+// HasNAS tells if requests of the NAS were proxied within the NAS timeout
+func (rp *Proxy) HasNAS(ip net.IP) bool {
+	val, ok := rp.nases.Load(ip.String())
+	if !ok {
+		return false
+	}
+
+	return time.Since(val.(time.Time)) < nasTimeout
+}
+
+const nasTimeout = 24 * time.Hour
+
+// expireNASes forgets the NAS that sent no request within the NAS timeout
+func (rp *Proxy) expireNASes(now time.Time) {
+	rp.nases.Range(func(k, v interface{}) bool {
+		if now.Sub(v.(time.Time)) >= nasTimeout {
+			rp.nases.Delete(k)
+		}
+
+		return true
+	})
+}
+
+// ParseCoASources parses the comma separated IPs and CIDRs allowed to send CoA requests
+func ParseCoASources(s string) ([]*net.IPNet, error) {
+	var sources []*net.IPNet
+	for _, source := range strings.Split(s, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CoA source %q", source)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			sources = append(sources, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CoA source %q: %w", source, err)
+		}
+
+		sources = append(sources, ipNet)
+	}
+
+	return sources, nil
+}
+
+func allowedSource(addr net.Addr, sources []*net.IPNet) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, source := range sources {
+		if source.Contains(udpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsCoA tells if the packet is a CoA or a Disconnect request
+func IsCoA(p *radius.Packet) bool {
+	return p.Code == radius.CodeCoARequest || p.Code == radius.CodeDisconnectRequest
+}
+
+// ServeCoA reads the CoA and Disconnect requests sent to conn and forwards them,
+// unmodified, to the NAS found in their NAS-IP-Address. The ACK/NAK of the NAS
+// is sent back to the originator. The requests from outside of sources are dropped.
+// It blocks until the context is cancelled.
+func ServeCoA(ctx context.Context, l *cio.Logger, conn net.PacketConn, sources []*net.IPNet, forward CoAForwardFunc) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	const maxPacketSize = 4096
+	buff := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		if !allowedSource(addr, sources) {
+			l.Infof("Dropping CoA packet from %s, not an allowed source", addr)
+			continue
+		}
+
+		payload := make([]byte, n)
+		copy(payload, buff[:n])
+		go handleCoA(l, conn, addr, payload, forward)
+	}
+}
+
+func handleCoA(l *cio.Logger, conn net.PacketConn, addr net.Addr, payload []byte, forward CoAForwardFunc) {
+	// The shared secret is only needed to decrypt attributes, the packet is relayed as is
+	packet, err := radius.Parse(payload, nil)
+	if err != nil {
+		l.Infof("Invalid CoA packet from %s: %s", addr, err)
+		return
+	}
+
+	if !IsCoA(packet) {
+		l.Infof("Ignoring %s from %s on the CoA port", packet.Code, addr)
+		return
+	}
+
+	nasIP := rfc2865.NASIPAddress_Get(packet)
+	if nasIP == nil {
+		l.Infof("Ignoring %s from %s without NAS-IP-Address", packet.Code, addr)
+		return
+	}
+
+	l.Debugf("Forwarding %s from %s to NAS %s", packet.Code, addr, nasIP)
+	reply, err := forward(nasIP, payload)
+	if err != nil {
+		l.Infof("Cannot forward %s to NAS %s: %s", packet.Code, nasIP, err)
+		return
+	}
+
+	if _, err := conn.WriteTo(reply, addr); err != nil {
+		l.Infof("Cannot send the reply of NAS %s to %s: %s", nasIP, addr, err)
+	}
+}
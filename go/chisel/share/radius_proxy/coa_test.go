@@ -0,0 +1,131 @@
+package radius_proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestServeCoA(t *testing.T) {
+	nasIP := net.ParseIP("192.0.2.10")
+	rp := testProxy("10.0.0.1:1812")
+	p := testPacket(t, "bob")
+	rfc2865.NASIPAddress_Set(p, nasIP)
+	testProxyPacket(t, rp, p)
+	if !rp.HasNAS(nasIP) {
+		t.Fatalf("NAS %s was not tracked", nasIP)
+	}
+
+	forward := func(ip net.IP, payload []byte) ([]byte, error) {
+		if !rp.HasNAS(ip) {
+			return nil, UnknownNASErr
+		}
+
+		request, err := radius.Parse(payload, testSecret)
+		if err != nil {
+			return nil, err
+		}
+
+		return request.Response(radius.CodeCoAACK).Encode()
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sources, err := ParseCoASources("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Cannot parse the sources: %s", err)
+	}
+
+	go ServeCoA(ctx, cio.NewLogger("test"), conn, sources, forward)
+
+	coa := radius.New(radius.CodeCoARequest, testSecret)
+	rfc2865.NASIPAddress_Set(coa, nasIP)
+	reply, err := radius.Exchange(ctx, coa, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("No reply to the CoA request: %s", err)
+	}
+
+	if reply.Code != radius.CodeCoAACK {
+		t.Errorf("Expected a CoA-ACK, got %s", reply.Code)
+	}
+
+	// Requests for an unknown NAS are dropped
+	rfc2865.NASIPAddress_Set(coa, net.ParseIP("192.0.2.20"))
+	ctx, cancelExchange := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelExchange()
+	if _, err := radius.Exchange(ctx, coa, conn.LocalAddr().String()); err == nil {
+		t.Errorf("Expected no reply for an unknown NAS")
+	}
+}
+
+func TestServeCoAUnknownSource(t *testing.T) {
+	forwarded := make(chan struct{}, 1)
+	forward := func(ip net.IP, payload []byte) ([]byte, error) {
+		forwarded <- struct{}{}
+		return nil, UnknownNASErr
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+
+	sources, err := ParseCoASources("192.0.2.0/24, 2001:db8::1")
+	if err != nil {
+		t.Fatalf("Cannot parse the sources: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeCoA(ctx, cio.NewLogger("test"), conn, sources, forward)
+
+	coa := radius.New(radius.CodeCoARequest, testSecret)
+	rfc2865.NASIPAddress_Set(coa, net.ParseIP("192.0.2.10"))
+	ctx, cancelExchange := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelExchange()
+	if _, err := radius.Exchange(ctx, coa, conn.LocalAddr().String()); err == nil {
+		t.Errorf("Expected no reply to a source that is not allowed")
+	}
+
+	select {
+	case <-forwarded:
+		t.Errorf("Request of a source that is not allowed was forwarded")
+	default:
+	}
+}
+
+func TestParseCoASources(t *testing.T) {
+	if _, err := ParseCoASources("127.0.0.1,nope"); err == nil {
+		t.Errorf("Expected an error for an invalid source")
+	}
+
+	sources, err := ParseCoASources("")
+	if err != nil || len(sources) != 0 {
+		t.Errorf("Expected no sources, got %v (%v)", sources, err)
+	}
+}
+
+func TestExpireNASes(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812")
+	now := time.Now()
+	rp.nases.Store("192.0.2.10", now.Add(-nasTimeout))
+	rp.nases.Store("192.0.2.20", now.Add(-time.Minute))
+	rp.expireNASes(now)
+	if _, ok := rp.nases.Load("192.0.2.10"); ok {
+		t.Errorf("Expected the stale NAS to be forgotten")
+	}
+
+	if _, ok := rp.nases.Load("192.0.2.20"); !ok {
+		t.Errorf("Expected the recent NAS to be kept")
+	}
+}
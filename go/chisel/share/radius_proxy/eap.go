@@ -0,0 +1,59 @@
+package radius_proxy
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// Types of the EAP methods (RFC 3748), see SetEAPTypeGroup
+const (
+	EAPTypeIdentity uint8 = 1
+	EAPTypeTLS      uint8 = 13
+	EAPTypeTTLS     uint8 = 21
+	EAPTypePEAP     uint8 = 25
+)
+
+// Codes of the EAP packets carrying a type
+const (
+	eapCodeRequest  = 1
+	eapCodeResponse = 2
+)
+
+// eapType returns the type of the EAP packet split across the EAP-Message attributes of the packet
+func eapType(p *radius.Packet) (uint8, bool) {
+	var eap []byte
+	for _, avp := range p.Attributes {
+		if avp.Type == rfc2869.EAPMessage_Type {
+			eap = append(eap, avp.Attribute...)
+			// the type follows the code, the identifier and the length
+			if len(eap) > 4 {
+				break
+			}
+		}
+	}
+
+	if len(eap) < 5 || (eap[0] != eapCodeRequest && eap[0] != eapCodeResponse) {
+		return 0, false
+	}
+
+	return eap[4], true
+}
+
+// eapGroup returns the group of the EAP type of the packet, the lock must be held
+func (b *Backends) eapGroup(p *radius.Packet) string {
+	if t, ok := eapType(p); ok {
+		if group, found := b.eapTypes[t]; found {
+			return group
+		}
+	}
+
+	return DefaultBackendGroup
+}
+
+// SetEAPTypeGroup routes the new sessions of the EAP type to the backends of the group,
+// the packets whose realm is mapped to a group stay in the group of their realm
+func (b *Backends) SetEAPTypeGroup(eapType uint8, group string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.eapTypes[eapType] = group
+}
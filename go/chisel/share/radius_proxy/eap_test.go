@@ -0,0 +1,95 @@
+package radius_proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// testEAPPacket returns a packet of the user carrying an EAP-Response of the type
+func testEAPPacket(t *testing.T, username string, eapType uint8) *radius.Packet {
+	p := testPacket(t, username)
+	if err := rfc2869.EAPMessage_Set(p, []byte{eapCodeResponse, 1, 0, 6, eapType, 0}); err != nil {
+		t.Fatalf("Cannot set EAP-Message: %s", err)
+	}
+
+	return p
+}
+
+func TestEAPTypeGroups(t *testing.T) {
+	rp := NewProxy(
+		&ProxyConfig{
+			Addrs:          []string{"10.0.0.1:1812"},
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+			Groups: map[string][]string{
+				"tls":  {"10.0.1.1:1812"},
+				"peap": {"10.0.2.1:1812"},
+				"corp": {"10.0.3.1:1812"},
+			},
+			Realms:   map[string]string{"corp": "corp"},
+			EAPTypes: map[uint8]string{EAPTypeTLS: "tls", EAPTypePEAP: "peap"},
+		},
+	)
+	defer Collector.remove(rp.metrics)
+
+	tests := []struct {
+		name     string
+		packet   *radius.Packet
+		expected string
+	}{
+		{name: "EAP-TLS", packet: testEAPPacket(t, "bob", EAPTypeTLS), expected: "10.0.1.1:1812"},
+		{name: "PEAP", packet: testEAPPacket(t, "bob", EAPTypePEAP), expected: "10.0.2.1:1812"},
+		{name: "EAP-TTLS", packet: testEAPPacket(t, "bob", EAPTypeTTLS), expected: "10.0.0.1:1812"},
+		{name: "non EAP", packet: testPacket(t, "bob"), expected: "10.0.0.1:1812"},
+		{name: "realm", packet: testEAPPacket(t, "bob@corp", EAPTypeTLS), expected: "10.0.3.1:1812"},
+	}
+	for _, test := range tests {
+		if addr := testProxyPacket(t, rp, test.packet); addr != test.expected {
+			t.Errorf("Expected the %s packet to go to %s, got %s", test.name, test.expected, addr)
+		}
+	}
+
+	// the session keeps its backend once the EAP conversation started
+	p := testEAPPacket(t, "bob", EAPTypePEAP)
+	payload, _ := p.Encode()
+	proxied, _, err := rp.ProxyPacket(payload, "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy packet: %s", err)
+	}
+	session, err := radius.Parse(proxied, testSecret)
+	if err != nil {
+		t.Fatalf("Cannot parse the proxied packet: %s", err)
+	}
+
+	next := testEAPPacket(t, "bob", EAPTypeTLS)
+	rfc2865.ProxyState_SetString(next, rfc2865.ProxyState_GetString(session))
+	if addr := testProxyPacket(t, rp, next); addr != "10.0.2.1:1812" {
+		t.Errorf("Expected the session to stay on the PEAP backend, got %s", addr)
+	}
+}
+
+func TestEAPType(t *testing.T) {
+	p := testPacket(t, "bob")
+	if _, ok := eapType(p); ok {
+		t.Errorf("Expected no EAP type without EAP-Message")
+	}
+
+	// the EAP packet can be split across the attributes
+	p.Add(rfc2869.EAPMessage_Type, radius.Attribute{eapCodeResponse, 1, 0})
+	p.Add(rfc2869.EAPMessage_Type, radius.Attribute{6, EAPTypePEAP, 0})
+	if eap, ok := eapType(p); !ok || eap != EAPTypePEAP {
+		t.Errorf("Expected the PEAP type, got %d %t", eap, ok)
+	}
+
+	success := testPacket(t, "bob")
+	success.Add(rfc2869.EAPMessage_Type, radius.Attribute{3, 1, 0, 4})
+	if _, ok := eapType(success); ok {
+		t.Errorf("Expected no EAP type for an EAP-Success")
+	}
+}
@@ -0,0 +1,143 @@
+package radius_proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultHealthCheckPath    = "/health"
+	DefaultHealthCheckTimeout = 5 * time.Second
+)
+
+// LoadTLSConfig builds the TLS config used to contact the backends from
+// the client certificate and key files, the system CAs are trusted when caFile is empty
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load the client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caCerts, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read the CA file: %w", err)
+		}
+
+		rootCAs := x509.NewCertPool()
+		if ok := rootCAs.AppendCertsFromPEM(caCerts); !ok {
+			return nil, fmt.Errorf("No CA certificate found in %s", caFile)
+		}
+
+		config.RootCAs = rootCAs
+	}
+
+	return config, nil
+}
+
+func newHealthCheckClient(config *ProxyConfig) *http.Client {
+	timeout := config.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   config.TLSConfig,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func (rp *Proxy) healthCheckURL(be *Backend) (string, error) {
+	host, _, err := net.SplitHostPort(be.addr)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if rp.tlsConfig != nil {
+		scheme = "https"
+	}
+
+	path := rp.healthCheckPath
+	if path == "" {
+		path = DefaultHealthCheckPath
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(rp.healthCheckPort)) + path, nil
+}
+
+// checkBackend queries the health endpoint of the backend, a failed
+// TLS handshake is an error like a timeout or an unexpected status
+func (rp *Proxy) checkBackend(be *Backend) error {
+	url, err := rp.healthCheckURL(be)
+	if err != nil {
+		return err
+	}
+
+	res, err := rp.healthClient.Get(url)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("Unexpected health check status " + res.Status)
+	}
+
+	return nil
+}
+
+// Ready reports if the proxy has a backend to send packets to,
+// it must also be healthy when the health checks are enabled
+func (rp *Proxy) Ready() bool {
+	return rp.backends.ready(rp.healthCheckPort != 0)
+}
+
+// CheckBackends updates the health of all the backends
+func (rp *Proxy) CheckBackends() {
+	if rp.healthCheckPort == 0 {
+		return
+	}
+
+	for _, be := range rp.backends.all() {
+		err := rp.checkBackend(be)
+		healthy := err == nil
+		if be.setHealthy(healthy) != healthy {
+			if healthy {
+				rp.Infof("Backend %s is healthy", be.addr)
+			} else {
+				rp.Infof("Backend %s is unhealthy: %s", be.addr, err)
+			}
+		}
+	}
+}
+
+// HealthCheck checks the health of the backends every tick until stop is closed
+func (rp *Proxy) HealthCheck(tick time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(tick)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			rp.CheckBackends()
+		case <-stop:
+			ticker.Stop()
+			break loop
+		}
+	}
+}
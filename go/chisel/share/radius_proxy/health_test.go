@@ -0,0 +1,172 @@
+package radius_proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+)
+
+// writeClientCert writes a self-signed client certificate and its key in dir
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pfconnector"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Cannot parse certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Cannot write certificate: %s", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Cannot write key: %s", err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+func TestHealthCheckClientCert(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t, t.TempDir())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != DefaultHealthCheckPath {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	healthCheckPort, _ := strconv.Atoi(port)
+	serverCAs := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	newProxy := func(tlsConfig *tls.Config) *Proxy {
+		tlsConfig.RootCAs = serverCAs
+		return NewProxy(&ProxyConfig{
+			Addrs:              []string{"127.0.0.1:1812"},
+			Secret:             testSecret,
+			SessionTimeout:     time.Minute,
+			Logger:             cio.NewLogger("test"),
+			TLSConfig:          tlsConfig,
+			HealthCheckPort:    healthCheckPort,
+			HealthCheckTimeout: 10 * time.Second,
+		})
+	}
+
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Cannot load the TLS config: %s", err)
+	}
+
+	rp := newProxy(tlsConfig)
+	rp.CheckBackends()
+	if be := rp.backends.all()[0]; !be.Healthy() {
+		t.Errorf("Expected %s to be healthy with the client certificate", be.Addr())
+	}
+
+	rp = newProxy(&tls.Config{})
+	start := time.Now()
+	rp.CheckBackends()
+	if be := rp.backends.all()[0]; be.Healthy() {
+		t.Errorf("Expected %s to be unhealthy without a client certificate", be.Addr())
+	}
+
+	if elapsed := time.Since(start); elapsed >= 10*time.Second {
+		t.Errorf("Expected the failed handshake to be detected before the timeout, took %s", elapsed)
+	}
+}
+
+func TestUnhealthyBackendSkipped(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.backends.all()[0].setHealthy(false)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		if addr := testProxyPacket(t, rp, testPacket(t, username)); addr != "10.0.0.2:1812" {
+			t.Errorf("Expected the healthy backend for %s, got %s", username, addr)
+		}
+	}
+
+	rp.backends.all()[1].setHealthy(false)
+	if addr := testProxyPacket(t, rp, testPacket(t, "alice")); addr == "" {
+		t.Errorf("Expected a backend when all of them are unhealthy")
+	}
+}
+
+func TestReady(t *testing.T) {
+	rp := testProxy()
+	if rp.Ready() {
+		t.Errorf("Expected a proxy without backends not to be ready")
+	}
+
+	rp.AddBackend("10.0.0.1:1812")
+	if !rp.Ready() {
+		t.Errorf("Expected a proxy with a backend to be ready")
+	}
+
+	rp.backends.all()[0].setHealthy(false)
+	if !rp.Ready() {
+		t.Errorf("Expected the health to be ignored without health checks")
+	}
+
+	rp.healthCheckPort = 2083
+	if rp.Ready() {
+		t.Errorf("Expected a proxy without healthy backends not to be ready")
+	}
+
+	rp.AddBackend("10.0.0.2:1812")
+	if !rp.Ready() {
+		t.Errorf("Expected a proxy with a healthy backend to be ready")
+	}
+
+	rp.DeleteBackend("10.0.0.2:1812")
+	if rp.Ready() {
+		t.Errorf("Expected the proxy not to be ready once the healthy backend is deleted")
+	}
+}
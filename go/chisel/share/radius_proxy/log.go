@@ -3,6 +3,7 @@ package radius_proxy
 import (
 	"encoding/hex"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/inverse-inc/go-radius/dictionary"
 	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
@@ -10,6 +11,32 @@ import (
 	"layeh.com/radius/rfc2865"
 )
 
+// Longest attribute value logged, longer ones are truncated
+const MaxLogValueLen = 256
+
+// LogValue makes an attribute value safe to log: non-printable characters
+// are escaped so a value cannot break a log line and long values are truncated
+func LogValue(value string) string {
+	truncated := 0
+	if len(value) > MaxLogValueLen {
+		end := MaxLogValueLen
+		for end > 0 && !utf8.RuneStart(value[end]) {
+			end--
+		}
+
+		truncated = len(value) - end
+		value = value[:end]
+	}
+
+	quoted := strconv.QuoteToGraphic(value)
+	quoted = quoted[1 : len(quoted)-1]
+	if truncated > 0 {
+		quoted += "...(" + strconv.Itoa(truncated) + " more bytes)"
+	}
+
+	return quoted
+}
+
 func LogPacket(l *cio.Logger, p *radius.Packet) {
 	l.Printf("Radius packet %s", p.Code.String())
 	l.Printf("Attributes")
@@ -32,11 +59,11 @@ func LogPacket(l *cio.Logger, p *radius.Packet) {
 					continue
 				}
 
-				l.Printf("\t%s => %s", dictAttr.Name, AttributeToString(dictAttr, radius.Attribute(data)))
+				l.Printf("\t%s => %s", dictAttr.Name, LogValue(AttributeToString(dictAttr, radius.Attribute(data))))
 			}
 		} else {
 			dictAttr := radiusDictionary.GetAttributeByOID([]int{int(a.Type)})
-			l.Printf("\t%s => %s", dictAttr.Name, AttributeToString(dictAttr, a.Attribute))
+			l.Printf("\t%s => %s", dictAttr.Name, LogValue(AttributeToString(dictAttr, a.Attribute)))
 		}
 	}
 }
@@ -0,0 +1,35 @@
+package radius_proxy
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestLogValue(t *testing.T) {
+	p := testPacket(t, "bob\n2024/01/01 00:00:00 tun: forged\r\x1b[31m")
+	var buf bytes.Buffer
+	l := log.New(&buf, "", 0)
+	l.Printf("\t%s => %s", "User-Name", LogValue(radius.String(rfc2865.UserName_Get(p))))
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("Expected a single log line, got %q", line)
+	}
+
+	if expected := `bob\n2024/01/01 00:00:00 tun: forged\r\x1b[31m`; !strings.Contains(line, expected) {
+		t.Errorf("Expected %q in the log line, got %q", expected, line)
+	}
+
+	if got := LogValue("é"); got != "é" {
+		t.Errorf("Expected printable characters to be kept, got %q", got)
+	}
+
+	long := strings.Repeat("a", MaxLogValueLen+10)
+	if got, expected := LogValue(long), strings.Repeat("a", MaxLogValueLen)+"...(10 more bytes)"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,144 @@
+package radius_proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptions of the metrics of the proxies
+var (
+	sessionsDesc = prometheus.NewDesc(
+		"pfconnector_radius_proxy_sessions",
+		"Number of RADIUS sessions in the session stores after the last cleanup.",
+		nil, nil,
+	)
+	sessionsEvictedDesc = prometheus.NewDesc(
+		"pfconnector_radius_proxy_sessions_evicted_total",
+		"Counter of expired RADIUS sessions evicted by the cleanup.",
+		nil, nil,
+	)
+	poolHitsDesc = prometheus.NewDesc(
+		"pfconnector_radius_proxy_pool_hits_total",
+		"Counter of backend connections reused from the pool.",
+		nil, nil,
+	)
+	poolMissesDesc = prometheus.NewDesc(
+		"pfconnector_radius_proxy_pool_misses_total",
+		"Counter of backend connections dialed because the pool had none idle.",
+		nil, nil,
+	)
+	rateLimitedDesc = prometheus.NewDesc(
+		"pfconnector_radius_proxy_rate_limited_total",
+		"Counter of RADIUS packets dropped because their NAS exceeded its rate.",
+		nil, nil,
+	)
+)
+
+// Collector exports the metrics of the proxies, summed over all of them
+var Collector = newProxyCollector()
+
+func init() {
+	prometheus.MustRegister(Collector)
+}
+
+// proxyMetrics are the metrics of a proxy, the methods are no-ops on nil
+type proxyMetrics struct {
+	sessions        int64
+	sessionsEvicted int64
+	poolHits        int64
+	poolMisses      int64
+	rateLimited     int64
+}
+
+func (m *proxyMetrics) setSessions(n int) {
+	if m != nil {
+		atomic.StoreInt64(&m.sessions, int64(n))
+	}
+}
+
+func (m *proxyMetrics) addEvicted(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.sessionsEvicted, int64(n))
+	}
+}
+
+func (m *proxyMetrics) poolHit() {
+	if m != nil {
+		atomic.AddInt64(&m.poolHits, 1)
+	}
+}
+
+func (m *proxyMetrics) poolMiss() {
+	if m != nil {
+		atomic.AddInt64(&m.poolMisses, 1)
+	}
+}
+
+func (m *proxyMetrics) rateLimit() {
+	if m != nil {
+		atomic.AddInt64(&m.rateLimited, 1)
+	}
+}
+
+// ProxyCollector is the prometheus collector of the metrics of the proxies
+type ProxyCollector struct {
+	lock    sync.Mutex
+	proxies map[*proxyMetrics]struct{}
+	// counters of the removed proxies so the totals never decrease
+	removed proxyMetrics
+}
+
+func newProxyCollector() *ProxyCollector {
+	return &ProxyCollector{proxies: map[*proxyMetrics]struct{}{}}
+}
+
+func (c *ProxyCollector) add(m *proxyMetrics) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.proxies[m] = struct{}{}
+}
+
+func (c *ProxyCollector) remove(m *proxyMetrics) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, found := c.proxies[m]; !found {
+		return
+	}
+
+	delete(c.proxies, m)
+	c.removed.sessionsEvicted += atomic.LoadInt64(&m.sessionsEvicted)
+	c.removed.poolHits += atomic.LoadInt64(&m.poolHits)
+	c.removed.poolMisses += atomic.LoadInt64(&m.poolMisses)
+	c.removed.rateLimited += atomic.LoadInt64(&m.rateLimited)
+}
+
+// Describe implements prometheus.Collector
+func (c *ProxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- sessionsEvictedDesc
+	ch <- poolHitsDesc
+	ch <- poolMissesDesc
+	ch <- rateLimitedDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *ProxyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	total := c.removed
+	for m := range c.proxies {
+		total.sessions += atomic.LoadInt64(&m.sessions)
+		total.sessionsEvicted += atomic.LoadInt64(&m.sessionsEvicted)
+		total.poolHits += atomic.LoadInt64(&m.poolHits)
+		total.poolMisses += atomic.LoadInt64(&m.poolMisses)
+		total.rateLimited += atomic.LoadInt64(&m.rateLimited)
+	}
+	c.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(total.sessions))
+	ch <- prometheus.MustNewConstMetric(sessionsEvictedDesc, prometheus.CounterValue, float64(total.sessionsEvicted))
+	ch <- prometheus.MustNewConstMetric(poolHitsDesc, prometheus.CounterValue, float64(total.poolHits))
+	ch <- prometheus.MustNewConstMetric(poolMissesDesc, prometheus.CounterValue, float64(total.poolMisses))
+	ch <- prometheus.MustNewConstMetric(rateLimitedDesc, prometheus.CounterValue, float64(total.rateLimited))
+}
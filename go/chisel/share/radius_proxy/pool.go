@@ -0,0 +1,244 @@
+package radius_proxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolMaxIdle     = 2
+	DefaultPoolIdleTimeout = time.Minute
+	DefaultPoolDialTimeout = 5 * time.Second
+	// Time allowed to a backend to answer a request over RadSec
+	DefaultExchangeTimeout = 5 * time.Second
+)
+
+// Size of the RADIUS header holding the length of the packet
+const radiusHeaderLen = 4
+
+// Minimum length of a RADIUS packet (RFC 2865)
+const radiusMinPacketLen = 20
+
+// ErrPoolExhausted is returned when a backend has MaxActive connections in use
+var ErrPoolExhausted = errors.New("Backend connection pool exhausted")
+
+// PoolConfig configures the connections kept to each backend over TCP (RadSec)
+type PoolConfig struct {
+	// Maximum idle connections kept per backend, defaults to DefaultPoolMaxIdle
+	MaxIdle int
+	// Maximum connections open at once per backend, 0 is unlimited
+	MaxActive int
+	// Idle connections unused for longer are closed, defaults to DefaultPoolIdleTimeout
+	IdleTimeout time.Duration
+}
+
+// ConnPool keeps the connections to the backends between the requests
+// to avoid a TCP and TLS handshake per request. UDP is not pooled.
+type ConnPool struct {
+	config   PoolConfig
+	dial     func(network, addr string) (net.Conn, error)
+	lock     sync.Mutex
+	backends map[string]*backendPool
+	// metrics of the proxy owning the pool, nil when it has none
+	metrics *proxyMetrics
+}
+
+type backendPool struct {
+	idle   []idleConn
+	active int
+}
+
+type idleConn struct {
+	conn  *pooledConn
+	since time.Time
+}
+
+// pooledConn is a connection of the pool, it goes back to it with Put
+type pooledConn struct {
+	net.Conn
+	addr string
+}
+
+func NewConnPool(config PoolConfig, dial func(network, addr string) (net.Conn, error)) *ConnPool {
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = DefaultPoolMaxIdle
+	}
+
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultPoolIdleTimeout
+	}
+
+	return &ConnPool{
+		config:   config,
+		dial:     dial,
+		backends: map[string]*backendPool{},
+	}
+}
+
+// TLSDialer dials the backends over TLS, the sessions are cached
+// so the new connections to a backend resume them
+func TLSDialer(config *tls.Config, timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	config = config.Clone()
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: config}
+	return dialer.Dial
+}
+
+// Get returns an idle connection to the backend or dials a new one,
+// UDP is always dialed since there is no connection to reuse
+func (p *ConnPool) Get(network, addr string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		return net.Dial(network, addr)
+	}
+
+	p.lock.Lock()
+	bp := p.backends[addr]
+	if bp == nil {
+		bp = &backendPool{}
+		p.backends[addr] = bp
+	}
+
+	for len(bp.idle) > 0 {
+		last := bp.idle[len(bp.idle)-1]
+		bp.idle = bp.idle[:len(bp.idle)-1]
+		if time.Since(last.since) > p.config.IdleTimeout {
+			last.conn.Conn.Close()
+			bp.active--
+			continue
+		}
+
+		p.lock.Unlock()
+		p.metrics.poolHit()
+		return last.conn, nil
+	}
+
+	if p.config.MaxActive > 0 && bp.active >= p.config.MaxActive {
+		p.lock.Unlock()
+		return nil, ErrPoolExhausted
+	}
+
+	bp.active++
+	p.lock.Unlock()
+	p.metrics.poolMiss()
+	conn, err := p.dial(network, addr)
+	if err != nil {
+		p.lock.Lock()
+		bp.active--
+		p.lock.Unlock()
+		return nil, err
+	}
+
+	return &pooledConn{Conn: conn, addr: addr}, nil
+}
+
+// Put gives back a connection returned by Get, err is the error of its last use.
+// The connection is closed when it failed, is not pooled or exceeds MaxIdle.
+func (p *ConnPool) Put(conn net.Conn, err error) {
+	pc, ok := conn.(*pooledConn)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	bp := p.backends[pc.addr]
+	if err != nil || len(bp.idle) >= p.config.MaxIdle {
+		pc.Conn.Close()
+		bp.active--
+		return
+	}
+
+	bp.idle = append(bp.idle, idleConn{conn: pc, since: time.Now()})
+}
+
+// Close closes the idle connections
+func (p *ConnPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, bp := range p.backends {
+		for _, idle := range bp.idle {
+			idle.conn.Conn.Close()
+			bp.active--
+		}
+
+		bp.idle = nil
+	}
+}
+
+// Exchange sends the packet to the backend over RadSec with a connection
+// of the pool and returns the response of the backend
+func (rp *Proxy) Exchange(packet []byte, addr string) ([]byte, error) {
+	conn, err := rp.pool.Get("tcp", addr)
+	if err != nil {
+		rp.ReportResult(addr, err)
+		return nil, err
+	}
+
+	timeout := rp.requestTimeout
+	if timeout <= 0 {
+		timeout = DefaultExchangeTimeout
+	}
+
+	reply, err := exchangeStream(conn, packet, rp.maxPacketSize, timeout)
+	rp.pool.Put(conn, err)
+	rp.ReportResult(addr, err)
+	return reply, err
+}
+
+// exchangeStream writes the packet to the stream and reads the response within timeout
+func exchangeStream(conn net.Conn, packet []byte, maxSize int, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	reply, err := readPacket(conn, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection goes back to the pool without deadline
+	return reply, conn.SetDeadline(time.Time{})
+}
+
+// readPacket reads a RADIUS packet from a stream, its length is in its header
+func readPacket(r io.Reader, maxSize int) ([]byte, error) {
+	header := make([]byte, radiusHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	if length < radiusMinPacketLen {
+		return nil, errors.New("Invalid RADIUS packet length")
+	}
+
+	packet := make([]byte, length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[radiusHeaderLen:]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,226 @@
+package radius_proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+)
+
+// tcpBackend accepts TCP connections and keeps them open
+func tcpBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	addr := tcpBackend(t)
+	dials := 0
+	pool := NewConnPool(PoolConfig{MaxActive: 1}, func(network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, addr)
+	})
+	defer pool.Close()
+	pool.metrics = &proxyMetrics{}
+
+	first, err := pool.Get("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot get a connection: %s", err)
+	}
+
+	if _, err := pool.Get("tcp", addr); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected the pool to be exhausted, got %v", err)
+	}
+
+	pool.Put(first, nil)
+	second, err := pool.Get("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot get a connection: %s", err)
+	}
+
+	if second != first || dials != 1 {
+		t.Errorf("Expected the connection to be reused, got %d dials", dials)
+	}
+
+	if pool.metrics.poolHits != 1 {
+		t.Errorf("Expected 1 pool hit, got %d", pool.metrics.poolHits)
+	}
+
+	if pool.metrics.poolMisses != 1 {
+		t.Errorf("Expected 1 pool miss, got %d", pool.metrics.poolMisses)
+	}
+
+	// A failed connection is not reused
+	pool.Put(second, errors.New("broken"))
+	third, err := pool.Get("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot get a connection: %s", err)
+	}
+
+	if third == second || dials != 2 {
+		t.Errorf("Expected a new connection after a failure, got %d dials", dials)
+	}
+
+	pool.Put(third, nil)
+}
+
+func TestConnPoolUDP(t *testing.T) {
+	dials := 0
+	pool := NewConnPool(PoolConfig{}, func(network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, addr)
+	})
+
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Get("udp", "127.0.0.1:1812")
+		if err != nil {
+			t.Fatalf("Cannot get a connection: %s", err)
+		}
+
+		pool.Put(conn, nil)
+	}
+
+	if dials != 0 || len(pool.backends) != 0 {
+		t.Errorf("Expected UDP not to be pooled, got %d dials", dials)
+	}
+}
+
+// radSecBackend accepts RADIUS packets over TCP and answers them with an Access-Accept
+func radSecBackend(t *testing.T) string {
+	return slowRadSecBackend(t, 0)
+}
+
+// slowRadSecBackend is a radSecBackend answering after delay
+func slowRadSecBackend(t *testing.T, delay time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				for {
+					payload, err := readPacket(conn, DefaultMaxPacketSize)
+					if err != nil {
+						return
+					}
+
+					request, err := radius.Parse(payload, testSecret)
+					if err != nil {
+						return
+					}
+
+					reply, err := request.Response(radius.CodeAccessAccept).Encode()
+					if err != nil {
+						return
+					}
+
+					time.Sleep(delay)
+					conn.Write(reply)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestExchange(t *testing.T) {
+	addr := radSecBackend(t)
+	rp := testProxy(addr)
+	dials := 0
+	rp.pool = NewConnPool(PoolConfig{}, func(network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, addr)
+	})
+	defer rp.pool.Close()
+
+	for i := 0; i < 3; i++ {
+		payload, err := testPacket(t, "bob").Encode()
+		if err != nil {
+			t.Fatalf("Cannot encode packet: %s", err)
+		}
+
+		reply, err := rp.Exchange(payload, addr)
+		if err != nil {
+			t.Fatalf("Cannot exchange the packet: %s", err)
+		}
+
+		response, err := radius.Parse(reply, testSecret)
+		if err != nil || response.Code != radius.CodeAccessAccept {
+			t.Errorf("Expected an Access-Accept, got %v (%v)", response, err)
+		}
+	}
+
+	if dials != 1 {
+		t.Errorf("Expected the connection to be reused, got %d dials", dials)
+	}
+}
+
+func TestExchangeRequestTimeout(t *testing.T) {
+	addr := slowRadSecBackend(t, 300*time.Millisecond)
+	exchange := func(requestTimeout time.Duration) (*Proxy, time.Duration, error) {
+		rp := NewProxy(
+			&ProxyConfig{
+				Addrs:          []string{addr},
+				Secret:         testSecret,
+				SessionTimeout: time.Hour,
+				Logger:         cio.NewLogger("test"),
+				RequestTimeout: requestTimeout,
+			},
+		)
+		rp.pool = NewConnPool(PoolConfig{}, net.Dial)
+		t.Cleanup(func() {
+			rp.pool.Close()
+			Collector.remove(rp.metrics)
+		})
+		payload, err := testPacket(t, "bob").Encode()
+		if err != nil {
+			t.Fatalf("Cannot encode packet: %s", err)
+		}
+
+		start := time.Now()
+		_, err = rp.Exchange(payload, addr)
+		return rp, time.Since(start), err
+	}
+
+	rp, elapsed, err := exchange(50 * time.Millisecond)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected the request to time out, got %v", err)
+	}
+	if elapsed >= 300*time.Millisecond {
+		t.Errorf("Expected the request timeout to fire before the reply, took %s", elapsed)
+	}
+	if rp.sessionTimeout != time.Hour {
+		t.Errorf("Expected the session lifetime to be unchanged, got %s", rp.sessionTimeout)
+	}
+
+	if _, _, err := exchange(time.Second); err != nil {
+		t.Errorf("Expected the slow reply within the request timeout, got %s", err)
+	}
+}
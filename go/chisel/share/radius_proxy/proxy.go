@@ -3,7 +3,14 @@ package radius_proxy
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,32 +22,187 @@ import (
 
 type Proxy struct {
 	attributes_keys []string
-	secret          []byte
+	secrets         atomic.Pointer[proxySecrets]
 	sessionTimeout  time.Duration
+	cleanupTick     time.Duration
 	backends        *Backends
+	nases           sync.Map
+	tlsConfig       *tls.Config
+	healthCheckPort int
+	healthCheckPath string
+	healthClient    *http.Client
+	maxPacketSize   int
+	pool            *ConnPool
+	sessionsFile    string
+	radSec          bool
+	metrics         *proxyMetrics
+	nasLimiter      *nasLimiter
+	requestTimeout  time.Duration
+	groupSecrets    map[string][]byte
+	pendingReplies  sync.Map
+	statusServer    string
 	*cio.Logger
 }
 
+// DefaultMaxPacketSize is the maximum length of a RADIUS packet (RFC 2865)
+const DefaultMaxPacketSize = 4096
+
+// ErrPacketTooLarge is returned for the packets exceeding the maximum packet size
+var ErrPacketTooLarge = errors.New("RADIUS packet too large")
+
 type ProxyConfig struct {
 	Addrs          []string
 	Secret         []byte
 	SessionTimeout time.Duration
 	Logger         *cio.Logger
+	// Interval of the eviction of the expired sessions, defaults to DefaultCleanupTick.
+	// Expired sessions live up to SessionTimeout + CleanupTick so it should not exceed SessionTimeout.
+	CleanupTick time.Duration
+	// Selector picks the backend of new sessions, defaults to HashBackendSelector
+	Selector BackendSelector
+	// Groups of backends by name, Addrs are in the DefaultBackendGroup
+	Groups map[string][]string
+	// Realms maps the realm of the User-Name to the group of backends of its packets
+	Realms map[string]string
+	// EAPTypes maps the EAP type of the EAP-Message to the group of backends of the
+	// new sessions, the realms take precedence. A session keeps its backend once
+	// established so the EAP conversation completes on it.
+	EAPTypes map[uint8]string
+	// GroupSecrets are the shared secrets of the backends of a group, the groups
+	// without one use the secret of the NAS. The packets are signed with the secret
+	// of their backend and its replies signed back with the one of the NAS (see ProxyReply).
+	GroupSecrets map[string][]byte
+	// TLS config used when contacting the backends over TLS,
+	// it holds the client certificate presented to them (see LoadTLSConfig)
+	TLSConfig *tls.Config
+	// Port of the health endpoint of the backends, 0 disables the health checks
+	HealthCheckPort int
+	// Path of the health endpoint, defaults to DefaultHealthCheckPath
+	HealthCheckPath string
+	// Timeout of a health check, defaults to DefaultHealthCheckTimeout
+	HealthCheckTimeout time.Duration
+	// Maximum size of the packets proxied and of the responses of the backends,
+	// defaults to DefaultMaxPacketSize
+	MaxPacketSize int
+	// Pool of the connections to the backends over TCP (RadSec)
+	Pool PoolConfig
+	// Send the packets to the backends over TLS (RadSec) with the connections
+	// of Pool instead of UDP, see Exchange
+	RadSec bool
+	// File the sessions are saved to on shutdown and loaded from on startup
+	// (see SaveSessions and LoadSessions), empty disables it
+	SessionsFile string
+	// Consecutive failures or timeouts of a backend opening its breaker (see ReportResult),
+	// 0 disables the breakers
+	BreakerThreshold int
+	// Time an open breaker routes the packets around its backend before a trial,
+	// defaults to DefaultBreakerCooldown
+	BreakerCooldown time.Duration
+	// Packets per second accepted from each NAS (keyed on its NAS-IP-Address),
+	// the packets over the rate are dropped. 0 disables the limit.
+	NASRate float64
+	// Packets a NAS can send at once above its rate, defaults to the rate rounded up
+	NASBurst int
+	// Time the proxy waits for the reply of a backend, defaults to DefaultExchangeTimeout
+	// over RadSec and to the UDP deadline of the tunnel over UDP. Unlike SessionTimeout
+	// it does not change how long a session sticks to its backend.
+	RequestTimeout time.Duration
+	// Handling of the Status-Server packets, StatusServerLocal (the default) or
+	// StatusServerForward, see LocalReply
+	StatusServer string
 }
 
 func NewProxy(config *ProxyConfig) *Proxy {
 	radiusProxy := &Proxy{
-		sessionTimeout: config.SessionTimeout,
-		backends:       NewBackends(config.SessionTimeout, config.Addrs...),
-		secret:         []byte(config.Secret),
-		Logger:         config.Logger,
+		sessionTimeout:  config.SessionTimeout,
+		cleanupTick:     config.CleanupTick,
+		backends:        NewBackends(config.SessionTimeout, config.Addrs...),
+		Logger:          config.Logger,
+		tlsConfig:       config.TLSConfig,
+		healthCheckPort: config.HealthCheckPort,
+		healthCheckPath: config.HealthCheckPath,
+		healthClient:    newHealthCheckClient(config),
+		maxPacketSize:   config.MaxPacketSize,
+		pool:            NewConnPool(config.Pool, TLSDialer(config.TLSConfig, DefaultPoolDialTimeout)),
+		sessionsFile:    config.SessionsFile,
+		radSec:          config.RadSec,
+		metrics:         &proxyMetrics{},
+		nasLimiter:      newNASLimiter(config.NASRate, config.NASBurst),
+		requestTimeout:  config.RequestTimeout,
+		groupSecrets:    map[string][]byte{},
+		statusServer:    config.StatusServer,
+	}
+
+	for group, secret := range config.GroupSecrets {
+		radiusProxy.groupSecrets[group] = secret
+	}
+
+	radiusProxy.secrets.Store(&proxySecrets{current: config.Secret})
+	radiusProxy.backends.breakerThreshold = config.BreakerThreshold
+	radiusProxy.backends.breakerCooldown = config.BreakerCooldown
+	if radiusProxy.backends.breakerCooldown <= 0 {
+		radiusProxy.backends.breakerCooldown = DefaultBreakerCooldown
+	}
+
+	radiusProxy.backends.sessions.metrics = radiusProxy.metrics
+	radiusProxy.pool.metrics = radiusProxy.metrics
+	Collector.add(radiusProxy.metrics)
+
+	if radiusProxy.maxPacketSize <= 0 {
+		radiusProxy.maxPacketSize = DefaultMaxPacketSize
+	}
+
+	if config.Selector != nil {
+		radiusProxy.backends.SetSelector(config.Selector)
+	}
+
+	for group, addrs := range config.Groups {
+		for _, addr := range addrs {
+			radiusProxy.backends.AddToGroup(group, addr)
+		}
+	}
+
+	for realm, group := range config.Realms {
+		radiusProxy.backends.SetRealmGroup(realm, group)
+	}
+
+	for eapType, group := range config.EAPTypes {
+		radiusProxy.backends.SetEAPTypeGroup(eapType, group)
 	}
 
 	return radiusProxy
 }
 
+func (rp *Proxy) SetBackendSelector(selector BackendSelector) {
+	rp.backends.SetSelector(selector)
+}
+
+// Cleanup evicts the expired sessions and NAS until stop is closed,
+// the metrics of the proxy are then removed from the Collector
 func (rp *Proxy) Cleanup(stop chan struct{}) {
-	rp.backends.sessions.Cleanup(5*time.Second, stop)
+	defer Collector.remove(rp.metrics)
+	go rp.cleanupNASes(stop)
+	rp.backends.sessions.Cleanup(rp.cleanupTick, stop)
+}
+
+func (rp *Proxy) cleanupNASes(stop chan struct{}) {
+	tick := rp.cleanupTick
+	if tick <= 0 {
+		tick = DefaultCleanupTick
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			rp.expireNASes(now)
+			rp.nasLimiter.expire(now)
+			rp.expireReplies(now)
+		case <-stop:
+			return
+		}
+	}
 }
 
 func (rp *Proxy) addProxyState(p *radius.Packet) bool {
@@ -57,17 +219,131 @@ func (rp *Proxy) addProxyState(p *radius.Packet) bool {
 	return true
 }
 
+// AddBackend adds a backend to the default group, it is a no-op when the
+// address is already present so it can be called on every pod update
 func (rp *Proxy) AddBackend(addr string) {
 	rp.backends.Add(addr)
 }
 
+func (rp *Proxy) AddGroupBackend(group, addr string) {
+	rp.backends.AddToGroup(group, addr)
+}
+
+func (rp *Proxy) SetRealmGroup(realm, group string) {
+	rp.backends.SetRealmGroup(realm, group)
+}
+
+func (rp *Proxy) SetEAPTypeGroup(eapType uint8, group string) {
+	rp.backends.SetEAPTypeGroup(eapType, group)
+}
+
+// SetBackends replaces the backends of the default group in a single step,
+// the sessions of the backends that are kept stay on them
+func (rp *Proxy) SetBackends(addrs []string) {
+	rp.backends.SetGroup(DefaultBackendGroup, addrs)
+}
+
 func (rp *Proxy) DeleteBackend(addr string) {
 	rp.backends.Delete(addr)
 }
 
+// Backends returns a snapshot of the backends in the order they were added
+func (rp *Proxy) Backends() []BackendStatus {
+	return rp.backends.status()
+}
+
+// ExportSessions writes the unexpired sessions to w so they can be
+// imported by the next process to keep their backends across restarts
+func (rp *Proxy) ExportSessions(w io.Writer) error {
+	return json.NewEncoder(w).Encode(rp.backends.sessions.Snapshot())
+}
+
+// ImportSessions restores the sessions written by ExportSessions, the expired ones are skipped.
+// It returns the number of sessions imported.
+func (rp *Proxy) ImportSessions(r io.Reader) (int, error) {
+	var snapshots []SessionSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshots); err != nil {
+		return 0, err
+	}
+
+	return rp.backends.sessions.Restore(snapshots, rp.backends.get), nil
+}
+
+// SaveSessions exports the sessions to the sessions file, if any
+func (rp *Proxy) SaveSessions() error {
+	if rp.sessionsFile == "" {
+		return nil
+	}
+
+	// The file is replaced at once so a failed save keeps the previous one
+	tmp := rp.sessionsFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := rp.ExportSessions(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, rp.sessionsFile)
+}
+
+// LoadSessions imports the sessions of the sessions file, if any,
+// a missing file imports nothing. It returns the number of sessions imported.
+func (rp *Proxy) LoadSessions() (int, error) {
+	if rp.sessionsFile == "" {
+		return 0, nil
+	}
+
+	f, err := os.Open(rp.sessionsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	defer f.Close()
+	return rp.ImportSessions(f)
+}
+
+// Pool returns the pool of the connections to the backends over TCP (RadSec)
+func (rp *Proxy) Pool() *ConnPool {
+	return rp.pool
+}
+
+// RadSec tells if the packets are sent to the backends over RadSec with Exchange
+func (rp *Proxy) RadSec() bool {
+	return rp.radSec
+}
+
+// MaxPacketSize returns the maximum size of the packets and of the responses of the backends
+func (rp *Proxy) MaxPacketSize() int {
+	return rp.maxPacketSize
+}
+
+// RequestTimeout returns the time the proxy waits for the reply of a backend, 0 when not set
+func (rp *Proxy) RequestTimeout() time.Duration {
+	return rp.requestTimeout
+}
+
 func (rp *Proxy) ProxyPacket(payload []byte, connectorID string) ([]byte, string, error) {
+	if len(payload) > rp.maxPacketSize {
+		return nil, "", ErrPacketTooLarge
+	}
+
 	rp.Debugf("Finding backend to proxy to")
-	packet, err := radius.Parse(payload, rp.secret)
+	secret := rp.packetSecret(payload, time.Now())
+	packet, err := radius.Parse(payload, secret)
 	if err != nil {
 		return nil, "", err
 	}
@@ -77,8 +353,32 @@ func (rp *Proxy) ProxyPacket(payload []byte, connectorID string) ([]byte, string
 		LogPacket(l, packet)
 	})
 
+	if !rp.allowPacket(packet, time.Now()) {
+		return nil, "", ErrRateLimited
+	}
+
+	rp.trackNAS(packet)
 	added := rp.addProxyState(packet)
 	_ = added
+	var be *Backend
+	if isInterimUpdate(packet) {
+		be = rp.backends.interimBackend(packet)
+	}
+
+	if be == nil {
+		be = rp.backends.getBackend(packet)
+	}
+
+	if be == nil {
+		return nil, "", errors.New("No backend available")
+	}
+
+	authenticator := packet.Authenticator
+	backendSecret := rp.backendSecret(be, secret)
+	if err := resignRequest(packet, backendSecret); err != nil {
+		return nil, "", err
+	}
+
 	connectorAttr, err := radius.NewString(connectorID)
 	if err != nil {
 		return nil, "", err
@@ -95,7 +395,7 @@ func (rp *Proxy) ProxyPacket(payload []byte, connectorID string) ([]byte, string
 	}
 
 	packet.Attributes.Add(26, vsa)
-	err = addMessageAuthenticator(packet, []byte(rp.secret))
+	err = addMessageAuthenticator(packet, backendSecret)
 	if err != nil {
 		return nil, "", err
 	}
@@ -105,12 +405,9 @@ func (rp *Proxy) ProxyPacket(payload []byte, connectorID string) ([]byte, string
 		return nil, "", err
 	}
 
-	be := rp.backends.getBackend(packet)
-	if be == nil {
-		return nil, "", errors.New("No backend available")
-	}
-
-	rp.Debugf("Proxy to %s for connector %s", be.addr, connectorID)
+	rp.addPendingReply(be.addr, packet, secret, authenticator, b2)
+	be.touch()
+	rp.Debugf("Proxy to %s for connector %s", be.addr, LogValue(connectorID))
 	rp.IfDebugHandle(func(l *cio.Logger) {
 		l.Printf("Payload Proxied")
 		LogPacket(l, packet)
@@ -0,0 +1,97 @@
+package radius_proxy
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// ErrRateLimited is returned for the packets of a NAS exceeding its rate
+var ErrRateLimited = errors.New("RADIUS packet rate of the NAS exceeded")
+
+// tokenBucket holds the packets a NAS can still send, refilled at the rate of the limiter
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// nasLimiter limits the packets of each NAS (keyed on its NAS-IP-Address) with a
+// token bucket, so a runaway NAS cannot starve the others nor flood the backends
+type nasLimiter struct {
+	// packets per second of a NAS, 0 disables the limiter
+	rate  float64
+	burst float64
+	mut   sync.Mutex
+	nases map[string]*tokenBucket
+}
+
+func newNASLimiter(rate float64, burst int) *nasLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return &nasLimiter{rate: rate, burst: float64(burst), nases: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from the bucket of the NAS, false when it is empty
+func (l *nasLimiter) allow(nas string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	b := l.nases[nas]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.nases[nas] = b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	}
+
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// expire forgets the NAS whose bucket refilled, they start again with a full bucket
+func (l *nasLimiter) expire(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for nas, b := range l.nases {
+		if now.Sub(b.last) >= refill {
+			delete(l.nases, nas)
+		}
+	}
+}
+
+// allowPacket reports if the packet is within the rate of its NAS,
+// the packets without a NAS-IP-Address are not limited
+func (rp *Proxy) allowPacket(p *radius.Packet, now time.Time) bool {
+	ip := rfc2865.NASIPAddress_Get(p)
+	if ip == nil {
+		return true
+	}
+
+	if rp.nasLimiter.allow(ip.String(), now) {
+		return true
+	}
+
+	rp.metrics.rateLimit()
+	return false
+}
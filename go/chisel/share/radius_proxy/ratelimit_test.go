@@ -0,0 +1,83 @@
+package radius_proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestNASRateLimit(t *testing.T) {
+	rp := NewProxy(
+		&ProxyConfig{
+			Addrs:          []string{"10.0.0.1:1812"},
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+			NASRate:        0.1,
+			NASBurst:       3,
+		},
+	)
+	defer Collector.remove(rp.metrics)
+	proxy := func(nas string) error {
+		p := testPacket(t, "bob")
+		if err := rfc2865.NASIPAddress_Set(p, net.ParseIP(nas)); err != nil {
+			t.Fatalf("Cannot set NAS-IP-Address: %s", err)
+		}
+		payload, err := p.Encode()
+		if err != nil {
+			t.Fatalf("Cannot encode packet: %s", err)
+		}
+		_, _, err = rp.ProxyPacket(payload, "connector")
+		return err
+	}
+
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if err := proxy("192.0.2.1"); errors.Is(err, ErrRateLimited) {
+			dropped++
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if dropped != 7 {
+		t.Errorf("Expected the packets above the burst to be dropped, %d were dropped", dropped)
+	}
+	if rp.metrics.rateLimited != 7 {
+		t.Errorf("Expected 7 rate limited packets in the metrics, got %d", rp.metrics.rateLimited)
+	}
+
+	if err := proxy("192.0.2.2"); err != nil {
+		t.Errorf("Expected another NAS to be unaffected, got %s", err)
+	}
+	if addr := testProxyPacket(t, rp, testPacket(t, "bob")); addr == "" {
+		t.Errorf("Expected the packets without NAS-IP-Address to be unaffected")
+	}
+}
+
+func TestNASLimiterRefill(t *testing.T) {
+	l := newNASLimiter(2, 0)
+	now := time.Now()
+	if !l.allow("nas", now) || !l.allow("nas", now) || l.allow("nas", now) {
+		t.Fatalf("Expected a burst of the rate rounded up")
+	}
+
+	if !l.allow("nas", now.Add(500*time.Millisecond)) || l.allow("nas", now.Add(500*time.Millisecond)) {
+		t.Errorf("Expected a single token after half a second")
+	}
+
+	l.expire(now.Add(1500 * time.Millisecond))
+	if len(l.nases) != 0 {
+		t.Errorf("Expected the refilled buckets to be forgotten, got %d", len(l.nases))
+	}
+
+	disabled := newNASLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !disabled.allow("nas", now) {
+			t.Fatalf("Expected no limit without rate")
+		}
+	}
+}
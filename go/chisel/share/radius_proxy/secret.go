@@ -0,0 +1,271 @@
+package radius_proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+)
+
+// proxySecrets are the shared secrets of the proxy, the previous one
+// is still accepted until previousUntil after a rotation
+type proxySecrets struct {
+	current       []byte
+	previous      []byte
+	previousUntil time.Time
+}
+
+// SetSecret replaces the shared secret of the proxy without dropping the sessions.
+// During overlap, the packets whose Message-Authenticator matches the previous
+// secret are still proxied with it so the NAS can be updated without a hard cutover.
+func (rp *Proxy) SetSecret(secret []byte, overlap time.Duration) {
+	secrets := &proxySecrets{current: secret}
+	if overlap > 0 {
+		secrets.previous = rp.secrets.Load().current
+		secrets.previousUntil = time.Now().Add(overlap)
+	}
+
+	rp.secrets.Store(secrets)
+}
+
+// packetSecret returns the secret of the packet, the current one unless the packet
+// is signed with the previous one during the overlap of a rotation
+func (rp *Proxy) packetSecret(payload []byte, now time.Time) []byte {
+	secrets := rp.secrets.Load()
+	if secrets.previous == nil || now.After(secrets.previousUntil) {
+		return secrets.current
+	}
+
+	if !messageAuthenticatorValid(payload, secrets.current) && messageAuthenticatorValid(payload, secrets.previous) {
+		return secrets.previous
+	}
+
+	return secrets.current
+}
+
+// messageAuthenticatorValid reports if the packet has a Message-Authenticator computed with the secret
+func messageAuthenticatorValid(payload []byte, secret []byte) bool {
+	for i := 20; i+2 <= len(payload); {
+		length := int(payload[i+1])
+		if length < 2 || i+length > len(payload) {
+			return false
+		}
+
+		if payload[i] == byte(rfc2869.MessageAuthenticator_Type) && length == 18 {
+			zeroed := append([]byte(nil), payload...)
+			copy(zeroed[i+2:i+18], make([]byte, 16))
+			hash := hmac.New(md5.New, secret)
+			hash.Write(zeroed)
+			return hmac.Equal(hash.Sum(nil), payload[i+2:i+18])
+		}
+
+		i += length
+	}
+
+	return false
+}
+
+// ErrInvalidReply is returned for the replies of a backend not signed with the secret of its group
+var ErrInvalidReply = errors.New("RADIUS reply not signed with the secret of the backend")
+
+// Vendor of the MS-MPPE keys, salt encrypted like the Tunnel-Password (RFC 2548)
+const (
+	microsoftVendor = 311
+	msMPPESendKey   = 16
+	msMPPERecvKey   = 17
+)
+
+// pendingReply holds what the reply to a request signed with the secret of a
+// group needs to be signed back with the secret of the NAS
+type pendingReply struct {
+	nasSecret     []byte
+	backendSecret []byte
+	// authenticators of the request of the NAS and of the one sent to the backend
+	authenticator [16]byte
+	forwarded     [16]byte
+	expires       time.Time
+}
+
+// backendSecret returns the secret of the group of the backend, secret when it has none
+func (rp *Proxy) backendSecret(be *Backend, secret []byte) []byte {
+	if groupSecret := rp.groupSecrets[be.group]; len(groupSecret) > 0 {
+		return groupSecret
+	}
+
+	return secret
+}
+
+// resignRequest encrypts the User-Password of the request with the secret
+// of the backend, the packet is then encoded with it
+func resignRequest(p *radius.Packet, secret []byte) error {
+	if bytes.Equal(p.Secret, secret) {
+		return nil
+	}
+
+	password, err := rfc2865.UserPassword_Lookup(p)
+	p.Secret = secret
+	if err != nil {
+		return nil
+	}
+
+	// the padding of the password is removed when it is decrypted (RFC 2865 5.2)
+	padded := make([]byte, 16*((len(password)+15)/16))
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+
+	copy(padded, password)
+	return rfc2865.UserPassword_Set(p, padded)
+}
+
+// addPendingReply remembers the request sent to the backend when its secret
+// differs from the one of the NAS, the reply is matched on its Proxy-State
+func (rp *Proxy) addPendingReply(addr string, p *radius.Packet, nasSecret []byte, authenticator [16]byte, forwarded []byte) {
+	if bytes.Equal(p.Secret, nasSecret) {
+		return
+	}
+
+	pending := &pendingReply{
+		nasSecret:     nasSecret,
+		backendSecret: p.Secret,
+		authenticator: authenticator,
+		expires:       time.Now().Add(rp.sessionTimeout),
+	}
+	copy(pending.forwarded[:], forwarded[4:20])
+	rp.pendingReplies.Store(addr+" "+rfc2865.ProxyState_GetString(p), pending)
+}
+
+// expireReplies forgets the requests whose backend never replied
+func (rp *Proxy) expireReplies(now time.Time) {
+	rp.pendingReplies.Range(func(key, value interface{}) bool {
+		if now.After(value.(*pendingReply).expires) {
+			rp.pendingReplies.Delete(key)
+		}
+
+		return true
+	})
+}
+
+// ProxyReply signs the reply of the backend at addr back with the secret of the NAS
+// when the request was sent with the secret of the group of the backend (see
+// ProxyConfig.GroupSecrets). The other replies are returned as is.
+func (rp *Proxy) ProxyReply(reply []byte, addr string) ([]byte, error) {
+	if len(rp.groupSecrets) == 0 {
+		return reply, nil
+	}
+
+	packet, err := radius.Parse(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value, found := rp.pendingReplies.LoadAndDelete(addr + " " + rfc2865.ProxyState_GetString(packet))
+	if !found {
+		return reply, nil
+	}
+
+	pending := value.(*pendingReply)
+	request := make([]byte, 20)
+	copy(request[4:], pending.forwarded[:])
+	if !radius.IsAuthenticResponse(reply, request, pending.backendSecret) {
+		return nil, ErrInvalidReply
+	}
+
+	if err := resecretReplyAttributes(packet, pending); err != nil {
+		return nil, err
+	}
+
+	packet.Secret = pending.nasSecret
+	packet.Authenticator = pending.authenticator
+	if _, err := rfc2869.MessageAuthenticator_Lookup(packet); err == nil {
+		if err := addReplyMessageAuthenticator(packet); err != nil {
+			return nil, err
+		}
+	}
+
+	return packet.Encode()
+}
+
+// resecretReplyAttributes encrypts the Tunnel-Password and the MS-MPPE keys
+// of the reply with the secret and the request authenticator of the NAS
+func resecretReplyAttributes(p *radius.Packet, pending *pendingReply) error {
+	resecret := func(a radius.Attribute) (radius.Attribute, error) {
+		password, salt, err := radius.TunnelPassword(a, pending.backendSecret, pending.forwarded[:])
+		if err != nil {
+			return nil, err
+		}
+
+		return radius.NewTunnelPassword(password, salt, pending.nasSecret, pending.authenticator[:])
+	}
+
+	for _, avp := range p.Attributes {
+		switch avp.Type {
+		case rfc2868.TunnelPassword_Type:
+			// the salt follows the tag
+			if len(avp.Attribute) < 1 {
+				continue
+			}
+
+			a, err := resecret(avp.Attribute[1:])
+			if err != nil {
+				return err
+			}
+
+			avp.Attribute = append(radius.Attribute{avp.Attribute[0]}, a...)
+		case rfc2865.VendorSpecific_Type:
+			vendor, data, err := radius.VendorSpecific(avp.Attribute)
+			if err != nil || vendor != microsoftVendor {
+				continue
+			}
+
+			var attrs []byte
+			for len(data) >= 2 {
+				length := int(data[1])
+				if length < 2 || length > len(data) {
+					return errors.New("invalid vendor attribute")
+				}
+
+				attr := data[:length]
+				if attr[0] == msMPPESendKey || attr[0] == msMPPERecvKey {
+					a, err := resecret(radius.Attribute(attr[2:]))
+					if err != nil {
+						return err
+					}
+
+					attr = append([]byte{attr[0], byte(2 + len(a))}, a...)
+				}
+
+				attrs = append(attrs, attr...)
+				data = data[length:]
+			}
+
+			vsa, err := radius.NewVendorSpecific(vendor, attrs)
+			if err != nil {
+				return err
+			}
+
+			avp.Attribute = vsa
+		}
+	}
+
+	return nil
+}
+
+// addReplyMessageAuthenticator signs the reply with its Authenticator set to the one of the request (RFC 3579 3.2)
+func addReplyMessageAuthenticator(p *radius.Packet) error {
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	hash := hmac.New(md5.New, p.Secret)
+	hash.Write(b)
+	return rfc2869.MessageAuthenticator_Set(p, hash.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package radius_proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// testSignedPacket returns a packet of bob signed with the secret
+func testSignedPacket(t *testing.T, secret []byte) []byte {
+	p := testPacket(t, "bob")
+	p.Secret = secret
+	if err := addMessageAuthenticator(p, secret); err != nil {
+		t.Fatalf("Cannot sign the packet: %s", err)
+	}
+
+	payload, err := p.Encode()
+	if err != nil {
+		t.Fatalf("Cannot encode the packet: %s", err)
+	}
+
+	return payload
+}
+
+func TestSetSecret(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812")
+	newSecret := []byte("rotated")
+	proxied := func(payload []byte) []byte {
+		t.Helper()
+		out, _, err := rp.ProxyPacket(payload, "connector")
+		if err != nil {
+			t.Fatalf("Cannot proxy the packet: %s", err)
+		}
+
+		return out
+	}
+
+	if out := proxied(testSignedPacket(t, testSecret)); !messageAuthenticatorValid(out, testSecret) {
+		t.Errorf("Expected the packet to be signed with the initial secret")
+	}
+
+	rp.SetSecret(newSecret, time.Minute)
+	if out := proxied(testSignedPacket(t, newSecret)); !messageAuthenticatorValid(out, newSecret) {
+		t.Errorf("Expected the packet to be signed with the new secret")
+	}
+
+	// during the overlap the packets of the NAS still using the previous secret keep it
+	if out := proxied(testSignedPacket(t, testSecret)); !messageAuthenticatorValid(out, testSecret) {
+		t.Errorf("Expected the previous secret to be accepted during the overlap")
+	}
+
+	if secret := rp.packetSecret(testSignedPacket(t, testSecret), time.Now().Add(2*time.Minute)); string(secret) != string(newSecret) {
+		t.Errorf("Expected the new secret after the overlap, got %s", secret)
+	}
+
+	rp.SetSecret([]byte("cutover"), 0)
+	if out := proxied(testSignedPacket(t, newSecret)); !messageAuthenticatorValid(out, []byte("cutover")) {
+		t.Errorf("Expected the packet to be signed with the new secret without overlap")
+	}
+}
+
+func TestGroupSecrets(t *testing.T) {
+	secrets := map[string][]byte{"a": []byte("secret-a"), "b": []byte("secret-b")}
+	rp := NewProxy(
+		&ProxyConfig{
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+			Groups:         map[string][]string{"a": {"10.0.0.1:1812"}, "b": {"10.0.0.2:1812"}},
+			Realms:         map[string]string{"a.example": "a", "b.example": "b"},
+			GroupSecrets:   secrets,
+		},
+	)
+	defer Collector.remove(rp.metrics)
+
+	for _, tc := range []struct {
+		username string
+		group    string
+		addr     string
+	}{
+		{username: "bob@a.example", group: "a", addr: "10.0.0.1:1812"},
+		{username: "alice@b.example", group: "b", addr: "10.0.0.2:1812"},
+	} {
+		p := testPacket(t, tc.username)
+		if err := rfc2865.UserPassword_SetString(p, "correct-password"); err != nil {
+			t.Fatalf("Cannot set User-Password: %s", err)
+		}
+
+		payload, err := p.Encode()
+		if err != nil {
+			t.Fatalf("Cannot encode the packet: %s", err)
+		}
+
+		out, addr, err := rp.ProxyPacket(payload, "connector")
+		if err != nil {
+			t.Fatalf("Cannot proxy the packet of %s: %s", tc.username, err)
+		}
+
+		if addr != tc.addr {
+			t.Errorf("Expected %s to be proxied to %s, got %s", tc.username, tc.addr, addr)
+		}
+
+		secret := secrets[tc.group]
+		if !messageAuthenticatorValid(out, secret) {
+			t.Errorf("Expected the packet of %s to be signed with the secret of group %s", tc.username, tc.group)
+		}
+
+		forwarded, err := radius.Parse(out, secret)
+		if err != nil {
+			t.Fatalf("Cannot parse the proxied packet: %s", err)
+		}
+
+		if password := rfc2865.UserPassword_GetString(forwarded); password != "correct-password" {
+			t.Errorf("Expected the User-Password encrypted with the secret of group %s, got %q", tc.group, password)
+		}
+
+		// the backend replies with its secret, the NAS gets it signed with its own
+		response := forwarded.Response(radius.CodeAccessAccept)
+		rfc2865.ProxyState_Set(response, rfc2865.ProxyState_Get(forwarded))
+		if err := addReplyMessageAuthenticator(response); err != nil {
+			t.Fatalf("Cannot sign the reply: %s", err)
+		}
+
+		reply, err := response.Encode()
+		if err != nil {
+			t.Fatalf("Cannot encode the reply: %s", err)
+		}
+
+		nasReply, err := rp.ProxyReply(reply, addr)
+		if err != nil {
+			t.Fatalf("Cannot proxy the reply to %s: %s", tc.username, err)
+		}
+
+		if !radius.IsAuthenticResponse(nasReply, payload, testSecret) {
+			t.Errorf("Expected the reply to %s to be signed with the secret of the NAS", tc.username)
+		}
+
+		if bytes.Equal(nasReply, reply) {
+			t.Errorf("Expected the reply to %s to be signed again", tc.username)
+		}
+	}
+
+	// the default group has no secret of its own
+	rp.AddBackend("10.0.0.3:1812")
+	out, addr, err := rp.ProxyPacket(testSignedPacket(t, testSecret), "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy the packet: %s", err)
+	}
+
+	if addr != "10.0.0.3:1812" || !messageAuthenticatorValid(out, testSecret) {
+		t.Errorf("Expected the packet without a realm signed with the default secret for 10.0.0.3:1812, got %s", addr)
+	}
+
+	forged := radius.New(radius.CodeAccessAccept, []byte("wrong"))
+	p := testPacket(t, "bob@a.example")
+	payload, _ := p.Encode()
+	out, addr, err = rp.ProxyPacket(payload, "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy the packet: %s", err)
+	}
+
+	forwarded, _ := radius.Parse(out, secrets["a"])
+	forged.Identifier = forwarded.Identifier
+	forged.Authenticator = forwarded.Authenticator
+	rfc2865.ProxyState_Set(forged, rfc2865.ProxyState_Get(forwarded))
+	reply, _ := forged.Encode()
+	if _, err := rp.ProxyReply(reply, addr); err != ErrInvalidReply {
+		t.Errorf("Expected a reply signed with another secret to be rejected, got %v", err)
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 type SessionBackend struct {
 	store sync.Map
+	// metrics of the proxy owning the store, nil when it has none
+	metrics *proxyMetrics
 }
 
 func NewSessionBackend() *SessionBackend {
@@ -20,8 +22,14 @@ func NewSessionBackend() *SessionBackend {
 }
 
 func NewRadiusSession(id string, timeout time.Duration, backend *Backend) *RadiusSession {
+	group := DefaultBackendGroup
+	if backend != nil {
+		group = backend.group
+	}
+
 	return &RadiusSession{
 		backend: backend,
+		group:   group,
 		id:      id,
 		endTime: time.Now().Add(timeout),
 		timeout: timeout,
@@ -29,7 +37,16 @@ func NewRadiusSession(id string, timeout time.Duration, backend *Backend) *Radiu
 	}
 }
 
+// DefaultCleanupTick is the interval of the expired sessions cleanup when none is configured
+const DefaultCleanupTick = 5 * time.Second
+
+// Cleanup evicts the expired sessions every tick until stop is closed,
+// a tick <= 0 uses DefaultCleanupTick
 func (sb *SessionBackend) Cleanup(tick time.Duration, stop chan struct{}) {
+	if tick <= 0 {
+		tick = DefaultCleanupTick
+	}
+
 	ticker := time.NewTicker(tick)
 loop:
 	for {
@@ -43,23 +60,83 @@ loop:
 	}
 }
 
-func (sb *SessionBackend) GetBackend(packet *radius.Packet) *Backend {
-	state := rfc2865.ProxyState_GetString(packet)
-	if state == "" {
-		return nil
+// GetBackend returns the backend of the session of the packet,
+// NoSessionErr is returned when the packet has no session
+func (sb *SessionBackend) GetBackend(packet *radius.Packet) (*Backend, error) {
+	rs, err := sb.getSession(packet)
+	if err != nil {
+		return nil, err
 	}
 
-	if val, ok := sb.store.Load(state); ok {
-		rs := val.(*RadiusSession)
-		if rs.ExtendTime() == nil {
-			return rs.backend
-		}
+	if err := rs.ExtendTime(); err != nil {
+		return nil, err
+	}
+
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return rs.backend, nil
+}
+
+// GetGroup returns the backend group of the session of the packet
+func (sb *SessionBackend) GetGroup(packet *radius.Packet) (string, error) {
+	rs, err := sb.getSession(packet)
+	if err != nil {
+		return DefaultBackendGroup, err
+	}
+
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return rs.group, nil
+}
+
+// SetBackend pins the session of the packet to another backend
+func (sb *SessionBackend) SetBackend(packet *radius.Packet, backend *Backend) error {
+	rs, err := sb.getSession(packet)
+	if err != nil {
+		return err
 	}
 
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.backend = backend
 	return nil
 }
 
+func (sb *SessionBackend) getSession(packet *radius.Packet) (*RadiusSession, error) {
+	return sb.session(rfc2865.ProxyState_GetString(packet))
+}
+
+// GetSessionBackend returns the backend of the session with the id and extends it
+func (sb *SessionBackend) GetSessionBackend(id string) (*Backend, error) {
+	rs, err := sb.session(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rs.ExtendTime(); err != nil {
+		return nil, err
+	}
+
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return rs.backend, nil
+}
+
+func (sb *SessionBackend) session(id string) (*RadiusSession, error) {
+	if id == "" {
+		return nil, NoSessionErr
+	}
+
+	val, ok := sb.store.Load(id)
+	if !ok {
+		return nil, NoSessionErr
+	}
+
+	return val.(*RadiusSession), nil
+}
+
 func (sb *SessionBackend) cleanup() {
+	evicted, size := 0, 0
 	sb.store.Range(
 		func(key, value any) bool {
 			rs := value.(*RadiusSession)
@@ -67,11 +144,104 @@ func (sb *SessionBackend) cleanup() {
 			defer rs.lock.Unlock()
 			if rs.expired() != nil {
 				sb.store.Delete(key)
+				evicted++
+			} else {
+				size++
+			}
+
+			return true
+		},
+	)
+
+	sb.metrics.addEvicted(evicted)
+	sb.metrics.setSessions(size)
+}
+
+// countByBackend returns the number of unexpired sessions of each backend
+func (sb *SessionBackend) countByBackend() map[*Backend]int {
+	counts := map[*Backend]int{}
+	sb.store.Range(
+		func(key, value any) bool {
+			rs := value.(*RadiusSession)
+			rs.lock.RLock()
+			defer rs.lock.RUnlock()
+			if rs.backend != nil && rs.expired() == nil {
+				counts[rs.backend]++
+			}
+
+			return true
+		},
+	)
+
+	return counts
+}
+
+// SessionSnapshot is the serializable form of a session,
+// the backend is referenced by its address
+type SessionSnapshot struct {
+	ID      string        `json:"id"`
+	EndTime time.Time     `json:"end_time"`
+	Timeout time.Duration `json:"timeout"`
+	Backend string        `json:"backend"`
+	Group   string        `json:"group"`
+}
+
+// Snapshot returns the unexpired sessions
+func (sb *SessionBackend) Snapshot() []SessionSnapshot {
+	snapshots := []SessionSnapshot{}
+	sb.store.Range(
+		func(key, value any) bool {
+			rs := value.(*RadiusSession)
+			rs.lock.RLock()
+			defer rs.lock.RUnlock()
+			if rs.expired() != nil {
+				return true
+			}
+
+			snapshot := SessionSnapshot{
+				ID:      rs.id,
+				EndTime: rs.endTime,
+				Timeout: rs.timeout,
+				Group:   rs.group,
+			}
+			if rs.backend != nil {
+				snapshot.Backend = rs.backend.addr
 			}
 
+			snapshots = append(snapshots, snapshot)
 			return true
 		},
 	)
+
+	return snapshots
+}
+
+// Restore adds the unexpired sessions of the snapshots and returns how many were added,
+// backend resolves their backend address and returns nil when it is unknown
+func (sb *SessionBackend) Restore(snapshots []SessionSnapshot, backend func(addr string) *Backend) int {
+	restored := 0
+	now := time.Now()
+	for _, snapshot := range snapshots {
+		if snapshot.ID == "" || snapshot.EndTime.Before(now) {
+			continue
+		}
+
+		// A session without its backend is re-pinned within its group by the next packet
+		sb.store.Store(
+			snapshot.ID,
+			&RadiusSession{
+				id:      snapshot.ID,
+				timeout: snapshot.Timeout,
+				endTime: snapshot.EndTime,
+				backend: backend(snapshot.Backend),
+				group:   snapshot.Group,
+				lock:    &sync.RWMutex{},
+			},
+		)
+		restored++
+	}
+
+	return restored
 }
 
 func (rs *SessionBackend) Add(id string, timeout time.Duration, backend *Backend) {
@@ -90,10 +260,13 @@ type RadiusSession struct {
 	timeout time.Duration
 	endTime time.Time
 	backend *Backend
+	group   string
 	lock    *sync.RWMutex
 }
 
 var SessionTimeoutErr = errors.New("Session Timed out")
+var NoSessionErr = errors.New("No session")
+var BackendGoneErr = errors.New("Session backend is gone")
 
 func (rs *RadiusSession) Expired() error {
 	rs.lock.RLock()
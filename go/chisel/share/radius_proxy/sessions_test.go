@@ -0,0 +1,160 @@
+package radius_proxy
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCleanupZeroTick(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rp.Cleanup(stop)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the cleanup to stop")
+	}
+}
+
+func TestCleanupMetrics(t *testing.T) {
+	sb := NewSessionBackend()
+	sb.metrics = &proxyMetrics{}
+
+	sb.Add("expired-1", -time.Second, nil)
+	sb.Add("expired-2", -time.Second, nil)
+	sb.Add("live", time.Minute, nil)
+	sb.cleanup()
+
+	if sb.metrics.sessionsEvicted != 2 {
+		t.Errorf("Expected 2 evicted sessions, got %d", sb.metrics.sessionsEvicted)
+	}
+	if sb.metrics.sessions != 1 {
+		t.Errorf("Expected 1 live session, got %d", sb.metrics.sessions)
+	}
+
+	sb.store.Delete("live")
+	sb.cleanup()
+	if sb.metrics.sessions != 0 {
+		t.Errorf("Expected no live sessions, got %d", sb.metrics.sessions)
+	}
+}
+
+func TestProxyCollector(t *testing.T) {
+	c := newProxyCollector()
+	first := &proxyMetrics{sessions: 2, sessionsEvicted: 3, poolHits: 1}
+	second := &proxyMetrics{sessions: 1, sessionsEvicted: 4, poolMisses: 2}
+	c.add(first)
+	c.add(second)
+	expected := `
+# HELP pfconnector_radius_proxy_sessions Number of RADIUS sessions in the session stores after the last cleanup.
+# TYPE pfconnector_radius_proxy_sessions gauge
+pfconnector_radius_proxy_sessions 3
+# HELP pfconnector_radius_proxy_sessions_evicted_total Counter of expired RADIUS sessions evicted by the cleanup.
+# TYPE pfconnector_radius_proxy_sessions_evicted_total counter
+pfconnector_radius_proxy_sessions_evicted_total 7
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "pfconnector_radius_proxy_sessions", "pfconnector_radius_proxy_sessions_evicted_total"); err != nil {
+		t.Errorf("Unexpected metrics: %s", err)
+	}
+
+	// The counters of a removed proxy are kept, not its sessions
+	c.remove(second)
+	expected = `
+# HELP pfconnector_radius_proxy_sessions Number of RADIUS sessions in the session stores after the last cleanup.
+# TYPE pfconnector_radius_proxy_sessions gauge
+pfconnector_radius_proxy_sessions 2
+# HELP pfconnector_radius_proxy_pool_misses_total Counter of backend connections dialed because the pool had none idle.
+# TYPE pfconnector_radius_proxy_pool_misses_total counter
+pfconnector_radius_proxy_pool_misses_total 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "pfconnector_radius_proxy_sessions", "pfconnector_radius_proxy_pool_misses_total"); err != nil {
+		t.Errorf("Unexpected metrics after removing a proxy: %s", err)
+	}
+}
+
+func TestExportImportSessions(t *testing.T) {
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.backends.sessions.Add("first", time.Minute, rp.backends.get("10.0.0.1:1812"))
+	rp.backends.sessions.Add("second", time.Minute, rp.backends.get("10.0.0.2:1812"))
+	rp.backends.sessions.Add("expired", -time.Second, rp.backends.get("10.0.0.1:1812"))
+
+	var buf bytes.Buffer
+	if err := rp.ExportSessions(&buf); err != nil {
+		t.Fatalf("Cannot export the sessions: %s", err)
+	}
+
+	restarted := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	n, err := restarted.ImportSessions(&buf)
+	if err != nil {
+		t.Fatalf("Cannot import the sessions: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 imported sessions, got %d", n)
+	}
+
+	for id, addr := range map[string]string{"first": "10.0.0.1:1812", "second": "10.0.0.2:1812"} {
+		be, err := restarted.backends.sessions.GetSessionBackend(id)
+		if err != nil {
+			t.Fatalf("Cannot get the backend of session %s: %s", id, err)
+		}
+		if be != restarted.backends.get(addr) {
+			t.Errorf("Expected session %s on %s, got %v", id, addr, be)
+		}
+	}
+	if _, err := restarted.backends.sessions.GetSessionBackend("expired"); err != NoSessionErr {
+		t.Errorf("Expected the expired session to be skipped, got %v", err)
+	}
+
+	// Sessions expiring between the export and the import are skipped as well
+	snapshots := []SessionSnapshot{{ID: "late", EndTime: time.Now().Add(-time.Second), Backend: "10.0.0.1:1812"}}
+	if n := restarted.backends.sessions.Restore(snapshots, restarted.backends.get); n != 0 {
+		t.Errorf("Expected the expired snapshot to be skipped, got %d restored", n)
+	}
+}
+
+func TestSaveLoadSessions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sessions.json")
+	rp := NewProxy(&ProxyConfig{
+		Addrs:          []string{"10.0.0.1:1812"},
+		Secret:         testSecret,
+		SessionTimeout: time.Minute,
+		Logger:         cio.NewLogger("test"),
+		SessionsFile:   file,
+	})
+	if n, err := rp.LoadSessions(); err != nil || n != 0 {
+		t.Fatalf("Expected nothing loaded without a file, got %d (%v)", n, err)
+	}
+
+	rp.backends.sessions.Add("first", time.Minute, rp.backends.get("10.0.0.1:1812"))
+	if err := rp.SaveSessions(); err != nil {
+		t.Fatalf("Cannot save the sessions: %s", err)
+	}
+
+	restarted := NewProxy(&ProxyConfig{
+		Addrs:          []string{"10.0.0.1:1812"},
+		Secret:         testSecret,
+		SessionTimeout: time.Minute,
+		Logger:         cio.NewLogger("test"),
+		SessionsFile:   file,
+	})
+	if n, err := restarted.LoadSessions(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 session loaded, got %d (%v)", n, err)
+	}
+
+	if err := testProxy("10.0.0.1:1812").SaveSessions(); err != nil {
+		t.Errorf("Expected no error without a sessions file, got %s", err)
+	}
+}
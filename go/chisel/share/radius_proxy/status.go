@@ -0,0 +1,51 @@
+package radius_proxy
+
+import (
+	"errors"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// Handling of the Status-Server packets (RFC 5997), see ProxyConfig.StatusServer
+const (
+	// StatusServerLocal answers the Status-Server packets with an Access-Accept while the proxy is Ready
+	StatusServerLocal = "local"
+	// StatusServerForward proxies the Status-Server packets to a backend like the other packets
+	StatusServerForward = "forward"
+)
+
+// ErrInvalidStatusServer is returned for the Status-Server packets without a valid Message-Authenticator
+var ErrInvalidStatusServer = errors.New("Status-Server without a valid Message-Authenticator")
+
+// LocalReply returns the reply of a packet answered by the proxy instead of a backend,
+// it is false when the packet must be proxied. The Status-Server packets are answered
+// unless the proxy forwards them, the reply is nil while the proxy is not Ready so
+// the monitoring sees it down.
+func (rp *Proxy) LocalReply(payload []byte) ([]byte, bool, error) {
+	if len(payload) < 20 || radius.Code(payload[0]) != radius.CodeStatusServer || rp.statusServer == StatusServerForward {
+		return nil, false, nil
+	}
+
+	secret := rp.packetSecret(payload, time.Now())
+	if !messageAuthenticatorValid(payload, secret) {
+		return nil, true, ErrInvalidStatusServer
+	}
+
+	if !rp.Ready() {
+		return nil, true, nil
+	}
+
+	packet, err := radius.Parse(payload, secret)
+	if err != nil {
+		return nil, true, err
+	}
+
+	response := packet.Response(radius.CodeAccessAccept)
+	if err := addReplyMessageAuthenticator(response); err != nil {
+		return nil, true, err
+	}
+
+	reply, err := response.Encode()
+	return reply, true, err
+}
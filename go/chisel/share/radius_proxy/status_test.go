@@ -0,0 +1,83 @@
+package radius_proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"layeh.com/radius"
+)
+
+// testStatusServer returns a Status-Server packet signed with the secret
+func testStatusServer(t *testing.T, secret []byte) []byte {
+	p := radius.New(radius.CodeStatusServer, secret)
+	if err := addMessageAuthenticator(p, secret); err != nil {
+		t.Fatalf("Cannot sign the packet: %s", err)
+	}
+
+	payload, err := p.Encode()
+	if err != nil {
+		t.Fatalf("Cannot encode the packet: %s", err)
+	}
+
+	return payload
+}
+
+func TestStatusServerLocal(t *testing.T) {
+	rp := testProxy()
+	defer Collector.remove(rp.metrics)
+	payload := testStatusServer(t, testSecret)
+	if reply, local, err := rp.LocalReply(payload); !local || reply != nil || err != nil {
+		t.Errorf("Expected no reply without backend, got %v %t %v", reply, local, err)
+	}
+
+	rp.AddBackend("10.0.0.1:1812")
+	reply, local, err := rp.LocalReply(payload)
+	if !local || err != nil {
+		t.Fatalf("Expected the Status-Server to be answered, got %t %v", local, err)
+	}
+
+	response, err := radius.Parse(reply, testSecret)
+	if err != nil {
+		t.Fatalf("Cannot parse the reply: %s", err)
+	}
+
+	if response.Code != radius.CodeAccessAccept || !radius.IsAuthenticResponse(reply, payload, testSecret) {
+		t.Errorf("Expected an Access-Accept signed with the secret, got %s", response.Code)
+	}
+
+	if _, local, err := rp.LocalReply(testStatusServer(t, []byte("wrong"))); !local || err != ErrInvalidStatusServer {
+		t.Errorf("Expected a Status-Server signed with another secret to be dropped, got %t %v", local, err)
+	}
+
+	request, _ := testPacket(t, "bob").Encode()
+	if _, local, _ := rp.LocalReply(request); local {
+		t.Errorf("Expected an Access-Request to be proxied")
+	}
+}
+
+func TestStatusServerForward(t *testing.T) {
+	rp := NewProxy(
+		&ProxyConfig{
+			Addrs:          []string{"10.0.0.1:1812"},
+			Secret:         testSecret,
+			SessionTimeout: time.Minute,
+			Logger:         cio.NewLogger("test"),
+			StatusServer:   StatusServerForward,
+		},
+	)
+	defer Collector.remove(rp.metrics)
+	payload := testStatusServer(t, testSecret)
+	if _, local, _ := rp.LocalReply(payload); local {
+		t.Fatalf("Expected the Status-Server to be forwarded")
+	}
+
+	out, addr, err := rp.ProxyPacket(payload, "connector")
+	if err != nil {
+		t.Fatalf("Cannot proxy the Status-Server: %s", err)
+	}
+
+	if addr != "10.0.0.1:1812" || radius.Code(out[0]) != radius.CodeStatusServer || !messageAuthenticatorValid(out, testSecret) {
+		t.Errorf("Expected the signed Status-Server to be proxied to 10.0.0.1:1812, got %s", addr)
+	}
+}
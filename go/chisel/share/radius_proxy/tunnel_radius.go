@@ -9,7 +9,9 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/inverse-inc/go-utils/sharedutils"
@@ -17,12 +19,21 @@ import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
 const defaultRadiusAuthK8Filter = "app=radiusd-auth"
 
+// Attempts and delay before the first retry of the initial list of the pods,
+// the delay doubles on each retry up to maxListBackoff
+const (
+	defaultListAttempts = 5
+	defaultListBackoff  = time.Second
+	maxListBackoff      = 30 * time.Second
+)
+
 func isPodReady(pod *v1.Pod) bool {
 	if pod.DeletionTimestamp != nil {
 		return false
@@ -37,13 +48,14 @@ func isPodReady(pod *v1.Pod) bool {
 	return false
 }
 
+// getPodHostPort returns the RADIUS address of the pod, IPv6 addresses are bracketed
 func getPodHostPort(pod *v1.Pod) string {
 	port, err := getPodPort(pod)
 	if err != nil {
-		return pod.Status.PodIP + ":1812"
+		port = 1812
 	}
 
-	return fmt.Sprintf("%s:%d", pod.Status.PodIP, port)
+	return net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))
 }
 
 func getPodPort(pod *v1.Pod) (int, error) {
@@ -61,6 +73,54 @@ func getPodPort(pod *v1.Pod) (int, error) {
 
 }
 
+// readyBackends returns the addresses of the ready pods
+func readyBackends(objs []interface{}) []string {
+	servers := []string{}
+	for _, obj := range objs {
+		pod, ok := obj.(*v1.Pod)
+		if ok && isPodReady(pod) {
+			servers = append(servers, getPodHostPort(pod))
+		}
+	}
+
+	return servers
+}
+
+// listPodsWithRetry lists the pods matching the filter, retrying with backoff
+// so a transient unavailability of the API server does not disable the proxy.
+// The error of the last attempt is returned once the attempts are exhausted.
+func listPodsWithRetry(ctx context.Context, l *cio.Logger, pods corev1.PodInterface, filter string, attempts int, backoff time.Duration) (*v1.PodList, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var list *v1.PodList
+		list, err = pods.List(ctx, metav1.ListOptions{LabelSelector: filter})
+		if err == nil {
+			return list, nil
+		}
+
+		l.Infof("Attempt %d/%d to list the pods matching %s failed: %s", attempt, attempts, filter, err)
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxListBackoff {
+			backoff = maxListBackoff
+		}
+	}
+
+	return nil, fmt.Errorf("Unable to list the pods after %d attempts: %w", attempts, err)
+}
+
 func clientSetFromEnv() (*kubernetes.Clientset, error) {
 	host := os.Getenv("K8S_MASTER_URI")
 	if host == "" {
@@ -103,7 +163,8 @@ func NewRadiusProxyFromKubernetes(l *cio.Logger, radiusSecret string) (*Proxy, c
 	filter := getRadiusAuthFilter()
 
 	namespace := string(data)
-	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: filter})
+	attempts := sharedutils.EnvOrDefaultInt("K8S_LIST_ATTEMPTS", defaultListAttempts)
+	pods, err := listPodsWithRetry(context.TODO(), l, clientset.CoreV1().Pods(namespace), filter, attempts, defaultListBackoff)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -115,14 +176,56 @@ func NewRadiusProxyFromKubernetes(l *cio.Logger, radiusSecret string) (*Proxy, c
 		servers = append(servers, addr)
 	}
 
-	radiusProxy := NewProxy(
-		&ProxyConfig{
-			Secret:         []byte(radiusSecret),
-			Addrs:          servers,
-			SessionTimeout: 20 * time.Second,
-			Logger:         l,
-		},
-	)
+	config := &ProxyConfig{
+		Secret:           []byte(radiusSecret),
+		Addrs:            servers,
+		SessionTimeout:   20 * time.Second,
+		CleanupTick:      5 * time.Second,
+		Logger:           l,
+		MaxPacketSize:    sharedutils.EnvOrDefaultInt("RADIUS_MAX_PACKET_SIZE", DefaultMaxPacketSize),
+		SessionsFile:     os.Getenv("RADIUS_SESSIONS_FILE"),
+		RadSec:           sharedutils.IsEnabled(sharedutils.EnvOrDefault("RADIUS_BACKEND_RADSEC", "disabled")),
+		BreakerThreshold: sharedutils.EnvOrDefaultInt("RADIUS_BREAKER_THRESHOLD", 0),
+	}
+	if cooldown := os.Getenv("RADIUS_BREAKER_COOLDOWN"); cooldown != "" {
+		d, err := time.ParseDuration(cooldown)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid RADIUS_BREAKER_COOLDOWN: %w", err)
+		}
+
+		config.BreakerCooldown = d
+	}
+	if timeout := os.Getenv("RADIUS_REQUEST_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid RADIUS_REQUEST_TIMEOUT: %w", err)
+		}
+
+		config.RequestTimeout = d
+	}
+	config.StatusServer = sharedutils.EnvOrDefault("RADIUS_STATUS_SERVER", StatusServerLocal)
+	if config.StatusServer != StatusServerLocal && config.StatusServer != StatusServerForward {
+		return nil, nil, fmt.Errorf("Invalid RADIUS_STATUS_SERVER %q, expected %s or %s", config.StatusServer, StatusServerLocal, StatusServerForward)
+	}
+	if rate := os.Getenv("RADIUS_NAS_RATE"); rate != "" {
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid RADIUS_NAS_RATE: %w", err)
+		}
+
+		config.NASRate = r
+		config.NASBurst = sharedutils.EnvOrDefaultInt("RADIUS_NAS_BURST", 0)
+	}
+	if err := backendTLSConfigFromEnv(config); err != nil {
+		return nil, nil, err
+	}
+
+	radiusProxy := NewProxy(config)
+	if n, err := radiusProxy.LoadSessions(); err != nil {
+		l.Infof("Cannot load the RADIUS sessions of %s: %s", config.SessionsFile, err)
+	} else if n > 0 {
+		l.Infof("Loaded %d RADIUS sessions from %s", n, config.SessionsFile)
+	}
 
 	watchlist := cache.NewFilteredListWatchFromClient(
 		clientset.CoreV1().RESTClient(),
@@ -133,7 +236,14 @@ func NewRadiusProxyFromKubernetes(l *cio.Logger, radiusSecret string) (*Proxy, c
 		},
 	)
 
-	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
+	// The store of the informer is updated before the handlers are called,
+	// every event replaces the backends with the ready pods of the store
+	var store cache.Store
+	syncBackends := func() {
+		radiusProxy.SetBackends(readyBackends(store.List()))
+	}
+
+	store, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
 		&v1.Pod{},
 		0, //Duration is int64
@@ -141,41 +251,66 @@ func NewRadiusProxyFromKubernetes(l *cio.Logger, radiusSecret string) (*Proxy, c
 			AddFunc: func(obj interface{}) {
 				pod := obj.(*v1.Pod)
 				if isPodReady(pod) {
-					address := getPodHostPort(pod)
-					l.Infof("Adding %s", address)
-					radiusProxy.AddBackend(address)
-					return
+					l.Infof("Adding %s", getPodHostPort(pod))
+					syncBackends()
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
-				pod := obj.(*v1.Pod)
-				address := getPodHostPort(pod)
-				l.Infof("Removing %s", address)
-				radiusProxy.DeleteBackend(address)
+				if pod, ok := obj.(*v1.Pod); ok {
+					l.Infof("Removing %s", getPodHostPort(pod))
+				}
+
+				syncBackends()
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				pod := newObj.(*v1.Pod)
 				if isPodReady(pod) {
-					address := getPodHostPort(pod)
-					l.Infof("Adding %s", address)
-					radiusProxy.AddBackend(address)
-					return
+					l.Infof("Adding %s", getPodHostPort(pod))
+				} else if pod.DeletionTimestamp != nil {
+					l.Infof("%s is terminating removing", getPodHostPort(pod))
 				}
 
-				if pod.DeletionTimestamp != nil {
-					address := getPodHostPort(pod)
-					l.Infof("%s is terminating removing", address)
-					radiusProxy.DeleteBackend(address)
-				}
+				syncBackends()
 			},
 		},
 	)
 	stop := make(chan struct{})
 	go controller.Run(stop)
+	if config.HealthCheckPort != 0 {
+		go radiusProxy.HealthCheck(10*time.Second, stop)
+	}
 
 	return radiusProxy, stop, nil
 }
 
+// backendTLSConfigFromEnv sets up the health checks of the backends and
+// the client certificate presented to them
+func backendTLSConfigFromEnv(config *ProxyConfig) error {
+	if port := os.Getenv("RADIUS_BACKEND_HEALTH_CHECK_PORT"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("Invalid RADIUS_BACKEND_HEALTH_CHECK_PORT: %w", err)
+		}
+
+		config.HealthCheckPort = p
+	}
+
+	certFile := os.Getenv("RADIUS_BACKEND_TLS_CERT_FILE")
+	keyFile := os.Getenv("RADIUS_BACKEND_TLS_KEY_FILE")
+	caFile := os.Getenv("RADIUS_BACKEND_TLS_CA_FILE")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
+	}
+
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+
+	config.TLSConfig = tlsConfig
+	return nil
+}
+
 func TLSClientConfigFromEnv() rest.TLSClientConfig {
 	caFile := sharedutils.EnvOrDefault("K8S_MASTER_CA_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
 	return rest.TLSClientConfig{
@@ -0,0 +1,109 @@
+//go:build !test_radius
+// +build !test_radius
+
+package radius_proxy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(ip string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+
+	return &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 1812}}}},
+		},
+		Status: v1.PodStatus{
+			PodIP:      ip,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestGetPodHostPort(t *testing.T) {
+	noPort := testPod("fd00::2", true)
+	noPort.Spec.Containers = nil
+	for pod, expected := range map[*v1.Pod]string{
+		testPod("10.0.0.1", true): "10.0.0.1:1812",
+		testPod("fd00::1", true):  "[fd00::1]:1812",
+		noPort:                    "[fd00::2]:1812",
+	} {
+		if addr := getPodHostPort(pod); addr != expected {
+			t.Errorf("Expected %s, got %s", expected, addr)
+		}
+	}
+}
+
+func TestReadyBackends(t *testing.T) {
+	terminating := testPod("10.0.0.3", true)
+	terminating.DeletionTimestamp = &metav1.Time{}
+	pods := []interface{}{testPod("10.0.0.1", true), testPod("10.0.0.2", false), terminating, testPod("10.0.0.4", true)}
+
+	servers := readyBackends(pods)
+	expected := []string{"10.0.0.1:1812", "10.0.0.4:1812"}
+	if !reflect.DeepEqual(servers, expected) {
+		t.Errorf("Expected the backends %v, got %v", expected, servers)
+	}
+
+	rp := testProxy("10.0.0.1:1812", "10.0.0.2:1812")
+	rp.SetBackends(servers)
+	addrs := []string{}
+	for _, b := range rp.Backends() {
+		addrs = append(addrs, b.Addr)
+	}
+
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected the proxy backends %v, got %v", expected, addrs)
+	}
+}
+
+func TestListPodsWithRetry(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testPod("10.0.0.1", true))
+	calls := 0
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls == 1 {
+			return true, nil, errors.New("API server unavailable")
+		}
+
+		return false, nil, nil
+	})
+
+	pods, err := listPodsWithRetry(context.Background(), cio.NewLogger("test"), clientset.CoreV1().Pods(""), "", 3, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected the list to succeed on retry, got %s", err)
+	}
+
+	if calls != 2 || len(pods.Items) != 1 {
+		t.Errorf("Expected 1 pod after 2 calls, got %d pods after %d calls", len(pods.Items), calls)
+	}
+
+	calls = 0
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		return true, nil, errors.New("API server unavailable")
+	})
+
+	if _, err := listPodsWithRetry(context.Background(), cio.NewLogger("test"), clientset.CoreV1().Pods(""), "", 3, time.Millisecond); err == nil {
+		t.Errorf("Expected an error once the attempts are exhausted")
+	}
+
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
@@ -33,6 +33,15 @@ import (
 //   1.1.1.1:53/udp
 //     local  127.0.0.1:53/udp
 //     remote 1.1.1.1:53/udp
+//   3000:127.0.0.1:80/tcp|original-dst
+//     local  0.0.0.0:3000
+//     remote original destination of each connection (Linux only)
+//   3000:unix:/var/run/app.sock
+//     local  0.0.0.0:3000
+//     remote unix socket /var/run/app.sock
+//   3000:example.com:80+flate
+//     local  0.0.0.0:3000
+//     remote example.com:80, the channel data is compressed
 
 type Remote struct {
 	sync.Mutex
@@ -41,10 +50,36 @@ type Remote struct {
 	RemoteHost, RemotePort, RemoteProto string
 	Dynamic, Socks, Reverse, Stdio      bool
 	Handler                             string
+	// The endpoint of each connection is its original destination before
+	// it was redirected to the local port (SO_ORIGINAL_DST), Linux only
+	OriginalDst bool
+	// Optional name of the remote in the logs and the stats
+	Name string
+	// Path of the Unix socket endpoint, RemoteHost and RemotePort are unused when set
+	RemoteSocket string
+	// Codec compressing the data of the channels, empty when uncompressed
+	Codec string
 }
 
 const revPrefix = "R:"
 
+// UnixPrefix starts the Unix socket endpoints
+const UnixPrefix = "unix:"
+
+// Maximum length of a Unix socket path (sun_path), including the trailing NUL
+const maxUnixSocketPath = 108
+
+// OriginalDstHandler is the handler of the TCP remotes
+// connecting to the original destination of the connections
+const OriginalDstHandler = "original-dst"
+
+// FlateCodec compresses the data of the channels with DEFLATE,
+// it benefits the bandwidth-bound links at the cost of latency
+const FlateCodec = "flate"
+
+// codecSeparator separates the codec from the remote and from the endpoint in the channel data
+const codecSeparator = "+"
+
 func DecodeRemote(s string) (*Remote, error) {
 	reverse := false
 	if strings.HasPrefix(s, revPrefix) {
@@ -52,12 +87,30 @@ func DecodeRemote(s string) (*Remote, error) {
 		reverse = true
 	}
 
+	codec := ""
+	if strings.HasSuffix(s, codecSeparator+FlateCodec) {
+		s = strings.TrimSuffix(s, codecSeparator+FlateCodec)
+		codec = FlateCodec
+	}
+
+	socket := ""
+	if i := strings.Index(s, UnixPrefix); i >= 0 {
+		socket = s[i+len(UnixPrefix):]
+		if err := ValidateUnixSocket(socket); err != nil {
+			return nil, err
+		}
+		s = strings.TrimSuffix(s[:i], ":")
+		if s == "" {
+			return nil, errors.New("Missing local port")
+		}
+	}
+
 	parts := regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`).FindAllStringSubmatch(s, -1)
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("Invalid remote")
 	}
 
-	r := &Remote{Reverse: reverse, Handler: "raw"}
+	r := &Remote{Reverse: reverse, Handler: "raw", Codec: codec}
 	//parse from back to front, to set 'remote' fields first,
 	//then to set 'local' fields second (allows the 'remote' side
 	//to provide the defaults)
@@ -143,9 +196,62 @@ func DecodeRemote(s string) (*Remote, error) {
 	if r.Stdio && r.Reverse {
 		return nil, errors.New("stdio cannot be reversed")
 	}
+	if socket != "" {
+		if r.RemoteProto != "tcp" || r.Socks {
+			return nil, errors.New("unix socket endpoints are only supported for TCP")
+		}
+		r.RemoteSocket = socket
+	}
+	if r.Handler == OriginalDstHandler {
+		if r.LocalProto != "tcp" || r.Socks || r.Stdio {
+			return nil, errors.New("original destination is only supported for TCP")
+		}
+		r.OriginalDst = true
+	}
+	if r.Codec != "" && (r.RemoteProto != "tcp" || r.Stdio) {
+		return nil, errors.New("compression is only supported for TCP")
+	}
 	return r, nil
 }
 
+// ChannelData is the data of the channels opened for the endpoint,
+// the codec prefixes the endpoint so both ends agree on it
+func ChannelData(endpoint, codec string) string {
+	if codec == "" {
+		return endpoint
+	}
+	return codec + codecSeparator + endpoint
+}
+
+// ParseChannelData returns the endpoint and the codec of the data of a channel,
+// the codec is made of letters only and an endpoint never starts with letters followed by a '+'
+func ParseChannelData(data string) (string, string) {
+	i := strings.Index(data, codecSeparator)
+	if i <= 0 {
+		return data, ""
+	}
+	for _, c := range data[:i] {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return data, ""
+		}
+	}
+	return data[i+1:], data[:i]
+}
+
+// ValidateUnixSocket checks the path of a Unix socket endpoint
+func ValidateUnixSocket(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("unix socket path must be absolute")
+	}
+	if strings.IndexByte(path, 0) >= 0 {
+		return errors.New("invalid unix socket path")
+	}
+	if len(path) >= maxUnixSocketPath {
+		return errors.New("unix socket path is too long")
+	}
+	return nil
+}
+
 func isPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -196,9 +302,44 @@ func (r *Remote) String() string {
 	if r.RemoteProto == "udp" {
 		sb.WriteString("/udp")
 	}
+	if r.Codec != "" {
+		sb.WriteString(codecSeparator + r.Codec)
+	}
 	return sb.String()
 }
 
+// Copy returns a copy of the remote with its own lock
+func (r *Remote) Copy() Remote {
+	r.Lock()
+	defer r.Unlock()
+	return Remote{
+		LastTouched:  r.LastTouched,
+		LocalHost:    r.LocalHost,
+		LocalPort:    r.LocalPort,
+		LocalProto:   r.LocalProto,
+		RemoteHost:   r.RemoteHost,
+		RemotePort:   r.RemotePort,
+		RemoteProto:  r.RemoteProto,
+		Dynamic:      r.Dynamic,
+		Socks:        r.Socks,
+		Reverse:      r.Reverse,
+		Stdio:        r.Stdio,
+		Handler:      r.Handler,
+		OriginalDst:  r.OriginalDst,
+		Name:         r.Name,
+		RemoteSocket: r.RemoteSocket,
+		Codec:        r.Codec,
+	}
+}
+
+// Label is the name of the remote, or its string when it has none
+func (r *Remote) Label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.String()
+}
+
 // Encode remote to a string
 func (r *Remote) Encode() string {
 	if r.LocalPort == "" {
@@ -209,6 +350,9 @@ func (r *Remote) Encode() string {
 	if r.RemoteProto == "udp" {
 		remote += "/udp"
 	}
+	if r.Codec != "" {
+		remote += codecSeparator + r.Codec
+	}
 	if r.Reverse {
 		return "R:" + local + ":" + remote
 	}
@@ -231,6 +375,9 @@ func (r *Remote) Remote() string {
 	if r.Socks {
 		return "socks"
 	}
+	if r.RemoteSocket != "" {
+		return UnixPrefix + r.RemoteSocket
+	}
 	if r.RemoteHost == "" {
 		r.RemoteHost = "127.0.0.1"
 	}
@@ -243,6 +390,9 @@ func (r *Remote) UserAddr() string {
 	if r.Reverse {
 		return "R:" + r.LocalHost + ":" + r.LocalPort
 	}
+	if r.RemoteSocket != "" {
+		return UnixPrefix + r.RemoteSocket
+	}
 	return r.RemoteHost + ":" + r.RemotePort
 }
 
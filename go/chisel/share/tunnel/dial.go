@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Dialer opens the connections to the endpoints, *net.Dialer implements it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialEndpoint resolves the endpoint and connects to its addresses in turn
+// with Config.Dialer, the error of the last address is returned
+func (t *Tunnel) dialEndpoint(network, hostPort string) (net.Conn, error) {
+	//the upstream proxy resolves the endpoint unless it is looked up here
+	addrs := []string{hostPort}
+	var err error
+	if !t.usesUpstream(network) || t.Config.ResolveEndpoints {
+		if addrs, err = t.resolveHostPort(network, hostPort); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = t.dialer(network, addr).DialContext(context.Background(), network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialer returns Config.Dialer, or a dialer binding the connections to Config.SrcIP
+// when the resolved endpoint is in Config.SrcIPSubnets. The TCP connections go
+// through Config.UpstreamProxy when set, SrcIP then applies to the proxy address.
+func (t *Tunnel) dialer(network, hostPort string) Dialer {
+	if t.Config.Dialer != nil {
+		return t.Config.Dialer
+	}
+	if t.usesUpstream(network) {
+		return upstreamDialer(t.Config.UpstreamProxy, t.directDialer(network, t.Config.UpstreamProxy.Host))
+	}
+	return t.directDialer(network, hostPort)
+}
+
+// directDialer returns the dialer binding the connections to hostPort to Config.SrcIP
+func (t *Tunnel) directDialer(network, hostPort string) Dialer {
+	// TCP keepalive of the endpoint connections keeps the Go defaults unless configured
+	d := &net.Dialer{}
+	if t.Config.TCPKeepAlive > 0 {
+		interval := t.Config.TCPKeepAliveInterval
+		if interval <= 0 {
+			interval = t.Config.TCPKeepAlive
+		}
+		d.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     t.Config.TCPKeepAlive,
+			Interval: interval,
+			Count:    -1,
+		}
+	}
+	if t.Config.SrcIP != nil && t.srcIPApplies(hostPort) {
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: t.Config.SrcIP}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: t.Config.SrcIP}
+		}
+		if t.Config.SrcPorts.Max > 0 {
+			return &portRangeDialer{dialer: d, ports: t.Config.SrcPorts}
+		}
+	}
+	return d
+}
+
+// PortRange is an inclusive range of ports, the zero value is no range
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses the min-max range of Config.SrcPorts, a single port is
+// a range of one port and an empty string is no range
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		last = first
+	}
+	min, err := strconv.Atoi(first)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	max, err := strconv.Atoi(last)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// portRangeDialer binds the connections to a free port of the range,
+// starting at a random port to spread the connections
+type portRangeDialer struct {
+	dialer *net.Dialer
+	ports  PortRange
+}
+
+func (d *portRangeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n := d.ports.Max - d.ports.Min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := d.ports.Min + (start+i)%n
+		dialer := *d.dialer
+		switch laddr := d.dialer.LocalAddr.(type) {
+		case *net.UDPAddr:
+			dialer.LocalAddr = &net.UDPAddr{IP: laddr.IP, Port: port}
+		case *net.TCPAddr:
+			dialer.LocalAddr = &net.TCPAddr{IP: laddr.IP, Port: port}
+		}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		//the port is taken, try the next one
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("source ports %d-%d exhausted", d.ports.Min, d.ports.Max)
+}
+
+// srcIPApplies reports if the SrcIP is used to reach the endpoint
+func (t *Tunnel) srcIPApplies(hostPort string) bool {
+	if len(t.Config.SrcIPSubnets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range t.Config.SrcIPSubnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSrcIP parses Config.SrcIP, the address must be assigned to a local
+// interface for the connections to bind to it. It is nil when s is empty.
+func ParseSrcIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLocalIP(ip, addrs); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// checkLocalIP fails when ip is not one of the interface addresses
+func checkLocalIP(ip net.IP, addrs []net.Addr) error {
+	if ip.IsUnspecified() {
+		return nil
+	}
+	available := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.Equal(ip) {
+			return nil
+		}
+		available = append(available, ipNet.IP.String())
+	}
+	return fmt.Errorf("%s is not assigned to a local interface, available addresses: %s", ip, strings.Join(available, ", "))
+}
+
+// ParseSubnets parses the CIDRs of Config.SrcIPSubnets
+func ParseSubnets(cidrs []string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func sockoptInt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("Cannot get the raw connection: %s", err)
+	}
+	var value int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || sockErr != nil {
+		t.Fatalf("Cannot read the socket option: %v %v", err, sockErr)
+	}
+	return value
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	tun := &Tunnel{}
+	c, err := tun.dialEndpoint("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot dial: %s", err)
+	}
+	if sockoptInt(t, c.(*net.TCPConn), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Errorf("Expected the default TCP keepalive of Go")
+	}
+	c.Close()
+
+	tun.TCPKeepAlive = 42 * time.Second
+	tun.TCPKeepAliveInterval = 7 * time.Second
+	c, err = tun.dialEndpoint("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot dial: %s", err)
+	}
+	defer c.Close()
+	tc := c.(*net.TCPConn)
+	if sockoptInt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Errorf("Expected TCP keepalive to be enabled")
+	}
+	if idle := sockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 42 {
+		t.Errorf("Expected a keepalive idle time of 42s, got %ds", idle)
+	}
+	if interval := sockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); interval != 7 {
+		t.Errorf("Expected a keepalive interval of 7s, got %ds", interval)
+	}
+}
@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of the loggers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestJSONConnectEvent(t *testing.T) {
+	var out syncBuffer
+	l := cio.NewLogger("test")
+	l.Debug = true
+	l.JSON = true
+	l.SetOutput(&out)
+	tun := &Tunnel{Config: Config{Logger: l}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := newFakeSSHConn(false)
+	done := make(chan struct{})
+	go func() {
+		bindFakeSSH(ctx, tun, conn)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	var connected map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected a JSON log line, got %q: %s", line, err)
+		}
+		if entry["event"] == "ssh_connected" {
+			connected = entry
+		}
+	}
+	if connected == nil {
+		t.Fatalf("Expected a ssh_connected event in %q", out.String())
+	}
+	expected := map[string]interface{}{
+		"component":  "test",
+		"remote":     "127.0.0.1:1234",
+		"conn_count": float64(0),
+	}
+	for k, v := range expected {
+		if connected[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, connected[k])
+		}
+	}
+}
+
+func TestPipeRemoteClientAddr(t *testing.T) {
+	for _, debug := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var out syncBuffer
+		tun := testTunnel(ctx)
+		tun.Logger.Debug = debug
+		tun.Logger.SetOutput(&out)
+		remote, err := settings.DecodeRemote("3000:example.com:80")
+		if err != nil {
+			t.Fatalf("Cannot decode remote: %s", err)
+		}
+		p := &Proxy{
+			Logger: tun.Logger,
+			sshTun: tun,
+			remote: remote,
+			stats:  tun.remoteStats(remote),
+			conns:  tun.conns(),
+		}
+		dst, dstPeer := net.Pipe()
+		release := make(chan struct{})
+		close(release)
+		tun.activeConn = &channelSSHConn{fakeSSHConn: newFakeSSHConn(false), channel: &pipeChannel{Conn: dst, release: release}}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen: %s", err)
+		}
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Cannot connect: %s", err)
+		}
+		src, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Cannot accept: %s", err)
+		}
+		client.Close()
+		dstPeer.Close()
+		p.pipeRemote(ctx, src)
+		l.Close()
+		cancel()
+
+		expected := "conn#1: Open from " + client.LocalAddr().String() + " to example.com:80"
+		if logged := strings.Contains(out.String(), expected); logged != debug {
+			t.Errorf("Expected %q to be logged only with debug (debug %v), got %q", expected, debug, out.String())
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons of the SSH disconnections
+const (
+	DisconnectNormal    = "normal"
+	DisconnectKeepAlive = "keepalive-failure"
+	DisconnectCancelled = "context-cancel"
+)
+
+// Variables declared for monitoring.
+var (
+	SSHConnectCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pfconnector",
+		Subsystem: "tunnel",
+		Name:      "ssh_connects_total",
+		Help:      "Counter of SSH connections bound to tunnels.",
+	})
+	SSHDisconnectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pfconnector",
+		Subsystem: "tunnel",
+		Name:      "ssh_disconnects_total",
+		Help:      "Counter of SSH disconnections of tunnels per reason.",
+	}, []string{"reason"})
+	ProxyConnDropCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pfconnector",
+		Subsystem: "tunnel",
+		Name:      "proxy_connections_dropped_total",
+		Help:      "Counter of connections closed by proxies at their maximum of connections.",
+	})
+)
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHConn fails its pings when failPing is set and returns an error from Wait once closed
+type fakeSSHConn struct {
+	ssh.Conn
+	failPing  bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeSSHConn(failPing bool) *fakeSSHConn {
+	return &fakeSSHConn{failPing: failPing, closed: make(chan struct{})}
+}
+
+func (c *fakeSSHConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if c.failPing {
+		return false, nil, errors.New("ping failed")
+	}
+	return true, []byte("pong"), nil
+}
+
+func (c *fakeSSHConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, errors.New("no channel on a fake connection")
+}
+
+func (c *fakeSSHConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeSSHConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+func (c *fakeSSHConn) Wait() error {
+	<-c.closed
+	return errors.New("connection closed")
+}
+
+func bindFakeSSH(ctx context.Context, tun *Tunnel, c *fakeSSHConn) error {
+	reqs := make(chan *ssh.Request)
+	chans := make(chan ssh.NewChannel)
+	close(reqs)
+	close(chans)
+	return tun.BindSSH(ctx, c, reqs, chans)
+}
+
+func TestSSHDisconnectMetrics(t *testing.T) {
+	tun := &Tunnel{Config: Config{Logger: cio.NewLogger("test"), KeepAlive: 10 * time.Millisecond, KeepAliveJitter: -1}}
+	connects := testutil.ToFloat64(SSHConnectCount)
+	keepAlive := testutil.ToFloat64(SSHDisconnectCount.WithLabelValues(DisconnectKeepAlive))
+	cancelled := testutil.ToFloat64(SSHDisconnectCount.WithLabelValues(DisconnectCancelled))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := bindFakeSSH(ctx, tun, newFakeSSHConn(true)); err == nil {
+		t.Errorf("Expected the error of the connection")
+	}
+	if got := testutil.ToFloat64(SSHDisconnectCount.WithLabelValues(DisconnectKeepAlive)); got != keepAlive+1 {
+		t.Errorf("Expected a keepalive failure disconnection, got %v", got-keepAlive)
+	}
+
+	tun.Config.KeepAlive = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	bindFakeSSH(ctx, tun, newFakeSSHConn(false))
+	if got := testutil.ToFloat64(SSHDisconnectCount.WithLabelValues(DisconnectCancelled)); got != cancelled+1 {
+		t.Errorf("Expected a context cancel disconnection, got %v", got-cancelled)
+	}
+
+	if got := testutil.ToFloat64(SSHConnectCount); got != connects+2 {
+		t.Errorf("Expected 2 connections, got %v", got-connects)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of netfilter
+const soOriginalDst = 80
+
+// lookupOriginalDst can be replaced in tests
+var lookupOriginalDst = originalDst
+
+// originalDst returns the destination of a connection redirected by netfilter
+func originalDst(c net.Conn) (string, error) {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv4 := tcp.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var ip net.IP
+	var port int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			//the sockaddr_in fits in the ip_mreqn
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockErr == nil {
+				port = int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+				ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			}
+		} else {
+			//the sockaddr_in6 fits in the ip6_mtuinfo
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if sockErr == nil {
+				var b [2]byte
+				binary.NativeEndian.PutUint16(b[:], info.Addr.Port)
+				port = int(binary.BigEndian.Uint16(b[:]))
+				ip = net.IP(info.Addr.Addr[:])
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+// lookupOriginalDst can be replaced in tests
+var lookupOriginalDst = originalDst
+
+func originalDst(c net.Conn) (string, error) {
+	return "", errors.New("original destination is only supported on Linux")
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+)
+
+func TestOriginalDst(t *testing.T) {
+	remote, err := settings.DecodeRemote("3000:127.0.0.1:80/tcp|original-dst")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	if !remote.OriginalDst {
+		t.Fatalf("Expected the original destination to be enabled")
+	}
+	if _, err := settings.DecodeRemote("3000:127.0.0.1:80/udp|original-dst"); err == nil {
+		t.Errorf("Expected an error for an UDP remote")
+	}
+
+	lookups := 0
+	lookupOriginalDst = func(c net.Conn) (string, error) {
+		lookups++
+		if lookups > 1 {
+			return "", errors.New("no original destination")
+		}
+		return "192.0.2.10:8080", nil
+	}
+	defer func() { lookupOriginalDst = originalDst }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	dst, dstPeer := net.Pipe()
+	dstPeer.Close()
+	release := make(chan struct{})
+	close(release)
+	conn := &channelSSHConn{fakeSSHConn: newFakeSSHConn(false), channel: &pipeChannel{Conn: dst, release: release}}
+	tun.activeConn = conn
+	p := &Proxy{
+		Logger: tun.Logger,
+		sshTun: tun,
+		remote: remote,
+		stats:  tun.remoteStats(remote),
+		conns:  tun.conns(),
+	}
+
+	src, srcPeer := net.Pipe()
+	defer srcPeer.Close()
+	p.pipeRemote(ctx, src)
+	if conn.data != "192.0.2.10:8080" {
+		t.Errorf("Expected the channel to the original destination, got %q", conn.data)
+	}
+
+	// no fallback to the fixed endpoint
+	conn.data = ""
+	src, srcPeer = net.Pipe()
+	defer srcPeer.Close()
+	p.pipeRemote(ctx, src)
+	if conn.data != "" {
+		t.Errorf("Expected no channel without the original destination, got %q", conn.data)
+	}
+}
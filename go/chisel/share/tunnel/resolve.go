@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Address families for Config.PreferFamily
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// resolveHostPort returns the addresses to dial for the endpoint. Without
+// Config.ResolveEndpoints the endpoint is resolved by the system to a single address.
+// Otherwise the host is looked up on every call so new connections follow
+// DNS changes, the addresses of the preferred address family come first
+func (t *Tunnel) resolveHostPort(network, hostPort string) ([]string, error) {
+	switch t.Config.PreferFamily {
+	case "", FamilyIPv4, FamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family %q", t.Config.PreferFamily)
+	}
+	if !t.Config.ResolveEndpoints {
+		addr, err := resolveAddr(network, hostPort)
+		if err != nil {
+			return nil, err
+		}
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{hostPort}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lookup := t.Config.Resolver
+	if lookup == nil {
+		lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		}
+	}
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if t.Config.PreferFamily != "" {
+		preferV4 := t.Config.PreferFamily == FamilyIPv4
+		sort.SliceStable(ips, func(i, j int) bool {
+			iV4, jV4 := ips[i].To4() != nil, ips[j].To4() != nil
+			return iV4 != jV4 && iV4 == preferV4
+		})
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs, nil
+}
+
+// resolveAddr resolves the endpoint like net.ResolveTCPAddr or net.ResolveUDPAddr
+func resolveAddr(network, hostPort string) (string, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		addr, err := net.ResolveUDPAddr(network, hostPort)
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	default:
+		addr, err := net.ResolveTCPAddr(network, hostPort)
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	}
+}
@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHInfo are the algorithms negotiated by an SSH connection, the cipher and
+// the MAC are the ones of the client to server direction. The MAC is empty
+// for the AEAD ciphers which authenticate the packets themselves.
+type SSHInfo struct {
+	KeyExchange string
+	HostKey     string
+	Cipher      string
+	MAC         string
+}
+
+// The SSH message starting the key exchange, sent in clear by both sides
+const msgKexInit = 20
+
+// Largest handshake recorded before the key exchange init messages are found
+const maxKexRecord = 256 * 1024
+
+// The ciphers without a separate MAC
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"aes256-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// kexInit are the algorithm lists of a key exchange init message
+type kexInit struct {
+	kex, hostKey, cipher, mac []string
+}
+
+// KexRecorder records the key exchange init messages of the SSH handshake made on
+// its connection, the SSH library does not expose the algorithms it negotiated
+type KexRecorder struct {
+	net.Conn
+	client bool
+	mut    sync.Mutex
+	// the bytes read and written until the messages are parsed, nil once done
+	read, written *bytes.Buffer
+	local, peer   *kexInit
+}
+
+// NewKexRecorder records the handshake of the client or the server side of an SSH connection on conn
+func NewKexRecorder(conn net.Conn, client bool) *KexRecorder {
+	return &KexRecorder{Conn: conn, client: client, read: &bytes.Buffer{}, written: &bytes.Buffer{}}
+}
+
+func (r *KexRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.record(p[:n], &r.read, &r.peer)
+	}
+	return n, err
+}
+
+func (r *KexRecorder) Write(p []byte) (int, error) {
+	r.record(p, &r.written, &r.local)
+	return r.Conn.Write(p)
+}
+
+func (r *KexRecorder) record(p []byte, buf **bytes.Buffer, init **kexInit) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if *buf == nil {
+		return
+	}
+	(*buf).Write(p)
+	k, done, err := parseKexInit((*buf).Bytes())
+	if err != nil || (*buf).Len() > maxKexRecord {
+		*buf = nil
+		return
+	}
+	if done {
+		*init = k
+		*buf = nil
+	}
+}
+
+// SSHInfo returns the algorithms negotiated by the handshake, zero until it is done
+func (r *KexRecorder) SSHInfo() SSHInfo {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.local == nil || r.peer == nil {
+		return SSHInfo{}
+	}
+	client, server := r.local, r.peer
+	if !r.client {
+		client, server = server, client
+	}
+	info := SSHInfo{
+		KeyExchange: agreedAlgorithm(client.kex, server.kex),
+		HostKey:     agreedAlgorithm(client.hostKey, server.hostKey),
+		Cipher:      agreedAlgorithm(client.cipher, server.cipher),
+	}
+	if !aeadCiphers[info.Cipher] {
+		info.MAC = agreedAlgorithm(client.mac, server.mac)
+	}
+	return info
+}
+
+// agreedAlgorithm is the first algorithm of the client also supported by the server (RFC 4253 7.1)
+func agreedAlgorithm(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// parseKexInit parses the key exchange init message following the version
+// exchange in buf, it is not done while buf is too short to hold it
+func parseKexInit(buf []byte) (*kexInit, bool, error) {
+	//the version line can be preceded by other lines
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return nil, false, nil
+		}
+		line := buf[:i]
+		buf = buf[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+	if len(buf) < 5 {
+		return nil, false, nil
+	}
+	length := binary.BigEndian.Uint32(buf)
+	if length > maxKexRecord {
+		return nil, false, errors.New("packet too large")
+	}
+	if uint32(len(buf)-4) < length {
+		return nil, false, nil
+	}
+	padding := uint32(buf[4])
+	if padding+1 > length {
+		return nil, false, errors.New("invalid padding")
+	}
+	payload := buf[5 : 4+length-padding]
+	//message type and cookie
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil, false, errors.New("not a key exchange init message")
+	}
+	payload = payload[17:]
+	lists := make([][]string, 6)
+	for i := range lists {
+		if len(payload) < 4 {
+			return nil, false, errors.New("truncated name list")
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < n {
+			return nil, false, errors.New("truncated name list")
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(payload[4:4+n]), ",")
+		}
+		payload = payload[4+n:]
+	}
+	//kex, host key, ciphers and MACs from the client to the server, then from the server to the client
+	return &kexInit{kex: lists[0], hostKey: lists[1], cipher: lists[2], mac: lists[4]}, true, nil
+}
+
+// sshInfoConn is an SSH connection along with the algorithms it negotiated
+type sshInfoConn struct {
+	ssh.Conn
+	info SSHInfo
+}
+
+func (c *sshInfoConn) SSHInfo() SSHInfo {
+	return c.info
+}
+
+// WithSSHInfo attaches the algorithms negotiated by the SSH connection,
+// they are returned by Tunnel.SSHInfo once it is bound
+func WithSSHInfo(c ssh.Conn, info SSHInfo) ssh.Conn {
+	return &sshInfoConn{Conn: c, info: info}
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+)
+
+func TestSSHInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inbound := testTunnel(ctx)
+	inbound.activatingConn.Add(1)
+	outbound := &Tunnel{Config: Config{Logger: cio.NewLogger("test"), Outbound: true}}
+	outbound.activatingConn.Add(1)
+	if info := inbound.SSHInfo(); info != (SSHInfo{}) {
+		t.Errorf("Expected no info without a connection, got %+v", info)
+	}
+
+	loopbackSSH(ctx, t, inbound, outbound)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer waitCancel()
+	if err := inbound.WaitActive(waitCtx); err != nil {
+		t.Fatalf("Inbound tunnel is not active: %s", err)
+	}
+	if err := outbound.WaitActive(waitCtx); err != nil {
+		t.Fatalf("Outbound tunnel is not active: %s", err)
+	}
+
+	info := inbound.SSHInfo()
+	if info.KeyExchange == "" || info.HostKey != "ssh-ed25519" || info.Cipher == "" {
+		t.Errorf("Expected the negotiated algorithms, got %+v", info)
+	}
+	if !aeadCiphers[info.Cipher] && info.MAC == "" {
+		t.Errorf("Expected the MAC of %s, got %+v", info.Cipher, info)
+	}
+	if peer := outbound.SSHInfo(); peer != info {
+		t.Errorf("Expected both sides to agree, got %+v and %+v", info, peer)
+	}
+}
+
+func TestAgreedAlgorithm(t *testing.T) {
+	client := []string{"curve25519-sha256", "ecdh-sha2-nistp256", "ext-info-c"}
+	if a := agreedAlgorithm(client, []string{"ecdh-sha2-nistp256", "curve25519-sha256"}); a != "curve25519-sha256" {
+		t.Errorf("Expected the first algorithm of the client, got %q", a)
+	}
+	if a := agreedAlgorithm(client, []string{"diffie-hellman-group14-sha256"}); a != "" {
+		t.Errorf("Expected no algorithm in common, got %q", a)
+	}
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cnet"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+)
+
+// RemoteStats is a snapshot of the bytes proxied for a remote.
+// BytesIn is what was received from the local side and sent through the tunnel,
+// BytesOut is what came back through the tunnel and was written to the local side.
+type RemoteStats struct {
+	BytesIn  int64
+	BytesOut int64
+}
+
+// remoteStats holds the byte counters of a remote, safe to read during transfers
+type remoteStats struct {
+	in, out int64
+}
+
+func (s *remoteStats) addIn(n int) {
+	atomic.AddInt64(&s.in, int64(n))
+}
+
+func (s *remoteStats) addOut(n int) {
+	atomic.AddInt64(&s.out, int64(n))
+}
+
+func (s *remoteStats) snapshot() RemoteStats {
+	return RemoteStats{
+		BytesIn:  atomic.LoadInt64(&s.in),
+		BytesOut: atomic.LoadInt64(&s.out),
+	}
+}
+
+// meter counts the bytes read from and written to the local side of a proxy
+func (s *remoteStats) meter(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &meteredRWC{ReadWriteCloser: rwc, stats: s}
+}
+
+type meteredRWC struct {
+	io.ReadWriteCloser
+	stats *remoteStats
+}
+
+func (m *meteredRWC) Read(p []byte) (int, error) {
+	n, err := m.ReadWriteCloser.Read(p)
+	m.stats.addIn(n)
+	return n, err
+}
+
+func (m *meteredRWC) Write(p []byte) (int, error) {
+	n, err := m.ReadWriteCloser.Write(p)
+	m.stats.addOut(n)
+	return n, err
+}
+
+// ConnStats is a snapshot of the connections of a tunnel per lifecycle stage,
+// a drain is done once all of them are back to zero
+type ConnStats struct {
+	Opening int32
+	Open    int32
+	Closing int32
+}
+
+// Stats returns a snapshot of the connections of the tunnel
+func (t *Tunnel) Stats() ConnStats {
+	opening, open, closing := t.connStats.Counts()
+	return ConnStats{Opening: opening, Open: open, Closing: closing}
+}
+
+func (t *Tunnel) conns() *cnet.ConnCount {
+	return &t.connStats
+}
+
+func (t *Tunnel) maxProxyConns() int {
+	return t.Config.MaxProxyConns
+}
+
+// onClose calls closing on the first Close of rwc
+func onClose(rwc io.ReadWriteCloser, closing func()) io.ReadWriteCloser {
+	return &closingRWC{ReadWriteCloser: rwc, closing: closing}
+}
+
+type closingRWC struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	closing func()
+}
+
+func (c *closingRWC) Close() error {
+	c.once.Do(c.closing)
+	return c.ReadWriteCloser.Close()
+}
+
+// remoteStats returns the counters of the remote, creating them on first use.
+// They are keyed by the label of the remote.
+func (t *Tunnel) remoteStats(remote *settings.Remote) *remoteStats {
+	key := remote.Label()
+	t.statsMut.Lock()
+	defer t.statsMut.Unlock()
+	if t.stats == nil {
+		t.stats = map[string]*remoteStats{}
+	}
+	s, found := t.stats[key]
+	if !found {
+		s = &remoteStats{}
+		t.stats[key] = s
+	}
+	return s
+}
+
+// RemoteStats returns a snapshot of the bytes proxied per remote label
+func (t *Tunnel) RemoteStats() map[string]RemoteStats {
+	t.statsMut.Lock()
+	defer t.statsMut.Unlock()
+	stats := make(map[string]RemoteStats, len(t.stats))
+	for key, s := range t.stats {
+		stats[key] = s.snapshot()
+	}
+	return stats
+}
@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRemoteStats(t *testing.T) {
+	remote, err := settings.DecodeRemote("3000:localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	tun := &Tunnel{}
+	stats := tun.remoteStats(remote)
+	if tun.remoteStats(remote) != stats {
+		t.Fatalf("Remote stats are not reused for the same remote")
+	}
+
+	local, localPeer := net.Pipe()
+	dst, dstPeer := net.Pipe()
+	go func() {
+		localPeer.Write(bytes.Repeat([]byte{1}, 1000))
+		io.ReadFull(localPeer, make([]byte, 250))
+		localPeer.Close()
+	}()
+	go func() {
+		io.CopyN(io.Discard, dstPeer, 1000)
+		dstPeer.Write(bytes.Repeat([]byte{2}, 250))
+		io.Copy(io.Discard, dstPeer)
+	}()
+	cio.Pipe(stats.meter(local), dst)
+
+	snapshot := tun.RemoteStats()[remote.String()]
+	if snapshot.BytesIn != 1000 {
+		t.Errorf("Expected 1000 bytes in, got %d", snapshot.BytesIn)
+	}
+	if snapshot.BytesOut != 250 {
+		t.Errorf("Expected 250 bytes out, got %d", snapshot.BytesOut)
+	}
+}
+
+// pipeChannel is an SSH channel over a pipe, its Close blocks until release is closed
+type pipeChannel struct {
+	net.Conn
+	release chan struct{}
+}
+
+func (c *pipeChannel) Close() error {
+	<-c.release
+	return c.Conn.Close()
+}
+
+func (c *pipeChannel) CloseWrite() error {
+	return nil
+}
+
+func (c *pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func (c *pipeChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+type channelSSHConn struct {
+	*fakeSSHConn
+	channel ssh.Channel
+	data    string
+}
+
+func (c *channelSSHConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	c.data = string(data)
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return c.channel, reqs, nil
+}
+
+func waitStats(tun *Tunnel, expected ConnStats) bool {
+	for i := 0; i < 100; i++ {
+		if tun.Stats() == expected {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPipeRemoteCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	remote, err := settings.DecodeRemote("3000:localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	p := &Proxy{
+		Logger: tun.Logger,
+		sshTun: tun,
+		remote: remote,
+		stats:  tun.remoteStats(remote),
+		conns:  tun.conns(),
+	}
+	// neither side ever sends or closes, the copies are stalled
+	dst, dstPeer := net.Pipe()
+	defer dstPeer.Close()
+	release := make(chan struct{})
+	close(release)
+	tun.activeConn = &channelSSHConn{fakeSSHConn: newFakeSSHConn(false), channel: &pipeChannel{Conn: dst, release: release}}
+	src, srcPeer := net.Pipe()
+	defer srcPeer.Close()
+	proxyCtx, cancelProxy := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		p.pipeRemote(proxyCtx, src)
+		close(done)
+	}()
+	if !waitStats(tun, ConnStats{Open: 1}) {
+		t.Fatalf("Expected an open connection, got %+v", tun.Stats())
+	}
+
+	cancelProxy()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the stalled connection to be closed once the proxy is cancelled")
+	}
+	if stats := tun.Stats(); stats != (ConnStats{}) {
+		t.Errorf("Expected no connections, got %+v", stats)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	remote, err := settings.DecodeRemote("3000:localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	p := &Proxy{
+		Logger: tun.Logger,
+		sshTun: tun,
+		remote: remote,
+		stats:  tun.remoteStats(remote),
+		conns:  tun.conns(),
+	}
+
+	// no SSH connection yet, the connection waits while opening
+	tun.activatingConn.Add(1)
+	src, srcPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.pipeRemote(ctx, src)
+		close(done)
+	}()
+	if !waitStats(tun, ConnStats{Opening: 1}) {
+		t.Fatalf("Expected an opening connection, got %+v", tun.Stats())
+	}
+
+	dst, dstPeer := net.Pipe()
+	defer dstPeer.Close()
+	release := make(chan struct{})
+	tun.activeConnMut.Lock()
+	tun.activeConn = &channelSSHConn{fakeSSHConn: newFakeSSHConn(false), channel: &pipeChannel{Conn: dst, release: release}}
+	tun.activeConnMut.Unlock()
+	tun.activatingConn.Done()
+	if !waitStats(tun, ConnStats{Open: 1}) {
+		t.Fatalf("Expected an open connection, got %+v", tun.Stats())
+	}
+
+	srcPeer.Close()
+	if !waitStats(tun, ConnStats{Closing: 1}) {
+		t.Fatalf("Expected a closing connection, got %+v", tun.Stats())
+	}
+	close(release)
+	<-done
+	if stats := tun.Stats(); stats != (ConnStats{}) {
+		t.Errorf("Expected no connections, got %+v", stats)
+	}
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"net/url"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -29,8 +34,52 @@ type Config struct {
 	RadiusSecret string
 	RadiusProxy  *radius_proxy.Proxy
 	KeepAlive    time.Duration
+	// Fraction of KeepAlive randomly added to or removed from each interval
+	// so pings of many tunnels spread out, 0 uses DefaultKeepAliveJitter
+	// and a negative value disables it
+	KeepAliveJitter float64
+	// Close SOCKS connections without traffic for this duration (0 disables)
+	SocksIdleTimeout time.Duration
+	// Pass the hostnames of the SOCKS5 requests unresolved to the Dialer so they
+	// are resolved where it connects (e.g. split-horizon DNS), instead of on this node
+	SocksRemoteResolve bool
 	// The source IP for the packets that come into the remote
 	SrcIP net.IP
+	// Destinations the SrcIP is used for, all of them when empty (see ParseSubnets)
+	SrcIPSubnets []*net.IPNet
+	// Source ports of the connections bound to SrcIP, the system picks
+	// them when empty (see ParsePortRange)
+	SrcPorts PortRange
+	// Look up the endpoint hosts with Resolver on each new connection and
+	// dial their addresses in turn, instead of the single system resolution
+	ResolveEndpoints bool
+	// Resolver of ResolveEndpoints, defaults to the system resolver
+	Resolver func(ctx context.Context, host string) ([]net.IP, error)
+	// Address family dialed first when an endpoint host has both (FamilyIPv4 or FamilyIPv6)
+	PreferFamily string
+	// Dialer opens the connections to the endpoints, the default dialer
+	// binds them to SrcIP. A custom dialer is responsible for SrcIP.
+	Dialer Dialer
+	// Upstream SOCKS5 or HTTP CONNECT proxy the TCP endpoint connections go through
+	// (see ParseUpstreamProxy), nil connects directly. Ignored with a custom Dialer.
+	UpstreamProxy *url.URL
+	// Idle time before the TCP keepalive probes of the endpoint connections,
+	// 0 keeps the Go defaults. Ignored with a custom Dialer.
+	TCPKeepAlive time.Duration
+	// Interval between the TCP keepalive probes, defaults to TCPKeepAlive
+	TCPKeepAliveInterval time.Duration
+	// Maximum number of proxies bound at the same time (0 disables the limit)
+	MaxProxies int
+	// Maximum number of connections each TCP proxy pipes at the same time, the
+	// connections over it are closed once accepted (0 disables the limit)
+	MaxProxyConns int
+	// Close the TCP endpoint connections without traffic for this duration (0 disables)
+	EndpointIdleTimeout time.Duration
+	// Close the TCP endpoint connections this long after they were opened,
+	// whatever their traffic (0 disables)
+	EndpointDeadline time.Duration
+	// Version sent to the peer right after binding an SSH connection, empty sends none
+	Version string
 }
 
 // Tunnel represents an SSH tunnel with proxy capabilities.
@@ -46,10 +95,16 @@ type Tunnel struct {
 	activeConnMut  sync.RWMutex
 	activatingConn waitGroup
 	activeConn     ssh.Conn
+	//algorithms negotiated by the active connection
+	sshInfo SSHInfo
 	//proxies
+	proxiesMut sync.Mutex
+	proxies    map[int]*boundProxy
 	proxyCount int
 	//internals
 	connStats   cnet.ConnCount
+	statsMut    sync.Mutex
+	stats       map[string]*remoteStats
 	socksServer *socks5.Server
 
 	connectionCtx context.Context
@@ -58,6 +113,53 @@ type Tunnel struct {
 	ConnectorID       string
 	radiusProxy       *radius_proxy.Proxy
 	k8ControllerDrop  chan struct{}
+	closeOnce         sync.Once
+	closed            int32
+	//count of the SSH connections dropped while not cancelled nor closed,
+	//lost is set until the next connection
+	connLost uint32
+	lost     int32
+	//version sent by the peer of the current SSH connection
+	peerVersionMut sync.Mutex
+	peerVersion    string
+	//last error of the SSH connection or the proxies
+	lastErrMut sync.Mutex
+	lastErr    TunnelError
+}
+
+// The sources of a TunnelError
+const (
+	ErrorSourceSSH   = "ssh"
+	ErrorSourceProxy = "proxy"
+)
+
+// TunnelError is an error that stopped the SSH connection or the proxies of a Tunnel
+type TunnelError struct {
+	// ErrorSourceSSH or ErrorSourceProxy
+	Source string
+	Err    error
+	Time   time.Time
+}
+
+// versionRequest is the global SSH request carrying the version of the peer
+const versionRequest = "version"
+
+// ErrConnectionLost is returned by BindRemotes when the SSH connection dropped
+// while the proxies were running, as opposed to a cancellation or Close,
+// so the caller can reconnect. Err is the error of the proxies, if any.
+type ErrConnectionLost struct {
+	Err error
+}
+
+func (e *ErrConnectionLost) Error() string {
+	if e.Err != nil {
+		return "SSH connection lost: " + e.Err.Error()
+	}
+	return "SSH connection lost"
+}
+
+func (e *ErrConnectionLost) Unwrap() error {
+	return e.Err
 }
 
 // New Tunnel from the given Config
@@ -69,33 +171,62 @@ func New(c Config) *Tunnel {
 	radiusProxy, stop, err := radius_proxy.NewRadiusProxyFromKubernetes(c.Logger, c.RadiusSecret)
 
 	if err != nil {
-		t.Infof("Error getting pod info: %s", err.Error())
+		t.InfoEventf("radius_proxy_failed", cio.Fields{"error": err.Error()}, "Error getting pod info: %s", err.Error())
 	} else {
 		t.radiusProxy = radiusProxy
 		t.k8ControllerDrop = stop
 		go radiusProxy.Cleanup(stop)
-		t.Infof("Radius Proxy setup is done")
+		t.InfoEventf("radius_proxy_ready", nil, "Radius Proxy setup is done")
 	}
 
 	t.activatingConn.Add(1)
 	//setup socks server (not listening on any port!)
 	extra := ""
 	if c.Socks {
-		sl := log.New(ioutil.Discard, "", 0)
-		if t.Logger.Debug {
-			sl = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
-		}
-		t.socksServer, _ = socks5.New(&socks5.Config{Logger: sl})
+		t.socksServer, _ = t.newSocksServer()
 		extra += " (SOCKS enabled)"
 	}
 	t.Debugf("Created%s", extra)
 	return t
 }
 
+func (t *Tunnel) newSocksServer() (*socks5.Server, error) {
+	sl := log.New(ioutil.Discard, "", 0)
+	if t.Logger.Debug {
+		sl = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
+	}
+	config := &socks5.Config{Logger: sl}
+	if t.Config.SocksRemoteResolve {
+		config.Resolver = unresolvedNames{}
+		config.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dialer(network, addr).DialContext(ctx, network, addr)
+		}
+	}
+	return socks5.New(config)
+}
+
+// unresolvedNames keeps the hostnames of the SOCKS5 requests,
+// the requests without an IP are dialed with their hostname
+type unresolvedNames struct{}
+
+func (unresolvedNames) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// ErrSSHAlreadyBound is returned by BindSSH while another SSH connection is active,
+// the connection is left untouched for the caller to close
+var ErrSSHAlreadyBound = errors.New("SSH connection already bound")
+
 // BindSSH provides an active SSH for use for tunnelling
 func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel) error {
+	//mark active and unblock
+	t.activeConnMut.Lock()
+	if t.activeConn != nil {
+		t.activeConnMut.Unlock()
+		t.Infof("Rejected SSH connection from %s, a connection is already active", c.RemoteAddr())
+		return ErrSSHAlreadyBound
+	}
 	//link ctx to ssh-conn
-	t.connectionCtx = ctx
 	go func() {
 		<-ctx.Done()
 		if c.Close() == nil {
@@ -103,32 +234,92 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 		}
 		t.activatingConn.DoneAll()
 	}()
-	//mark active and unblock
-	t.activeConnMut.Lock()
-	if t.activeConn != nil {
-		panic("double bind ssh")
-	}
 	t.activeConn = c
+	t.connectionCtx = ctx
+	t.sshInfo = SSHInfo{}
+	if info, ok := c.(interface{ SSHInfo() SSHInfo }); ok {
+		t.sshInfo = info.SSHInfo()
+	}
 	t.activeConnMut.Unlock()
+	atomic.StoreInt32(&t.lost, 0)
+	t.setPeerVersion("")
 	t.activatingConn.Done()
+	SSHConnectCount.Inc()
 	//optional keepalive loop against this connection
+	var keepAliveFailed int32
 	if t.Config.KeepAlive > 0 {
-		go t.keepAliveLoop(c)
+		go func() {
+			t.keepAliveLoop(c)
+			//close ssh connection on abnormal ping
+			atomic.StoreInt32(&keepAliveFailed, 1)
+			c.Close()
+		}()
 	}
 	//block until closed
 	go t.handleSSHRequests(reqs)
 	go t.handleSSHChannels(chans)
-	t.Debugf("SSH connected")
+	if t.Config.Version != "" {
+		if _, _, err := c.SendRequest(versionRequest, false, []byte(t.Config.Version)); err != nil {
+			t.Debugf("Cannot send the version: %s", err)
+		}
+	}
+	t.DebugEventf("ssh_connected", t.sshEventFields(c), "SSH connected")
 	err := c.Wait()
-	t.Debugf("SSH disconnected")
+	reason := DisconnectNormal
+	if atomic.LoadInt32(&keepAliveFailed) == 1 {
+		reason = DisconnectKeepAlive
+	} else if ctx.Err() != nil {
+		reason = DisconnectCancelled
+	}
+	SSHDisconnectCount.WithLabelValues(reason).Inc()
+	if reason != DisconnectCancelled && atomic.LoadInt32(&t.closed) == 0 {
+		atomic.StoreInt32(&t.lost, 1)
+		atomic.AddUint32(&t.connLost, 1)
+	}
+	if err != nil {
+		t.setLastError(ErrorSourceSSH, err)
+	}
+	fields := t.sshEventFields(c)
+	fields["reason"] = reason
+	t.DebugEventf("ssh_disconnected", fields, "SSH disconnected (%s)", reason)
 	//mark inactive and block
 	t.activatingConn.Add(1)
 	t.activeConnMut.Lock()
 	t.activeConn = nil
+	t.connectionCtx = nil
+	t.sshInfo = SSHInfo{}
 	t.activeConnMut.Unlock()
 	return err
 }
 
+// PeerVersion returns the version sent by the peer of the SSH connection,
+// empty when it sent none
+func (t *Tunnel) PeerVersion() string {
+	t.peerVersionMut.Lock()
+	defer t.peerVersionMut.Unlock()
+	return t.peerVersion
+}
+
+func (t *Tunnel) setPeerVersion(version string) {
+	t.peerVersionMut.Lock()
+	t.peerVersion = version
+	t.peerVersionMut.Unlock()
+}
+
+// LastError returns the last error that stopped the SSH connection or the
+// proxies, its Err is nil when there was none
+func (t *Tunnel) LastError() TunnelError {
+	t.lastErrMut.Lock()
+	defer t.lastErrMut.Unlock()
+	return t.lastErr
+}
+
+func (t *Tunnel) setLastError(source string, err error) {
+	t.lastErrMut.Lock()
+	t.lastErr = TunnelError{Source: source, Err: err, Time: time.Now()}
+	t.lastErrMut.Unlock()
+}
+
 // getSSH blocks while connecting
 func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
 	//cancelled already?
@@ -167,7 +358,87 @@ func (t *Tunnel) activatingConnWait() <-chan struct{} {
 
 // Bind remotes that are tied to the context of the SSH connection
 func (t *Tunnel) BindDynamicRemotes(remotes []*settings.Remote) error {
-	return t.BindRemotes(t.connectionCtx, remotes)
+	ctx := t.connCtx()
+	if ctx == nil {
+		return errors.New("no ssh connection")
+	}
+	return t.BindRemotes(ctx, remotes)
+}
+
+// ErrSSHNotConnected is returned by BindRemotesWithTimeout when
+// no SSH connection is active by the end of the timeout
+var ErrSSHNotConnected = errors.New("SSH connection not active")
+
+// BindRemotesWithTimeout is BindRemotes failing with ErrSSHNotConnected
+// instead of binding the proxies when no SSH connection is active within timeout
+func (t *Tunnel) BindRemotesWithTimeout(ctx context.Context, remotes []*settings.Remote, timeout time.Duration) error {
+	if err := t.waitSSH(ctx, timeout); err != nil {
+		return err
+	}
+	return t.BindRemotes(ctx, remotes)
+}
+
+// waitSSH blocks until an SSH connection is active, unlike getSSH it does not wait for SSH_WAIT
+func (t *Tunnel) waitSSH(ctx context.Context, timeout time.Duration) error {
+	if t.getActiveConn() != nil {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrSSHNotConnected
+	case <-t.activatingConnWait():
+	}
+	//the wait is also released when the connection is cancelled
+	if t.getActiveConn() == nil {
+		return ErrSSHNotConnected
+	}
+	return nil
+}
+
+// WaitActive blocks until an SSH connection is active, it returns the
+// error of ctx when ctx is done first
+func (t *Tunnel) WaitActive(ctx context.Context) error {
+	for t.getActiveConn() == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.activatingConnWait():
+		}
+		//the wait is also released when a connection is cancelled, do not spin until the next one
+		if t.getActiveConn() == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
+
+// SSHInfo returns the algorithms negotiated by the active SSH connection,
+// zero when there is none or when they were not recorded (see WithSSHInfo)
+func (t *Tunnel) SSHInfo() SSHInfo {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	return t.sshInfo
+}
+
+func (t *Tunnel) getActiveConn() ssh.Conn {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	return t.activeConn
+}
+
+// connCtx returns the context of the active SSH connection, nil when there is none
+func (t *Tunnel) connCtx() context.Context {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	return t.connectionCtx
 }
 
 // BindRemotes converts the given remotes into proxies, and blocks
@@ -179,33 +450,244 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	if !t.Inbound {
 		return errors.New("inbound connections blocked")
 	}
+	indexes, err := t.reserveProxies(remotes)
+	if err != nil {
+		return err
+	}
 	proxies := make([]*Proxy, len(remotes))
 	for i, remote := range remotes {
-		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
+		p, err := NewProxy(t.Logger, t, indexes[i], remote)
 		if err != nil {
+			for _, p := range proxies[:i] {
+				p.close()
+			}
+			t.releaseProxies(indexes)
 			return err
 		}
 		proxies[i] = p
-		t.proxyCount++
 	}
-	//TODO: handle tunnel close
+	connLost := atomic.LoadUint32(&t.connLost)
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, proxy := range proxies {
 		p := proxy
+		ctx, cancel := context.WithCancel(ctx)
+		if !t.trackProxy(p, cancel) {
+			cancel()
+		}
 		eg.Go(func() error {
+			defer t.untrackProxy(p)
 			return p.Run(ctx)
 		})
 	}
-	t.Debugf("Bound proxies")
-	err := eg.Wait()
-	t.Debugf("Unbound proxies")
+	t.DebugEventf("proxies_bound", t.remotesEventFields(remotes), "Bound proxies")
+	err = eg.Wait()
+	if err != nil {
+		t.setLastError(ErrorSourceProxy, err)
+	}
+	t.DebugEventf("proxies_unbound", t.remotesEventFields(remotes), "Unbound proxies")
+	//a connection dropped during the run and none replaced it
+	if atomic.LoadUint32(&t.connLost) != connLost && atomic.LoadInt32(&t.lost) == 1 {
+		return &ErrConnectionLost{Err: err}
+	}
 	return err
 }
 
+func (t *Tunnel) sshEventFields(c ssh.Conn) cio.Fields {
+	return cio.Fields{
+		"remote":     c.RemoteAddr().String(),
+		"conn_count": t.connStats.OpenCount(),
+	}
+}
+
+func (t *Tunnel) remotesEventFields(remotes []*settings.Remote) cio.Fields {
+	names := make([]string, len(remotes))
+	for i, remote := range remotes {
+		names[i] = remote.String()
+	}
+	return cio.Fields{
+		"remote":     names,
+		"conn_count": t.connStats.OpenCount(),
+	}
+}
+
+// AddRemote binds a single remote on the active SSH connection, the proxy
+// runs until the connection closes or the remote is removed with RemoveRemote
+func (t *Tunnel) AddRemote(remote *settings.Remote) error {
+	if !t.Inbound {
+		return errors.New("inbound connections blocked")
+	}
+	connCtx := t.connCtx()
+	if connCtx == nil || connCtx.Err() != nil {
+		return errors.New("no ssh connection")
+	}
+	indexes, err := t.reserveRemote(remote)
+	if err != nil {
+		return err
+	}
+	p, err := NewProxy(t.Logger, t, indexes[0], remote)
+	if err != nil {
+		t.releaseProxies(indexes)
+		return err
+	}
+	ctx, cancel := context.WithCancel(connCtx)
+	if !t.trackProxy(p, cancel) {
+		cancel()
+	}
+	go func() {
+		defer t.untrackProxy(p)
+		if err := p.Run(ctx); err != nil {
+			t.Infof("Proxy %s stopped: %s", remote, err)
+		}
+	}()
+	return nil
+}
+
+// RemoveRemote stops the proxy of the remote without touching the other proxies
+func (t *Tunnel) RemoveRemote(remote *settings.Remote) error {
+	t.proxiesMut.Lock()
+	id, bp := t.findProxy(remote)
+	if bp != nil {
+		delete(t.proxies, id)
+	}
+	t.proxiesMut.Unlock()
+	if bp == nil {
+		return errors.New("remote " + remote.String() + " is not bound")
+	}
+	//a proxy still binding is cancelled by trackProxy
+	if bp.cancel != nil {
+		bp.cancel()
+	}
+	return nil
+}
+
+// ActiveRemotes returns the remotes of the running proxies in the order they were bound,
+// the remotes whose proxy is still binding are not listed
+func (t *Tunnel) ActiveRemotes() []settings.Remote {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	ids := make([]int, 0, len(t.proxies))
+	for id, bp := range t.proxies {
+		if bp.proxy != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	remotes := make([]settings.Remote, 0, len(ids))
+	for _, id := range ids {
+		remotes = append(remotes, t.proxies[id].remote.Copy())
+	}
+	return remotes
+}
+
+// boundProxy is a proxy that can be cancelled individually, the proxy
+// and cancel are nil while its slot is reserved by a bind in progress
+type boundProxy struct {
+	remote *settings.Remote
+	proxy  *Proxy
+	cancel context.CancelFunc
+}
+
+// findProxy returns the proxy id and the bound proxy of the remote, the lock must be held
+func (t *Tunnel) findProxy(remote *settings.Remote) (int, *boundProxy) {
+	key := remote.String()
+	for id, bp := range t.proxies {
+		if bp.remote.String() == key {
+			return id, bp
+		}
+	}
+	return 0, nil
+}
+
+// reserveProxies reserves a slot for the proxy of each remote and returns
+// their indexes, it fails when the proxies would exceed MaxProxies.
+// The slots are counted as bound until released or replaced by trackProxy
+func (t *Tunnel) reserveProxies(remotes []*settings.Remote) ([]int, error) {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	return t.reserveLocked(remotes)
+}
+
+// reserveRemote is reserveProxies for a remote that is not already bound
+func (t *Tunnel) reserveRemote(remote *settings.Remote) ([]int, error) {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	if _, bp := t.findProxy(remote); bp != nil {
+		return nil, errors.New("remote " + remote.String() + " is already bound")
+	}
+	return t.reserveLocked([]*settings.Remote{remote})
+}
+
+func (t *Tunnel) reserveLocked(remotes []*settings.Remote) ([]int, error) {
+	bound := len(t.proxies)
+	if t.MaxProxies > 0 && bound+len(remotes) > t.MaxProxies {
+		return nil, fmt.Errorf("binding %d remotes would exceed the maximum of %d proxies (%d bound)", len(remotes), t.MaxProxies, bound)
+	}
+	if t.proxies == nil {
+		t.proxies = map[int]*boundProxy{}
+	}
+	indexes := make([]int, len(remotes))
+	for i, remote := range remotes {
+		indexes[i] = t.proxyCount
+		t.proxyCount++
+		//the proxies are tracked by their id, the index + 1
+		t.proxies[indexes[i]+1] = &boundProxy{remote: remote}
+	}
+	return indexes, nil
+}
+
+// releaseProxies frees the slots reserved for proxies that failed to bind
+func (t *Tunnel) releaseProxies(indexes []int) {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	for _, index := range indexes {
+		delete(t.proxies, index+1)
+	}
+}
+
+// trackProxy fills the slot reserved for the proxy, it returns false
+// when the remote was removed while binding
+func (t *Tunnel) trackProxy(p *Proxy, cancel context.CancelFunc) bool {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	bp, found := t.proxies[p.id]
+	if !found {
+		return false
+	}
+	bp.proxy = p
+	bp.cancel = cancel
+	return true
+}
+
+func (t *Tunnel) untrackProxy(p *Proxy) {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	if bp, found := t.proxies[p.id]; found && bp.proxy == p {
+		bp.cancel()
+		delete(t.proxies, p.id)
+	}
+}
+
+// DefaultKeepAliveJitter is the keepalive jitter used when none is configured
+const DefaultKeepAliveJitter = 0.1
+
+// keepAliveInterval returns the KeepAlive randomized within the jitter band
+func (t *Tunnel) keepAliveInterval() time.Duration {
+	jitter := t.Config.KeepAliveJitter
+	if jitter == 0 {
+		jitter = DefaultKeepAliveJitter
+	}
+	if jitter < 0 {
+		return t.Config.KeepAlive
+	}
+	delta := (rand.Float64()*2 - 1) * jitter * float64(t.Config.KeepAlive)
+	return t.Config.KeepAlive + time.Duration(delta)
+}
+
+// keepAliveLoop pings the connection until a ping fails
 func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
 	//ping forever
 	for {
-		time.Sleep(t.Config.KeepAlive)
+		time.Sleep(t.keepAliveInterval())
 		_, b, err := sshConn.SendRequest("ping", true, nil)
 		if err != nil {
 			break
@@ -215,8 +697,44 @@ func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
 			break
 		}
 	}
-	//close ssh connection on abnormal ping
-	sshConn.Close()
+}
+
+// Close stops the RADIUS proxy informer and session cleanup
+// and closes the active SSH connection, it is safe to call more than once
+func (t *Tunnel) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		atomic.StoreInt32(&t.closed, 1)
+		if t.radiusProxy != nil {
+			if err := t.radiusProxy.SaveSessions(); err != nil {
+				t.Infof("Cannot save the RADIUS sessions: %s", err)
+			}
+		}
+		if t.k8ControllerDrop != nil {
+			close(t.k8ControllerDrop)
+		}
+		t.activeConnMut.RLock()
+		c := t.activeConn
+		t.activeConnMut.RUnlock()
+		if c != nil {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+// RadiusProxyReady reports if the RADIUS proxy of the tunnel has a usable backend
+func (t *Tunnel) RadiusProxyReady() bool {
+	return t.radiusProxy != nil && t.radiusProxy.Ready()
+}
+
+// SetRadiusSecret rotates the shared secret of the RADIUS proxy, the previous
+// secret is still accepted during overlap (see radius_proxy.Proxy.SetSecret)
+func (t *Tunnel) SetRadiusSecret(secret string, overlap time.Duration) {
+	if t.radiusProxy == nil {
+		return
+	}
+	t.radiusProxy.SetSecret([]byte(secret), overlap)
 }
 
 func (t *Tunnel) IsActive() bool {
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/radius_proxy"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// HasNAS tells if the RADIUS requests of the NAS come through this tunnel
+func (t *Tunnel) HasNAS(ip net.IP) bool {
+	return t.radiusProxy != nil && t.radiusProxy.HasNAS(ip)
+}
+
+// ForwardCoA sends a CoA or Disconnect request to the CoA port of the NAS
+// from the other end of the tunnel and returns the reply of the NAS
+func (t *Tunnel) ForwardCoA(nasIP net.IP, payload []byte) ([]byte, error) {
+	ctx := t.connCtx()
+	if ctx == nil {
+		return nil, errors.New("no ssh connection")
+	}
+	deadline := settings.EnvDuration("UDP_DEADLINE", 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	sshConn := t.getSSH(ctx)
+	if sshConn == nil {
+		return nil, errors.New("no ssh connection")
+	}
+	hostPort := net.JoinHostPort(nasIP.String(), strconv.Itoa(radius_proxy.CoAPort))
+	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte(hostPort+"/udp"))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	defer rwc.Close()
+	uc := &udpChannel{
+		r: gob.NewDecoder(rwc),
+		w: gob.NewEncoder(rwc),
+		c: rwc,
+	}
+	go func() {
+		<-ctx.Done()
+		rwc.Close()
+	}()
+	if err := uc.encode("coa", payload); err != nil {
+		return nil, err
+	}
+	p := udpPacket{}
+	if err := uc.decode(&p); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return p.Payload, nil
+}
@@ -2,12 +2,14 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"sync/atomic"
 	"time"
 
 	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/cnet"
 	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -19,6 +21,9 @@ const LAST_TOUCHED_TIMEOUT = 10 * time.Second
 // sshTunnel exposes a subset of Tunnel to subtypes
 type sshTunnel interface {
 	getSSH(ctx context.Context) ssh.Conn
+	remoteStats(remote *settings.Remote) *remoteStats
+	conns() *cnet.ConnCount
+	maxProxyConns() int
 }
 
 // Proxy is the inbound portion of a Tunnel
@@ -26,27 +31,39 @@ type Proxy struct {
 	*cio.Logger
 	sshTun     sshTunnel
 	id         int
-	count      int
+	count      int64
 	remote     *settings.Remote
+	stats      *remoteStats
+	conns      *cnet.ConnCount
 	dialer     net.Dialer
 	tcp        *net.TCPListener
 	udp        *udpListener
 	aliveConns int64
+	//maximum of aliveConns, 0 when unlimited
+	maxConns int64
 }
 
 // NewProxy creates a Proxy
 func NewProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.Remote) (*Proxy, error) {
 	id := index + 1
 	p := &Proxy{
-		Logger: logger.Fork("proxy#%s", remote.String()),
+		Logger: logger.Fork("proxy#%s", remote.Label()),
 		sshTun: sshTun,
 		id:     id,
 		remote: remote,
+		stats:  sshTun.remoteStats(remote),
+		conns:  sshTun.conns(),
 	}
+	p.maxConns = int64(sshTun.maxProxyConns())
 	return p, p.listen()
 }
 
 func (p *Proxy) listen() error {
+	if p.remote.RemoteSocket != "" {
+		if err := settings.ValidateUnixSocket(p.remote.RemoteSocket); err != nil {
+			return p.Errorf("unix socket: %s", err)
+		}
+	}
 	if p.remote.Stdio {
 		//TODO check if pipes active?
 	} else if p.remote.LocalProto == "tcp" {
@@ -73,6 +90,16 @@ func (p *Proxy) listen() error {
 	return nil
 }
 
+// close releases the listener of a proxy that never ran
+func (p *Proxy) close() {
+	if p.tcp != nil {
+		p.tcp.Close()
+	}
+	if p.udp != nil {
+		p.udp.inbound.Close()
+	}
+}
+
 // Run enables the proxy and blocks while its active,
 // close the proxy by cancelling the context.
 func (p *Proxy) Run(ctx context.Context) error {
@@ -122,7 +149,7 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 				select {
 				case <-ctx.Done():
 					//listener closed
-					p.Infof("listener closed", err)
+					p.Infof("listener closed")
 					err = nil
 				default:
 					p.Infof("Accept error: %s", err)
@@ -138,6 +165,13 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 		case err := <-errChan:
 			return err
 		case src := <-srcChan:
+			//only this loop adds connections, they cannot exceed the maximum once checked
+			if p.maxConns > 0 && atomic.LoadInt64(&p.aliveConns) >= p.maxConns {
+				ProxyConnDropCount.Inc()
+				p.Debugf("Dropping connection from %s, %d connections are open", src.RemoteAddr(), p.maxConns)
+				src.Close()
+				continue
+			}
 			atomic.AddInt64(&p.aliveConns, 1)
 			go p.pipeRemote(ctx, src)
 		case <-time.After(INACTIVITY_CHECK_INTERVAL):
@@ -169,28 +203,69 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 	}
 }
 
+// endpoint returns the address the far side connects to for the connection
+func (p *Proxy) endpoint(src io.ReadWriteCloser) (string, error) {
+	if !p.remote.OriginalDst {
+		return p.remote.Remote(), nil
+	}
+	conn, ok := src.(net.Conn)
+	if !ok {
+		return "", errors.New("not a network connection")
+	}
+	return lookupOriginalDst(conn)
+}
+
+// clientAddr returns the address of the client of the connection, stdio has none
+func clientAddr(src io.ReadWriteCloser) string {
+	if conn, ok := src.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return "stdio"
+}
+
 func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
 	defer func() {
 		atomic.AddInt64(&p.aliveConns, -1)
 		src.Close()
 	}()
-	p.count++
-	cid := p.count
+	cid := atomic.AddInt64(&p.count, 1)
 	l := p.Fork("conn#%d", cid)
-	l.Debugf("Open")
+	endpoint, err := p.endpoint(src)
+	if err != nil {
+		l.Infof("Original destination error: %s", err)
+		return
+	}
+	l.Debugf("Open from %s to %s", clientAddr(src), endpoint)
+	p.conns.Opening()
 	sshConn := p.sshTun.getSSH(ctx)
 	if sshConn == nil {
+		p.conns.Abort()
 		l.Errorf("No remote connection")
 		return
 	}
 	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	ch, reqs, err := sshConn.OpenChannel("chisel", []byte(settings.ChannelData(endpoint, p.remote.Codec)))
 	if err != nil {
+		p.conns.Abort()
 		l.Infof("Stream error: %s", err)
 		return
 	}
+	p.conns.Opened()
 	go ssh.DiscardRequests(reqs)
-	//then pipe
-	s, r := cio.Pipe(src, dst)
+	dst := io.ReadWriteCloser(ch)
+	if p.remote.Codec == settings.FlateCodec {
+		dst = cnet.NewFlateRWC(ch)
+	}
+	//a stalled transfer must not outlive the proxy, the deadline aborts the copies once cancelled
+	stop := context.AfterFunc(ctx, func() {
+		if conn, ok := src.(interface{ SetDeadline(time.Time) error }); ok {
+			conn.SetDeadline(time.Now())
+		}
+		ch.Close()
+	})
+	defer stop()
+	//then pipe, the teardown starts once a side is done
+	s, r := cio.Pipe(p.stats.meter(onClose(src, p.conns.Closing)), dst)
+	p.conns.Closed()
 	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
 }
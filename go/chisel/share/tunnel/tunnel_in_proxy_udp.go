@@ -45,6 +45,7 @@ func listenUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*udpLi
 		Logger:  l,
 		sshTun:  sshTun,
 		remote:  remote,
+		stats:   sshTun.remoteStats(remote),
 		inbound: conn,
 	}
 	return u, nil
@@ -54,6 +55,7 @@ type udpListener struct {
 	*cio.Logger
 	sshTun      sshTunnel
 	remote      *settings.Remote
+	stats       *remoteStats
 	inbound     *net.UDPConn
 	outboundMut sync.Mutex
 	outbound    *udpChannel
@@ -123,6 +125,7 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 		}
 		//stats
 		atomic.AddInt64(&u.sent, int64(n))
+		u.stats.addIn(n)
 	}
 	return nil
 }
@@ -157,6 +160,7 @@ func (u *udpListener) runOutbound(ctx context.Context) error {
 		}
 		//stats
 		atomic.AddInt64(&u.recv, int64(n))
+		u.stats.addOut(n)
 	}
 	return nil
 }
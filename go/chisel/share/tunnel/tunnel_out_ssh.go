@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
 	"github.com/inverse-inc/packetfence/go/chisel/share/cnet"
@@ -18,6 +19,11 @@ func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request) {
 		switch r.Type {
 		case "ping":
 			r.Reply(true, []byte("pong"))
+		case versionRequest:
+			version := string(r.Payload)
+			t.setPeerVersion(version)
+			t.Debugf("Peer version %q", version)
+			r.Reply(true, nil)
 		default:
 			t.Debugf("Unknown request: %s", r.Type)
 		}
@@ -36,24 +42,49 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 		ch.Reject(ssh.Prohibited, "Denied outbound connection")
 		return
 	}
-	remote := string(ch.ExtraData())
+	remote, codec := settings.ParseChannelData(string(ch.ExtraData()))
+	if codec != "" && codec != settings.FlateCodec {
+		t.Debugf("Denied unsupported codec %q", codec)
+		ch.Reject(ssh.Prohibited, "Unsupported codec "+codec)
+		return
+	}
+	socket := ""
+	if strings.HasPrefix(remote, settings.UnixPrefix) {
+		socket = strings.TrimPrefix(remote, settings.UnixPrefix)
+		if err := settings.ValidateUnixSocket(socket); err != nil {
+			t.Debugf("Denied unix socket %q: %s", socket, err)
+			ch.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+	}
 	//extract protocol
 	hostPort, proto, handler := settings.L4Proto(remote)
-	udp := proto == "udp"
+	udp := proto == "udp" && socket == ""
 	socks := hostPort == "socks"
 	if socks && t.socksServer == nil {
 		t.Debugf("Denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
 		return
 	}
+	if udp && codec != "" {
+		t.Debugf("Denied compressed UDP stream")
+		ch.Reject(ssh.Prohibited, "Compression is only supported for TCP")
+		return
+	}
 	sshChan, reqs, err := ch.Accept()
 	if err != nil {
 		t.Debugf("Failed to accept stream: %s", err)
 		return
 	}
 	stream := io.ReadWriteCloser(sshChan)
+	if codec == settings.FlateCodec {
+		stream = cnet.NewFlateRWC(sshChan)
+	}
 	//cnet.MeterRWC(t.Logger.Fork("sshchan"), sshChan)
-	defer stream.Close()
+	defer func() {
+		stream.Close()
+		t.connStats.Closed()
+	}()
 	go ssh.DiscardRequests(reqs)
 	l := t.Logger.Fork("conn#%d", t.connStats.New())
 	//ready to handle
@@ -61,12 +92,14 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	l.Debugf("Open %s", t.connStats.String())
 	if socks {
 		err = t.handleSocks(stream)
+	} else if socket != "" {
+		err = t.handleUnix(l, stream, socket)
 	} else if udp {
 		err = t.handleUDP(l, stream, hostPort, handler)
 	} else {
 		err = t.handleTCP(l, stream, hostPort)
 	}
-	t.connStats.Close()
+	t.connStats.Closing()
 	errmsg := ""
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		errmsg = fmt.Sprintf(" (error %s)", err)
@@ -75,30 +108,40 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 }
 
 func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
+	if t.Config.SocksIdleTimeout > 0 {
+		src = cnet.NewIdleRWC(src, t.Config.SocksIdleTimeout)
+	}
 	return t.socksServer.ServeConn(cnet.NewRWCConn(src))
 }
 
 func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string) error {
-	laddrIP := ""
-	if t.Config.SrcIP != nil {
-		laddrIP = t.Config.SrcIP.String()
-	}
-	laddr, err := net.ResolveTCPAddr("tcp", laddrIP+":")
+	conn, err := t.dialEndpoint("tcp", hostPort)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	raddr, err := net.ResolveTCPAddr("tcp", hostPort)
+	t.pipeEndpoint(l, src, conn)
+	return nil
+}
+
+func (t *Tunnel) handleUnix(l *cio.Logger, src io.ReadWriteCloser, socket string) error {
+	conn, err := net.Dial("unix", socket)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	dst, err := net.DialTCP("tcp", laddr, raddr)
-	fmt.Println(err)
-	if err != nil {
-		return err
+	t.pipeEndpoint(l, src, conn)
+	return nil
+}
+
+// pipeEndpoint copies between the SSH stream and the endpoint connection until one of them closes
+func (t *Tunnel) pipeEndpoint(l *cio.Logger, src io.ReadWriteCloser, conn net.Conn) {
+	if t.Config.EndpointDeadline > 0 {
+		//reads and writes fail past the deadline, which ends the pipe
+		conn.SetDeadline(time.Now().Add(t.Config.EndpointDeadline))
+	}
+	dst := io.ReadWriteCloser(conn)
+	if t.Config.EndpointIdleTimeout > 0 {
+		dst = cnet.NewIdleRWC(dst, t.Config.EndpointIdleTimeout)
 	}
 	s, r := cio.Pipe(src, dst)
 	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
-	return nil
 }
@@ -0,0 +1,278 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// loopbackSSH binds the inbound tunnel to the outbound one over an SSH connection on the loopback
+func loopbackSSH(ctx context.Context, t *testing.T, inbound, outbound *Tunnel) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Cannot create signer: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	clientConfig := &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         2 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			c.Close()
+		}()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		kex := NewKexRecorder(c, false)
+		conn, chans, reqs, err := ssh.NewServerConn(kex, serverConfig)
+		if err != nil {
+			return
+		}
+		c.SetDeadline(time.Time{})
+		outbound.BindSSH(ctx, WithSSHInfo(conn, kex.SSHInfo()), reqs, chans)
+	}()
+	c, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	kex := NewKexRecorder(c, true)
+	conn, chans, reqs, err := ssh.NewClientConn(kex, l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("Cannot connect over SSH: %s", err)
+	}
+	c.SetDeadline(time.Time{})
+	go inbound.BindSSH(ctx, WithSSHInfo(conn, kex.SSHInfo()), reqs, chans)
+}
+
+func TestUnixSocketEndpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Cannot listen on the unix socket: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	inbound := testTunnel(ctx)
+	inbound.activatingConn.Add(1)
+	outbound := &Tunnel{Config: Config{Logger: cio.NewLogger("test"), Outbound: true}}
+	loopbackSSH(ctx, t, inbound, outbound)
+
+	port := testRemote(t).LocalPort
+	remote, err := settings.DecodeRemote("127.0.0.1:" + port + ":unix:" + socket)
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	if remote.Remote() != "unix:"+socket {
+		t.Errorf("Unexpected endpoint %s", remote.Remote())
+	}
+	if err := inbound.AddRemote(remote); err != nil {
+		t.Fatalf("Cannot add remote: %s", err)
+	}
+	if !waitListening(remote.Local(), true) {
+		t.Fatalf("Remote is not listening")
+	}
+
+	//concurrent connections share the proxy, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.Dial("tcp", remote.Local())
+			if err != nil {
+				t.Errorf("Cannot connect to the proxy: %s", err)
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(2 * time.Second))
+			ping := "ping" + strconv.Itoa(i)
+			if _, err := c.Write([]byte(ping)); err != nil {
+				t.Errorf("Cannot write: %s", err)
+				return
+			}
+			reply := make([]byte, len(ping))
+			if _, err := io.ReadFull(c, reply); err != nil || string(reply) != ping {
+				t.Errorf("Expected the echo of the unix socket, got %q (%v)", reply, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, invalid := range []string{port + ":unix:app.sock", port + ":unix:/" + strings.Repeat("a", 200), "unix:" + socket, "socks:unix:" + socket} {
+		if _, err := settings.DecodeRemote(invalid); err == nil {
+			t.Errorf("Expected an error decoding %q", invalid)
+		}
+	}
+}
+
+// endpointDialer records the dialed addresses and connects them all to the endpoint
+type endpointDialer struct {
+	endpoint string
+	dialed   chan string
+}
+
+func (d *endpointDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed <- network + " " + address
+	return net.Dial("tcp", d.endpoint)
+}
+
+func TestSocksRemoteResolve(t *testing.T) {
+	endpoint, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer endpoint.Close()
+	dialer := &endpointDialer{endpoint: endpoint.Addr().String(), dialed: make(chan string, 1)}
+	tun := &Tunnel{Config: Config{
+		Logger:             cio.NewLogger("test"),
+		Socks:              true,
+		SocksRemoteResolve: true,
+		Dialer:             dialer,
+	}}
+	if tun.socksServer, err = tun.newSocksServer(); err != nil {
+		t.Fatalf("Cannot create the SOCKS server: %s", err)
+	}
+
+	src, peer := net.Pipe()
+	defer peer.Close()
+	go tun.handleSocks(src)
+	//no authentication, then CONNECT intranet.example:80
+	host := "intranet.example"
+	request := append([]byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}, host...)
+	request = append(request, 0, 80)
+	go peer.Write(request)
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(peer, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("Unexpected authentication reply %v %v", reply, err)
+	}
+
+	select {
+	case dialed := <-dialer.dialed:
+		if dialed != "tcp intranet.example:80" {
+			t.Errorf("Expected the hostname to be forwarded unresolved, got %s", dialed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the SOCKS request to be dialed")
+	}
+	//the connect reply holds the local address of the endpoint connection
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(peer, reply); err != nil || reply[1] != 0 {
+		t.Errorf("Unexpected connect reply %v %v", reply, err)
+	}
+}
+
+func TestCompressedRemote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	inbound := testTunnel(ctx)
+	inbound.activatingConn.Add(1)
+	outbound := &Tunnel{Config: Config{Logger: cio.NewLogger("test"), Outbound: true}}
+	loopbackSSH(ctx, t, inbound, outbound)
+
+	port := testRemote(t).LocalPort
+	remote, err := settings.DecodeRemote("127.0.0.1:" + port + ":" + l.Addr().String() + "+flate")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	if remote.Codec != settings.FlateCodec || !strings.HasSuffix(remote.Encode(), "+flate") {
+		t.Errorf("Expected the flate codec, got %q encoded as %s", remote.Codec, remote.Encode())
+	}
+	if err := inbound.AddRemote(remote); err != nil {
+		t.Fatalf("Cannot add remote: %s", err)
+	}
+	if !waitListening(remote.Local(), true) {
+		t.Fatalf("Remote is not listening")
+	}
+
+	c, err := net.Dial("tcp", remote.Local())
+	if err != nil {
+		t.Fatalf("Cannot connect to the proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 256*1024)
+	rand.Read(data[:len(data)/2])
+	copy(data[len(data)/2:], strings.Repeat("compressible ", len(data)/2))
+	go c.Write(data)
+	reply := make([]byte, len(data))
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("Cannot read the echo: %s", err)
+	}
+	if string(reply) != string(data) {
+		t.Errorf("The data was altered through the compressed channel")
+	}
+
+	// the far side must agree on the codec
+	sshConn := inbound.getSSH(ctx)
+	if _, _, err := sshConn.OpenChannel("chisel", []byte(settings.ChannelData(l.Addr().String(), "snappy"))); err == nil {
+		t.Errorf("Expected an unsupported codec to be rejected")
+	}
+
+	for _, invalid := range []string{port + ":1.1.1.1:53/udp+flate", "stdio:example.com:22+flate"} {
+		if _, err := settings.DecodeRemote(invalid); err == nil {
+			t.Errorf("Expected an error decoding %q", invalid)
+		}
+	}
+}
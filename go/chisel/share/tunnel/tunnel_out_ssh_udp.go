@@ -2,7 +2,7 @@ package tunnel
 
 import (
 	"encoding/gob"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -21,7 +21,7 @@ func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort strin
 	conns := &udpConns{
 		Logger: l,
 		m:      map[string]*udpConn{},
-		srcIP:  t.Config.SrcIP,
+		dialer: t.dialEndpoint,
 	}
 	defer conns.closeAll()
 	h := &udpHandler{
@@ -72,10 +72,32 @@ func (h *udpHandler) handleWrite(p *udpPacket) error {
 	case "radius":
 		if h.radiusProxy != nil {
 			h.Debugf("Proxying RADIUS")
+			if reply, local, err := h.radiusProxy.LocalReply(packet); local {
+				if err != nil {
+					h.Debugf("Dropping RADIUS packet from %s: %s", p.Src, err)
+				} else if reply == nil {
+					h.Debugf("Not answering the Status-Server of %s, no RADIUS backend is ready", p.Src)
+				} else if err := h.udpChannel.encode(p.Src, reply); err != nil {
+					h.Debugf("encode error %s: %s", p.Src, err)
+				}
+				return nil
+			}
 			packet, hostPort, err = h.radiusProxy.ProxyPacket(packet, h.connectorID)
+			if errors.Is(err, radius_proxy.ErrPacketTooLarge) {
+				h.Infof("Dropping RADIUS packet of %d bytes from %s", len(p.Payload), p.Src)
+				return nil
+			}
+			if errors.Is(err, radius_proxy.ErrRateLimited) {
+				h.Debugf("Dropping RADIUS packet from %s, its NAS exceeded its rate", p.Src)
+				return nil
+			}
 			if err != nil {
 				return err
 			}
+			if h.radiusProxy.RadSec() {
+				go h.exchange(p.Src, packet, hostPort)
+				return nil
+			}
 		} else {
 			h.Infof("Radius Proxy not config properly")
 			h.Debugf("Proxying raw UDP")
@@ -112,13 +134,39 @@ func (h *udpHandler) handleWrite(p *udpPacket) error {
 	return nil
 }
 
+// exchange sends the RADIUS packet to the backend over RadSec and its response back over ssh
+func (h *udpHandler) exchange(src string, packet []byte, hostPort string) {
+	reply, err := h.radiusProxy.Exchange(packet, hostPort)
+	if err != nil {
+		h.Infof("Cannot exchange the RADIUS packet of %s with %s: %s", src, hostPort, err)
+		return
+	}
+	if reply, err = h.radiusProxy.ProxyReply(reply, hostPort); err != nil {
+		h.Infof("Dropping the RADIUS reply of %s to %s: %s", hostPort, src, err)
+		return
+	}
+	if err := h.udpChannel.encode(src, reply); err != nil {
+		h.Debugf("encode error %s: %s", src, err)
+	}
+}
+
 func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
 	//ensure connection is cleaned up
 	defer h.udpConns.remove(conn.id)
 	const maxMTU = 9012
-	buff := make([]byte, maxMTU)
+	maxSize := maxMTU
+	radius := h.handler == "radius" && h.radiusProxy != nil
+	if radius {
+		maxSize = h.radiusProxy.MaxPacketSize()
+	}
+	replied := false
+	//one more byte to detect the responses exceeding the maximum size
+	buff := make([]byte, maxSize+1)
 	//response must arrive within 5 seconds
 	deadline := settings.EnvDuration("UDP_DEADLINE", 5*time.Second)
+	if radius && h.radiusProxy.RequestTimeout() > 0 {
+		deadline = h.radiusProxy.RequestTimeout()
+	}
 	h.Debugf("Reading host port: '%s', UDP conn: '%s'", h.hostPort, conn.id)
 	for {
 		conn.SetReadDeadline(time.Now().Add(deadline))
@@ -130,9 +178,27 @@ func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
 			} else {
 				h.Debugf("closing connection %s", conn)
 			}
+			//the backend never answered, count it for its breaker
+			if radius && !replied && os.IsTimeout(err) {
+				h.radiusProxy.ReportResult(conn.RemoteAddr().String(), radius_proxy.ErrNoReply)
+			}
 			break
 		}
+		if n > maxSize {
+			h.Infof("Dropping response of more than %d bytes from %s", maxSize, conn.RemoteAddr())
+			continue
+		}
+		if radius && !replied {
+			replied = true
+			h.radiusProxy.ReportResult(conn.RemoteAddr().String(), nil)
+		}
 		b := buff[:n]
+		if radius {
+			if b, err = h.radiusProxy.ProxyReply(b, conn.RemoteAddr().String()); err != nil {
+				h.Infof("Dropping the RADIUS reply of %s to %s: %s", conn.RemoteAddr(), p.Src, err)
+				continue
+			}
+		}
 		//encode back over ssh connection
 		err = h.udpChannel.encode(p.Src, b)
 		if err != nil {
@@ -149,8 +215,8 @@ func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
 type udpConns struct {
 	*cio.Logger
 	sync.Mutex
-	srcIP net.IP
-	m     map[string]*udpConn
+	dialer func(network, hostPort string) (net.Conn, error)
+	m      map[string]*udpConn
 }
 
 func (cs *udpConns) dial(id, addr string) (*udpConn, bool, error) {
@@ -158,22 +224,7 @@ func (cs *udpConns) dial(id, addr string) (*udpConn, bool, error) {
 	defer cs.Unlock()
 	conn, ok := cs.m[id]
 	if !ok {
-		laddrIP := ""
-		if cs.srcIP != nil {
-			laddrIP = cs.srcIP.String()
-		}
-		laddr, err := net.ResolveUDPAddr("udp", laddrIP+":")
-		if err != nil {
-			fmt.Println(err)
-			return nil, false, err
-		}
-		raddr, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			fmt.Println(err)
-			return nil, false, err
-		}
-
-		c, err := net.DialUDP("udp", laddr, raddr)
+		c, err := cs.dialer("udp", addr)
 		if err != nil {
 			return nil, false, err
 		}
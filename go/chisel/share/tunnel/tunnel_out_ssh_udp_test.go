@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/radius_proxy"
+)
+
+func testRadiusHandler(out io.Writer, in io.Reader, replies io.Writer) *udpHandler {
+	l := cio.NewLogger("test")
+	l.Info = true
+	l.SetOutput(out)
+	return &udpHandler{
+		Logger:   l,
+		hostPort: "127.0.0.1:1812",
+		handler:  "radius",
+		udpChannel: &udpChannel{
+			r: gob.NewDecoder(in),
+			w: gob.NewEncoder(replies),
+		},
+		radiusProxy: radius_proxy.NewProxy(&radius_proxy.ProxyConfig{
+			Addrs:          []string{"127.0.0.1:1812"},
+			Secret:         []byte("secret"),
+			SessionTimeout: time.Minute,
+			Logger:         l,
+		}),
+		udpConns: &udpConns{
+			Logger: l,
+			m:      map[string]*udpConn{},
+			dialer: net.Dial,
+		},
+	}
+}
+
+func TestRadiusPacketTooLarge(t *testing.T) {
+	var out syncBuffer
+	var in bytes.Buffer
+	oversized := make([]byte, radius_proxy.DefaultMaxPacketSize+1)
+	if err := gob.NewEncoder(&in).Encode(udpPacket{Src: "192.0.2.1:1234", Payload: oversized}); err != nil {
+		t.Fatalf("Cannot encode packet: %s", err)
+	}
+	h := testRadiusHandler(&out, &in, io.Discard)
+
+	if err := h.handleWrite(&udpPacket{}); err != nil {
+		t.Fatalf("Expected the packet to be dropped without error, got %s", err)
+	}
+	if n := h.udpConns.len(); n != 0 {
+		t.Errorf("Expected no connection to the backend, got %d", n)
+	}
+	if !strings.Contains(out.String(), "Dropping RADIUS packet") {
+		t.Errorf("Expected the dropped packet to be logged, got %q", out.String())
+	}
+}
+
+func TestRadiusResponseTooLarge(t *testing.T) {
+	t.Setenv("CHISEL_UDP_DEADLINE", "200ms")
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer backend.Close()
+	go func() {
+		buff := make([]byte, 16)
+		_, addr, err := backend.ReadFrom(buff)
+		if err != nil {
+			return
+		}
+		backend.WriteTo(make([]byte, radius_proxy.DefaultMaxPacketSize+1), addr)
+		backend.WriteTo(make([]byte, 20), addr)
+	}()
+
+	var out, replies syncBuffer
+	h := testRadiusHandler(&out, &bytes.Buffer{}, &replies)
+	h.hostPort = backend.LocalAddr().String()
+	conn, _, err := h.udpConns.dial("192.0.2.1:1234", h.hostPort)
+	if err != nil {
+		t.Fatalf("Cannot dial the backend: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatalf("Cannot write to the backend: %s", err)
+	}
+	h.handleRead(&udpPacket{Src: "192.0.2.1:1234"}, conn)
+
+	dec := gob.NewDecoder(strings.NewReader(replies.String()))
+	var sizes []int
+	for {
+		p := udpPacket{}
+		if err := dec.Decode(&p); err != nil {
+			break
+		}
+		sizes = append(sizes, len(p.Payload))
+	}
+	if len(sizes) != 1 || sizes[0] != 20 {
+		t.Errorf("Expected only the response of 20 bytes, got responses of %v bytes", sizes)
+	}
+	if !strings.Contains(out.String(), "Dropping response") {
+		t.Errorf("Expected the dropped response to be logged, got %q", out.String())
+	}
+}
@@ -0,0 +1,755 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/chisel/share/cio"
+	"github.com/inverse-inc/packetfence/go/chisel/share/radius_proxy"
+	"github.com/inverse-inc/packetfence/go/chisel/share/settings"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func testTunnel(ctx context.Context) *Tunnel {
+	return &Tunnel{
+		Config: Config{
+			Logger:  cio.NewLogger("test"),
+			Inbound: true,
+		},
+		connectionCtx: ctx,
+	}
+}
+
+func testRemote(t *testing.T) *settings.Remote {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot find a free port: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	remote, err := settings.DecodeRemote("127.0.0.1:" + strconv.Itoa(port) + ":localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	return remote
+}
+
+func waitListening(addr string, listening bool) bool {
+	for i := 0; i < 50; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		if (err == nil) == listening {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestAddRemoveRemote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	first := testRemote(t)
+	second := testRemote(t)
+
+	for _, remote := range []*settings.Remote{first, second} {
+		if err := tun.AddRemote(remote); err != nil {
+			t.Fatalf("Cannot add remote %s: %s", remote, err)
+		}
+	}
+	if err := tun.AddRemote(first); err == nil {
+		t.Errorf("Expected an error when adding a remote twice")
+	}
+	if !waitListening(first.Local(), true) || !waitListening(second.Local(), true) {
+		t.Fatalf("Remotes are not listening")
+	}
+
+	if err := tun.RemoveRemote(first); err != nil {
+		t.Fatalf("Cannot remove remote: %s", err)
+	}
+	if !waitListening(first.Local(), false) {
+		t.Errorf("Removed remote is still listening")
+	}
+	if !waitListening(second.Local(), true) {
+		t.Errorf("Other remote stopped listening")
+	}
+	if err := tun.RemoveRemote(first); err == nil {
+		t.Errorf("Expected an error when removing an unbound remote")
+	}
+}
+
+func TestActiveRemotes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	remotes := []*settings.Remote{testRemote(t), testRemote(t)}
+
+	bindCtx, unbind := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- tun.BindRemotes(bindCtx, remotes)
+	}()
+	for _, remote := range remotes {
+		if !waitListening(remote.Local(), true) {
+			t.Fatalf("Remote %s is not listening", remote)
+		}
+	}
+	active := tun.ActiveRemotes()
+	if len(active) != 2 || active[0].String() != remotes[0].String() || active[1].String() != remotes[1].String() {
+		t.Errorf("Expected the active remotes %v, got %v", remotes, active)
+	}
+
+	unbind()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("BindRemotes did not return")
+	}
+	if active := tun.ActiveRemotes(); len(active) != 0 {
+		t.Errorf("Expected no active remotes after unbind, got %v", active)
+	}
+}
+
+func TestKeepAliveInterval(t *testing.T) {
+	tun := &Tunnel{Config: Config{KeepAlive: 10 * time.Second, KeepAliveJitter: 0.2}}
+	min, max := 8*time.Second, 12*time.Second
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		interval := tun.keepAliveInterval()
+		if interval < min || interval > max {
+			t.Fatalf("Interval %s is outside [%s, %s]", interval, min, max)
+		}
+		seen[interval] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Intervals do not vary")
+	}
+
+	tun.Config.KeepAliveJitter = -1
+	if interval := tun.keepAliveInterval(); interval != tun.Config.KeepAlive {
+		t.Errorf("Expected no jitter, got %s", interval)
+	}
+}
+
+func TestResolveHostPort(t *testing.T) {
+	lookups := 0
+	records := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	tun := &Tunnel{Config: Config{
+		ResolveEndpoints: true,
+		Resolver: func(ctx context.Context, host string) ([]net.IP, error) {
+			lookups++
+			return records, nil
+		},
+	}}
+
+	tests := []struct {
+		family   string
+		expected string
+	}{
+		{family: "", expected: "[2001:db8::1]:1812 192.0.2.1:1812"},
+		{family: FamilyIPv4, expected: "192.0.2.1:1812 [2001:db8::1]:1812"},
+		{family: FamilyIPv6, expected: "[2001:db8::1]:1812 192.0.2.1:1812"},
+	}
+	for _, test := range tests {
+		tun.Config.PreferFamily = test.family
+		addrs, err := tun.resolveHostPort("udp", "radius.example:1812")
+		if err != nil {
+			t.Fatalf("Cannot resolve: %s", err)
+		}
+		if hostPorts := strings.Join(addrs, " "); hostPorts != test.expected {
+			t.Errorf("Expected %s with family %q, got %s", test.expected, test.family, hostPorts)
+		}
+	}
+	if lookups != len(tests) {
+		t.Errorf("Expected a lookup per connection, got %d lookups", lookups)
+	}
+
+	// The endpoint follows DNS changes
+	records = []net.IP{net.ParseIP("192.0.2.2")}
+	if addrs, _ := tun.resolveHostPort("udp", "radius.example:1812"); len(addrs) != 1 || addrs[0] != "192.0.2.2:1812" {
+		t.Errorf("Expected the new record, got %v", addrs)
+	}
+
+	if addrs, _ := tun.resolveHostPort("udp", "192.0.2.3:1812"); len(addrs) != 1 || addrs[0] != "192.0.2.3:1812" || lookups != len(tests)+1 {
+		t.Errorf("IP endpoints should not be resolved, got %v", addrs)
+	}
+
+	tun.Config.PreferFamily = "ipv5"
+	if _, err := tun.resolveHostPort("udp", "radius.example:1812"); err == nil {
+		t.Errorf("Expected an error for an unknown address family")
+	}
+
+	// Without ResolveEndpoints the system resolves the endpoint once
+	tun.Config.PreferFamily = ""
+	tun.Config.ResolveEndpoints = false
+	if addrs, err := tun.resolveHostPort("tcp", "localhost:1812"); err != nil || len(addrs) != 1 || lookups != len(tests)+1 {
+		t.Errorf("Expected a single system resolution, got %v (%v) after %d lookups", addrs, err, lookups)
+	}
+}
+
+func TestClose(t *testing.T) {
+	tun := testTunnel(context.Background())
+	sessionsFile := filepath.Join(t.TempDir(), "sessions.json")
+	tun.radiusProxy = radius_proxy.NewProxy(&radius_proxy.ProxyConfig{
+		Addrs:          []string{"127.0.0.1:1812"},
+		Secret:         []byte("secret"),
+		SessionTimeout: time.Minute,
+		Logger:         tun.Logger,
+		SessionsFile:   sessionsFile,
+	})
+	tun.k8ControllerDrop = make(chan struct{})
+	conn := newFakeSSHConn(false)
+	tun.activeConn = conn
+
+	done := make(chan struct{})
+	go func() {
+		tun.radiusProxy.Cleanup(tun.k8ControllerDrop)
+		close(done)
+	}()
+
+	tun.Close()
+	tun.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the RADIUS proxy cleanup to stop")
+	}
+
+	select {
+	case <-conn.closed:
+	default:
+		t.Errorf("Expected the SSH connection to be closed")
+	}
+
+	if _, err := os.Stat(sessionsFile); err != nil {
+		t.Errorf("Expected the RADIUS sessions to be saved: %s", err)
+	}
+}
+
+func TestBindRemotesMaxProxies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.MaxProxies = 2
+	if err := tun.AddRemote(testRemote(t)); err != nil {
+		t.Fatalf("Cannot add remote: %s", err)
+	}
+
+	remotes := []*settings.Remote{testRemote(t), testRemote(t)}
+	if err := tun.BindRemotes(ctx, remotes); err == nil {
+		t.Fatalf("Expected an error when exceeding the maximum proxies")
+	}
+	for _, remote := range remotes {
+		if !waitListening(remote.Local(), false) {
+			t.Errorf("Rejected remote %s is listening", remote)
+		}
+	}
+	if err := tun.AddRemote(testRemote(t)); err != nil {
+		t.Errorf("Cannot add remote up to the maximum: %s", err)
+	}
+	if err := tun.AddRemote(testRemote(t)); err == nil {
+		t.Errorf("Expected an error when exceeding the maximum proxies")
+	}
+}
+
+func TestBindRemotesPartialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	first := testRemote(t)
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer busy.Close()
+	second, err := settings.DecodeRemote(busy.Addr().String() + ":localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+
+	if err := tun.BindRemotes(ctx, []*settings.Remote{first, second}); err == nil {
+		t.Fatalf("Expected an error when a remote cannot listen")
+	}
+	if !waitListening(first.Local(), false) {
+		t.Errorf("Remote %s is still listening after the failure", first)
+	}
+}
+
+func TestAddRemoteConcurrentMaxProxies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.MaxProxies = 2
+	remotes := make([]*settings.Remote, 6)
+	for i := range remotes {
+		remotes[i] = testRemote(t)
+	}
+
+	var wg sync.WaitGroup
+	var added int32
+	for _, remote := range remotes {
+		wg.Add(1)
+		go func(remote *settings.Remote) {
+			defer wg.Done()
+			if tun.AddRemote(remote) == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}(remote)
+	}
+	wg.Wait()
+	if added != 2 {
+		t.Errorf("Expected 2 remotes added up to the maximum, got %d", added)
+	}
+	listening := 0
+	for _, remote := range remotes {
+		if waitListening(remote.Local(), true) {
+			listening++
+		}
+	}
+	if listening != 2 {
+		t.Errorf("Expected 2 remotes listening, got %d", listening)
+	}
+}
+
+func TestAddRemoteConcurrentDuplicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	remote := testRemote(t)
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tun.AddRemote(remote) == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Errorf("Expected the remote to be added once, got %d", added)
+	}
+}
+
+func TestAddRemoteDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tun := testTunnel(ctx)
+	cancel()
+	remote := testRemote(t)
+	if err := tun.AddRemote(remote); err == nil {
+		t.Errorf("Expected an error when the SSH connection is gone")
+	}
+	if !waitListening(remote.Local(), false) {
+		t.Errorf("Remote %s is listening without a connection", remote)
+	}
+	tun.connectionCtx = nil
+	if err := tun.AddRemote(testRemote(t)); err == nil {
+		t.Errorf("Expected an error without an SSH connection")
+	}
+}
+
+func TestBindRemotesFailureReleasesSlots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.MaxProxies = 2
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer busy.Close()
+	taken, err := settings.DecodeRemote(busy.Addr().String() + ":localhost:80")
+	if err != nil {
+		t.Fatalf("Cannot decode remote: %s", err)
+	}
+	if err := tun.BindRemotes(ctx, []*settings.Remote{testRemote(t), taken}); err == nil {
+		t.Fatalf("Expected an error when a remote cannot listen")
+	}
+	for i := 0; i < 2; i++ {
+		if err := tun.AddRemote(testRemote(t)); err != nil {
+			t.Errorf("Cannot add remote after a failed bind: %s", err)
+		}
+	}
+}
+
+// slowBackend accepts connections and writes a byte every interval, never closing them
+func slowBackend(t *testing.T, interval time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					if interval > 0 {
+						if _, err := c.Write([]byte{1}); err != nil {
+							return
+						}
+					}
+					time.Sleep(interval + 10*time.Millisecond)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		config   Config
+	}{
+		// a silent backend is idle
+		{name: "idle", config: Config{EndpointIdleTimeout: 100 * time.Millisecond}},
+		// a trickling backend is never idle but is still cut at the deadline
+		{name: "deadline", interval: 20 * time.Millisecond, config: Config{EndpointIdleTimeout: time.Second, EndpointDeadline: 200 * time.Millisecond}},
+	}
+	for _, test := range tests {
+		tun := &Tunnel{Config: test.config}
+		addr := slowBackend(t, test.interval)
+		src, peer := net.Pipe()
+		defer peer.Close()
+		go io.Copy(io.Discard, peer)
+
+		start := time.Now()
+		done := make(chan struct{})
+		go func() {
+			tun.handleTCP(cio.NewLogger("test"), src, addr)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the %s copy to abort", test.name)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("Expected the %s copy to abort at the timeout, aborted after %s", test.name, elapsed)
+		}
+	}
+}
+
+func TestBindRemotesWithTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	//no SSH connection is ever bound
+	tun.activatingConn.Add(1)
+	remote := testRemote(t)
+
+	start := time.Now()
+	err := tun.BindRemotesWithTimeout(ctx, []*settings.Remote{remote}, 50*time.Millisecond)
+	if !errors.Is(err, ErrSSHNotConnected) {
+		t.Fatalf("Expected a not connected error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the error at the timeout, got it after %s", elapsed)
+	}
+	if !waitListening(remote.Local(), false) {
+		t.Errorf("Remote %s is listening without an SSH connection", remote)
+	}
+}
+
+func TestWaitActive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := testTunnel(ctx)
+	idle.activatingConn.Add(1)
+	timeout, cancelTimeout := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelTimeout()
+	if err := idle.WaitActive(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context error without an SSH connection, got %v", err)
+	}
+
+	tun := testTunnel(ctx)
+	tun.activatingConn.Add(1)
+	errs := make(chan error)
+	go func() {
+		errs <- tun.WaitActive(ctx)
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected WaitActive to block before BindSSH, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	go bindFakeSSH(ctx, tun, newFakeSSHConn(false))
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected WaitActive to return once BindSSH runs")
+	}
+	if !tun.IsActive() {
+		t.Errorf("Expected the tunnel to be active")
+	}
+}
+
+func TestBindRemotesConnectionLost(t *testing.T) {
+	for _, closeTunnel := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		tun := testTunnel(ctx)
+		tun.activatingConn.Add(1)
+		conn := newFakeSSHConn(false)
+		remote := testRemote(t)
+
+		//stop the proxies once the SSH connection is gone, like the server does
+		go func() {
+			bindFakeSSH(ctx, tun, conn)
+			cancel()
+		}()
+		errs := make(chan error)
+		go func() {
+			errs <- tun.BindRemotes(ctx, []*settings.Remote{remote})
+		}()
+		if !waitListening(remote.Local(), true) {
+			t.Fatalf("Remote is not listening")
+		}
+
+		if closeTunnel {
+			tun.Close()
+		} else {
+			conn.Close()
+		}
+		var err error
+		select {
+		case err = <-errs:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected BindRemotes to return")
+		}
+		var lost *ErrConnectionLost
+		if closeTunnel && errors.As(err, &lost) {
+			t.Errorf("Expected no connection lost error when closing the tunnel, got %v", err)
+		} else if !closeTunnel && !errors.As(err, &lost) {
+			t.Errorf("Expected a connection lost error, got %v", err)
+		}
+		cancel()
+	}
+}
+
+func TestNamedRemote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out syncBuffer
+	tun := testTunnel(ctx)
+	tun.Logger.Info = true
+	tun.Logger.SetOutput(&out)
+	named := testRemote(t)
+	named.Name = "web"
+	unnamed := testRemote(t)
+
+	for _, remote := range []*settings.Remote{named, unnamed} {
+		if err := tun.AddRemote(remote); err != nil {
+			t.Fatalf("Cannot add remote %s: %s", remote, err)
+		}
+	}
+	if !waitListening(named.Local(), true) || !waitListening(unnamed.Local(), true) {
+		t.Fatalf("Remotes are not listening")
+	}
+
+	for _, prefix := range []string{"proxy#web: Listening", "proxy#" + unnamed.String() + ": Listening"} {
+		if !strings.Contains(out.String(), prefix) {
+			t.Errorf("Expected %q in the logs, got %q", prefix, out.String())
+		}
+	}
+	stats := tun.RemoteStats()
+	if _, found := stats["web"]; !found {
+		t.Errorf("Expected the stats of the named remote under its name, got %v", stats)
+	}
+	if _, found := stats[unnamed.String()]; !found {
+		t.Errorf("Expected the stats of the unnamed remote under its string, got %v", stats)
+	}
+}
+
+// requestSSHConn records the global requests sent on the connection
+type requestSSHConn struct {
+	*fakeSSHConn
+	requests chan *ssh.Request
+}
+
+func (c *requestSSHConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	c.requests <- &ssh.Request{Type: name, WantReply: wantReply, Payload: payload}
+	return true, nil, nil
+}
+
+func TestVersionRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.Version = "1.2.3"
+	conn := &requestSSHConn{fakeSSHConn: newFakeSSHConn(false), requests: make(chan *ssh.Request, 1)}
+	reqs := make(chan *ssh.Request)
+	chans := make(chan ssh.NewChannel)
+	close(reqs)
+	close(chans)
+	go tun.BindSSH(ctx, conn, reqs, chans)
+
+	select {
+	case r := <-conn.requests:
+		if r.Type != versionRequest || string(r.Payload) != "1.2.3" {
+			t.Errorf("Expected the version request, got %s %q", r.Type, r.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the version to be sent")
+	}
+
+	peer := testTunnel(ctx)
+	received := make(chan *ssh.Request, 2)
+	received <- &ssh.Request{Type: "unknown", Payload: []byte("ignored")}
+	received <- &ssh.Request{Type: versionRequest, Payload: []byte("1.2.3")}
+	close(received)
+	peer.handleSSHRequests(received)
+	if version := peer.PeerVersion(); version != "1.2.3" {
+		t.Errorf("Expected the peer version 1.2.3, got %q", version)
+	}
+}
+
+func TestDoubleBindSSH(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.activatingConn.Add(1)
+	first := newFakeSSHConn(false)
+	done := make(chan error, 1)
+	go func() {
+		done <- bindFakeSSH(ctx, tun, first)
+	}()
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	if err := tun.WaitActive(waitCtx); err != nil {
+		t.Fatalf("Expected the first connection to be active: %s", err)
+	}
+
+	second := newFakeSSHConn(false)
+	if err := bindFakeSSH(ctx, tun, second); !errors.Is(err, ErrSSHAlreadyBound) {
+		t.Errorf("Expected the second bind to fail with ErrSSHAlreadyBound, got %v", err)
+	}
+	if tun.getActiveConn() != first {
+		t.Errorf("Expected the first connection to stay active")
+	}
+	select {
+	case <-second.closed:
+		t.Errorf("Expected the rejected connection to be left to the caller")
+	default:
+	}
+
+	first.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the first bind to return once its connection is closed")
+	}
+	if tun.getActiveConn() != nil {
+		t.Errorf("Expected the closed connection to be unbound")
+	}
+}
+
+func TestLastError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	if last := tun.LastError(); last.Err != nil {
+		t.Errorf("Expected no error before a connection, got %v", last.Err)
+	}
+
+	tun.activatingConn.Add(1)
+	conn := newFakeSSHConn(false)
+	done := make(chan struct{})
+	go func() {
+		bindFakeSSH(ctx, tun, conn)
+		close(done)
+	}()
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	if err := tun.WaitActive(waitCtx); err != nil {
+		t.Fatalf("Expected the connection to be active: %s", err)
+	}
+	before := time.Now()
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected BindSSH to return once the connection is closed")
+	}
+
+	last := tun.LastError()
+	if last.Source != ErrorSourceSSH || last.Err == nil || last.Err.Error() != "connection closed" {
+		t.Errorf("Expected the SSH disconnect error, got %s %v", last.Source, last.Err)
+	}
+	if last.Time.Before(before) || last.Time.After(time.Now()) {
+		t.Errorf("Expected the time of the disconnect, got %s", last.Time)
+	}
+}
+
+func TestMaxProxyConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := testTunnel(ctx)
+	tun.MaxProxyConns = 1
+	tun.activatingConn.Add(1)
+	remote := testRemote(t)
+	if err := tun.AddRemote(remote); err != nil {
+		t.Fatalf("Cannot add remote %s: %s", remote, err)
+	}
+	tun.proxiesMut.Lock()
+	_, bp := tun.findProxy(remote)
+	tun.proxiesMut.Unlock()
+	dropped := testutil.ToFloat64(ProxyConnDropCount)
+
+	//without SSH connection the first connection waits for one
+	first, err := net.Dial("tcp", remote.Local())
+	if err != nil {
+		t.Fatalf("Cannot connect to the proxy: %s", err)
+	}
+	defer first.Close()
+	for i := 0; atomic.LoadInt64(&bp.proxy.aliveConns) != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the first connection to be piped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", remote.Local())
+	if err != nil {
+		t.Fatalf("Cannot connect to the proxy: %s", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection over the maximum to be closed, got %v", err)
+	}
+	if got := testutil.ToFloat64(ProxyConnDropCount) - dropped; got != 1 {
+		t.Errorf("Expected 1 dropped connection, got %v", got)
+	}
+
+	first.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := first.Read(make([]byte, 1)); !os.IsTimeout(err) {
+		t.Errorf("Expected the first connection to stay open, got %v", err)
+	}
+}
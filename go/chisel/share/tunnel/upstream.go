@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ParseUpstreamProxy validates the URL of Config.UpstreamProxy, a SOCKS5 proxy
+// (socks5:// or socks5h://) or an HTTP CONNECT proxy (http://), with optional credentials
+func ParseUpstreamProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q, expected socks5, socks5h or http", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no host and port", u.Redacted())
+	}
+	return u, nil
+}
+
+// usesUpstream reports if the endpoint connections of the network go through the upstream proxy
+func (t *Tunnel) usesUpstream(network string) bool {
+	if t.Config.UpstreamProxy == nil || t.Config.Dialer != nil {
+		return false
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// upstreamDialer connects to the endpoints through the upstream proxy u,
+// forward connects to the proxy
+func upstreamDialer(u *url.URL, forward Dialer) Dialer {
+	if u.Scheme == "http" {
+		return &connectDialer{proxy: u, forward: forward}
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, forwardDialer{forward})
+	if err != nil {
+		return failedDialer{err: err}
+	}
+	return d.(Dialer)
+}
+
+// forwardDialer is a Dialer usable by the SOCKS5 dialer
+type forwardDialer struct {
+	Dialer
+}
+
+func (d forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+type failedDialer struct {
+	err error
+}
+
+func (d failedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, d.err
+}
+
+// connectDialer opens the connections with the CONNECT method of an HTTP proxy
+type connectDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused to connect to %s: %s", address, resp.Status)
+	}
+	//the endpoint can speak first, keep what was read along with the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read in r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
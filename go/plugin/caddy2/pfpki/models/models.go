@@ -263,6 +263,36 @@ func (SCEPServer) TableName() string {
 
 const dbError = "A database error occured. See log for details."
 
+// Newest certificates first when the client does not send any sort
+const certDefaultSort = "not_before DESC"
+
+// groupBy applies the GROUP BY of the search, if any, gorm emits an empty one otherwise
+func groupBy(group string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if group == "" {
+			return db
+		}
+		return db.Group(group)
+	}
+}
+
+// Status of the certificates computed from their validity dates,
+// the revoked certificates are moved to the RevokedCert table
+var certStatus = sql.VirtualField{
+	"valid":         {Query: "`not_before` <= NOW() AND `valid_until` >= NOW()"},
+	"expired":       {Query: "`valid_until` < NOW()"},
+	"not_yet_valid": {Query: "`not_before` > NOW()"},
+	"revoked":       {Query: "FALSE"},
+}
+
+// Status of the revoked certificates, whatever their validity dates
+var revokedCertStatus = sql.VirtualField{
+	"valid":         {Query: "FALSE"},
+	"expired":       {Query: "FALSE"},
+	"not_yet_valid": {Query: "FALSE"},
+	"revoked":       {Query: "TRUE"},
+}
+
 // Digest Values:
 // 0 UnknownSignatureAlgorithm
 // 1 MD2WithRSA
@@ -522,7 +552,7 @@ func (c CA) Paginated(vars sql.Vars) (types.Info, error) {
 			return Information, errors.New(dbError)
 		}
 		var cadb []CA
-		c.DB.Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&cadb)
+		c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&cadb)
 		Information.Entries = cadb
 	}
 
@@ -538,7 +568,7 @@ func (c CA) Search(vars sql.Vars) (types.Info, error) {
 		return Information, errors.New(dbError)
 	}
 	var count int64
-	c.DB.Model(&CA{}).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
+	c.DB.Model(&CA{}).Scopes(groupBy(sql.Group)).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
 	counter := int(count)
 
 	Information.TotalCount = counter
@@ -546,7 +576,7 @@ func (c CA) Search(vars sql.Vars) (types.Info, error) {
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
 		var cadb []CA
-		c.DB.Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&cadb)
+		c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&cadb)
 		Information.Entries = cadb
 	}
 
@@ -1154,7 +1184,7 @@ func (p Profile) Paginated(vars sql.Vars) (types.Info, error) {
 			return Information, errors.New(dbError)
 		}
 		var profiledb []Profile
-		p.DB.Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&profiledb)
+		p.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&profiledb)
 		Information.Entries = profiledb
 	}
 
@@ -1169,14 +1199,14 @@ func (p Profile) Search(vars sql.Vars) (types.Info, error) {
 		return Information, errors.New(dbError)
 	}
 	var count int64
-	p.DB.Model(&Profile{}).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
+	p.DB.Model(&Profile{}).Scopes(groupBy(sql.Group)).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
 	counter := int(count)
 	Information.TotalCount = counter
 	Information.PrevCursor = vars.Cursor
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
 		var profiledb []Profile
-		p.DB.Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&profiledb)
+		p.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&profiledb)
 		Information.Entries = profiledb
 	}
 
@@ -1337,13 +1367,13 @@ func (c Cert) Paginated(vars sql.Vars) (types.Info, error) {
 	Information.PrevCursor = vars.Cursor
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
-		sql, err := vars.Sql(c)
+		sql, err := vars.Sql(c, certDefaultSort)
 		if err != nil {
 			Information.Error = err.Error()
 			return Information, errors.New(dbError)
 		}
 		var certdb []Cert
-		c.DB.Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&certdb)
+		c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&certdb)
 		Information.Entries = certdb
 	}
 
@@ -1352,20 +1382,21 @@ func (c Cert) Paginated(vars sql.Vars) (types.Info, error) {
 
 func (c Cert) Search(vars sql.Vars) (types.Info, error) {
 	Information := types.Info{}
-	sql, err := vars.Sql(c)
+	vars.VirtualFields = map[string]sql.VirtualField{"status": certStatus}
+	sql, err := vars.Sql(c, certDefaultSort)
 	if err != nil {
 		Information.Error = err.Error()
 		return Information, errors.New(dbError)
 	}
 	var count int64
-	c.DB.Model(&Cert{}).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
+	c.DB.Model(&Cert{}).Scopes(groupBy(sql.Group)).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
 	counter := int(count)
 	Information.TotalCount = counter
 	Information.PrevCursor = vars.Cursor
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
 		var certdb []Cert
-		c.DB.Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&certdb)
+		c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&certdb)
 		Information.Entries = certdb
 	}
 
@@ -1796,7 +1827,7 @@ func (c RevokedCert) Paginated(vars sql.Vars) (types.Info, error) {
 			return Information, err
 		}
 		var revokedcertdb []RevokedCert
-		result := c.DB.Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&revokedcertdb)
+		result := c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&revokedcertdb)
 		if result.Error != nil {
 			Information.Error = result.Error.Error()
 			return Information, err
@@ -1810,20 +1841,21 @@ func (c RevokedCert) Paginated(vars sql.Vars) (types.Info, error) {
 
 func (c RevokedCert) Search(vars sql.Vars) (types.Info, error) {
 	Information := types.Info{}
+	vars.VirtualFields = map[string]sql.VirtualField{"status": revokedCertStatus}
 	sql, err := vars.Sql(c)
 	if err != nil {
 		Information.Error = err.Error()
 		return Information, err
 	}
 	var count int64
-	c.DB.Model(&Cert{}).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
+	c.DB.Model(&Cert{}).Scopes(groupBy(sql.Group)).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
 	counter := int(count)
 	Information.TotalCount = counter
 	Information.PrevCursor = vars.Cursor
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
 		var revokedcertdb []RevokedCert
-		c.DB.Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&revokedcertdb)
+		c.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&revokedcertdb)
 		Information.Entries = revokedcertdb
 	}
 
@@ -2274,7 +2306,7 @@ func (s SCEPServer) Search(vars sql.Vars) (types.Info, error) {
 		return Information, errors.New(dbError)
 	}
 	var count int64
-	s.DB.Model(&SCEPServer{}).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
+	s.DB.Model(&SCEPServer{}).Scopes(groupBy(sql.Group)).Where(sql.Where.Query, sql.Where.Values...).Count(&count)
 	counter := int(count)
 
 	Information.TotalCount = counter
@@ -2282,7 +2314,7 @@ func (s SCEPServer) Search(vars sql.Vars) (types.Info, error) {
 	Information.NextCursor = vars.Cursor + vars.Limit
 	if vars.Cursor < counter {
 		var scepserverdb []SCEPServer
-		s.DB.Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&scepserverdb)
+		s.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Where(sql.Where.Query, sql.Where.Values...).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&scepserverdb)
 		Information.Entries = scepserverdb
 	}
 
@@ -2319,7 +2351,7 @@ func (s SCEPServer) Paginated(vars sql.Vars) (types.Info, error) {
 			return Information, errors.New(dbError)
 		}
 		var scepserverdb []SCEPServer
-		s.DB.Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&scepserverdb)
+		s.DB.Scopes(groupBy(sql.Group)).Select(sql.Select).Order(sql.Order).Offset(sql.Offset).Limit(sql.Limit).Find(&scepserverdb)
 		Information.Entries = scepserverdb
 	}
 
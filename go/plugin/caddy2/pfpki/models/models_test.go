@@ -0,0 +1,79 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inverse-inc/packetfence/go/plugin/caddy2/pfpki/sql"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// testDB builds the statements without any database
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "test@tcp(127.0.0.1:1)/test", SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("Cannot open the database: %s", err)
+	}
+	return db
+}
+
+func TestGroupBy(t *testing.T) {
+	db := testDB(t)
+	var certs []Cert
+	stmt := db.Scopes(groupBy("`profile_name`")).Select("`profile_name`,COUNT(*)").Find(&certs).Statement
+	if query := stmt.SQL.String(); !strings.Contains(query, "GROUP BY `profile_name`") {
+		t.Errorf("Expected the query to be grouped, got %s", query)
+	}
+
+	stmt = db.Scopes(groupBy("")).Find(&certs).Statement
+	if query := stmt.SQL.String(); strings.Contains(query, "GROUP BY") {
+		t.Errorf("Expected no GROUP BY without group, got %s", query)
+	}
+}
+
+func TestCertStatus(t *testing.T) {
+	tests := []struct {
+		status  string
+		fields  map[string]sql.VirtualField
+		where   string
+		invalid bool
+	}{
+		// The validity dates are both included in the validity period
+		{status: "valid", fields: map[string]sql.VirtualField{"status": certStatus}, where: "((`not_before` <= NOW() AND `valid_until` >= NOW()))"},
+		// Expired the instant after valid_until
+		{status: "expired", fields: map[string]sql.VirtualField{"status": certStatus}, where: "((`valid_until` < NOW()))"},
+		// Not yet valid until the instant of not_before
+		{status: "not_yet_valid", fields: map[string]sql.VirtualField{"status": certStatus}, where: "((`not_before` > NOW()))"},
+		{status: "revoked", fields: map[string]sql.VirtualField{"status": certStatus}, where: "((FALSE))"},
+		{status: "REVOKED", fields: map[string]sql.VirtualField{"status": certStatus}, where: "((FALSE))"},
+		{status: "valid", fields: map[string]sql.VirtualField{"status": revokedCertStatus}, where: "((FALSE))"},
+		{status: "revoked", fields: map[string]sql.VirtualField{"status": revokedCertStatus}, where: "((TRUE))"},
+		{status: "suspended", fields: map[string]sql.VirtualField{"status": certStatus}, invalid: true},
+	}
+	for _, test := range tests {
+		vars := sql.Vars{
+			Query:         sql.Search{Field: "status", Op: "equals", Value: test.status},
+			VirtualFields: test.fields,
+		}
+		query, err := vars.Sql(Cert{})
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Expected an error for the status %s", test.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for the status %s: %s", test.status, err)
+		}
+		if query.Where.Query != test.where {
+			t.Errorf("Expected %s for the status %s, got %s", test.where, test.status, query.Where.Query)
+		}
+	}
+
+	for status := range certStatus {
+		if _, found := revokedCertStatus[status]; !found {
+			t.Errorf("Status %s is missing from the revoked certificates", status)
+		}
+	}
+}
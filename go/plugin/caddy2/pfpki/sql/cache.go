@@ -0,0 +1,245 @@
+package sql
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSqlCacheSize is the number of shapes kept by a SqlCache created without a size
+const DefaultSqlCacheSize = 1000
+
+// Longest key of a shape, the larger queries are not cached
+const maxSqlShape = 4096
+
+// SqlCache memoizes the statement parts built for the shape of a Vars: its fields,
+// sort, group and the fields and operators of its search, but not the values of
+// the search. A query repeating a shape only binds its values, without the
+// reflection on the class and the string building.
+//
+// The server side settings of the Vars (Operators, DefaultOperators, JSONFields,
+// Collations, VirtualFields and the queries of the Scores) are not part of the
+// shape, a cache must only be shared by the queries with the same settings,
+// e.g. one cache per listing endpoint.
+type SqlCache struct {
+	mu      sync.RWMutex
+	size    int
+	entries map[string]*sqlCacheEntry
+}
+
+// sqlCacheEntry holds the statement parts built for a shape
+type sqlCacheEntry struct {
+	sql Sql
+	// scores are the names of the score sort keys, in the order of their values
+	scores []string
+	// types maps the lowercase fields of the class to their Go type
+	types map[string]reflect.Type
+}
+
+// NewSqlCache returns a cache of size shapes, DefaultSqlCacheSize when size is 0.
+// The cache is emptied once full since the shapes are chosen by the clients.
+func NewSqlCache(size int) *SqlCache {
+	if size <= 0 {
+		size = DefaultSqlCacheSize
+	}
+	return &SqlCache{size: size, entries: make(map[string]*sqlCacheEntry)}
+}
+
+// Sql returns the same statement parts as vars.Sql, the parts depending only
+// on the shape of vars are reused from a previous query with the same shape
+func (c *SqlCache) Sql(vars Vars, class interface{}, defaultSort ...string) (Sql, error) {
+	key, ok := vars.sqlShape(class, defaultSort)
+	if !ok {
+		return vars.Sql(class, defaultSort...)
+	}
+	c.mu.RLock()
+	entry := c.entries[key]
+	c.mu.RUnlock()
+	if entry == nil {
+		return c.add(key, vars, class, defaultSort...)
+	}
+
+	var err error
+	sql := entry.sql
+	sql.MaxExecutionTime = vars.MaxExecutionTime
+	sql.SelectValues = nil
+	if vars.MatchedFields {
+		fields, groups := vars.Query.sqlMatchGroups()
+		for _, field := range fields {
+			for _, search := range groups[field] {
+				if sql.SelectValues, err = search.sqlBind(entry.types, vars.whereOptions(), sql.SelectValues); err != nil {
+					return Sql{}, err
+				}
+			}
+		}
+	}
+	sql.OrderValues = nil
+	for _, name := range entry.scores {
+		sql.OrderValues = append(sql.OrderValues, vars.Scores[name].Values...)
+	}
+	if len(vars.After) > 0 {
+		// keyset pagination replaces the offset
+		vars.Cursor = 0
+	}
+	if sql.Offset, err = vars.SqlOffset(); err != nil {
+		return Sql{}, err
+	}
+	if sql.Limit, err = vars.SqlLimit(); err != nil {
+		return Sql{}, err
+	}
+	if sql.Where.Values, err = vars.Query.sqlBind(entry.types, vars.whereOptions(), nil); err != nil {
+		return Sql{}, err
+	}
+	sql.Where = sql.Where.And(vars.Scope)
+	if len(vars.After) > 0 {
+		keyset, err := vars.SqlKeyset(class, defaultSort...)
+		if err != nil {
+			return Sql{}, err
+		}
+		sql.Where = sql.Where.And(keyset)
+	}
+
+	return sql, nil
+}
+
+// add builds the statement parts of vars and caches the ones of its shape
+func (c *SqlCache) add(key string, vars Vars, class interface{}, defaultSort ...string) (Sql, error) {
+	sql, err := vars.Sql(class, defaultSort...)
+	if err != nil {
+		return Sql{}, err
+	}
+	where, err := vars.Query.sqlWhereOptions(class, vars.whereOptions())
+	if err != nil {
+		return Sql{}, err
+	}
+	sorts, err := vars.sqlSorts(class, defaultSort...)
+	if err != nil {
+		return Sql{}, err
+	}
+
+	entry := &sqlCacheEntry{
+		sql:   Sql{Select: sql.Select, Group: sql.Group, Order: sql.Order, Where: Where{Query: where.Query}},
+		types: make(map[string]reflect.Type),
+	}
+	for _, sort := range sorts {
+		if sort.Score != nil {
+			entry.scores = append(entry.scores, sort.Field)
+		}
+	}
+	for _, field := range sqlClassFields(class) {
+		entry.types[strings.ToLower(field.Name)] = field.Type
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string]*sqlCacheEntry)
+	}
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return sql, nil
+}
+
+// sqlShape returns the key of the shape of vars, false when the vars cannot be cached
+func (vars Vars) sqlShape(class interface{}, defaultSort []string) (string, bool) {
+	var sb strings.Builder
+	sb.WriteString(reflect.TypeOf(class).String())
+	for _, list := range [][]string{vars.Fields, vars.Sort, vars.GroupBy, defaultSort} {
+		sb.WriteString("|")
+		for _, s := range list {
+			sb.WriteString(strconv.Quote(s))
+		}
+	}
+	sb.WriteString("|" + strconv.FormatBool(vars.MatchedFields) + "|")
+	if !vars.Query.sqlShape(&sb, vars.VirtualFields) {
+		return "", false
+	}
+	return sb.String(), true
+}
+
+// sqlShape writes the shape of the search, the values changing the statement
+// (the lists, the other field of field_equals and the values of the virtual
+// fields) are part of the shape. It is false when the search is too large.
+func (search Search) sqlShape(sb *strings.Builder, virtualFields map[string]VirtualField) bool {
+	if sb.Len() > maxSqlShape {
+		return false
+	}
+	sb.WriteString("(")
+	sb.WriteString(strings.ToLower(search.Op))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Quote(strings.ToLower(search.Field)))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Quote(search.Collation))
+	sb.WriteString(" ")
+	if search.Value == "" {
+		sb.WriteString("-")
+	} else if _, _, virtual := sqlVirtualField(virtualFields, search.Field); virtual || strings.ToLower(sqlOperatorAlias(search.Op)) == "field_equals" {
+		sb.WriteString(strconv.Quote(searchLiteral(search.Value)))
+	} else if values, ok := sqlSlice(search.Value); ok {
+		sb.WriteString("[" + strconv.Itoa(len(values)) + "]")
+	} else {
+		sb.WriteString("?")
+	}
+	for _, value := range search.Values {
+		if !value.sqlShape(sb, virtualFields) {
+			return false
+		}
+	}
+	sb.WriteString(")")
+	return true
+}
+
+// sqlBind appends the values bound by the search to values, the search must have
+// the shape of the one the cached where clause was built from. types maps the
+// lowercase fields of the class to their Go type.
+func (search Search) sqlBind(types map[string]reflect.Type, options sqlWhereOptions, values []interface{}) ([]interface{}, error) {
+	if reflect.DeepEqual(search, Search{}) {
+		return values, nil
+	}
+	var err error
+	if strings.ToLower(search.Op) == "not" || len(search.Values) == 1 {
+		return search.Values[0].sqlBind(types, options, values)
+	}
+	if len(search.Values) > 0 {
+		for _, value := range search.Values {
+			if values, err = value.sqlBind(types, options, values); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	if search.Op == "" {
+		search.Op, _ = sqlDefaultOperator(options.defaultOperators, search.Field)
+	}
+	search.Op = sqlOperatorAlias(search.Op)
+	t, found := types[strings.ToLower(search.Field)]
+	if !found {
+		if !sqlIsJSONField(options.jsonFields, search.Field) {
+			if _, virtual, ok := sqlVirtualField(options.virtualFields, search.Field); ok {
+				where, err := virtual.sqlWhere(search)
+				if err != nil {
+					return nil, err
+				}
+				return append(values, where.Values...), nil
+			}
+		}
+	}
+	if search.Value == "" {
+		return values, nil
+	}
+	leaf, err := search.sqlValues(t)
+	if err != nil {
+		return nil, err
+	}
+	return append(values, leaf...), nil
+}
+
+// sqlIsJSONField reports if the field is registered as a JSON field
+func sqlIsJSONField(jsonFields map[string]JSONField, field string) bool {
+	for name := range jsonFields {
+		if strings.ToLower(name) == strings.ToLower(field) {
+			return true
+		}
+	}
+	return false
+}
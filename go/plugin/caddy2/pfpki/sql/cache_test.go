@@ -0,0 +1,90 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testCacheVars returns the vars of a listing, the values of the search change with cn
+func testCacheVars(cn string, cas ...interface{}) Vars {
+	return Vars{
+		Limit:  10,
+		Fields: []string{"id", "cn", "ca_id"},
+		Sort:   []string{"relevance DESC", "id ASC"},
+		Query: Search{Op: "and", Values: []Search{
+			{Field: "cn", Op: "starts_with", Value: cn},
+			{Field: "ca_id", Op: "equals", Value: cas},
+			{Field: "status", Op: "equals", Value: "valid"},
+			{Field: "mail", Value: cn + "@example.com"},
+		}},
+		DefaultOperators: map[string]string{"mail": "equals"},
+		VirtualFields: map[string]VirtualField{
+			"status": {
+				"valid":   Where{Query: "`valid_until` > ?", Values: []interface{}{"2020-01-01"}},
+				"expired": Where{Query: "`valid_until` <= ?", Values: []interface{}{"2020-01-01"}},
+			},
+		},
+		Scores: map[string]Score{"relevance": Relevance("cn", cn)},
+		Scope:  Where{Query: "`profile_id` = ?", Values: []interface{}{1}},
+	}
+}
+
+func TestSqlCache(t *testing.T) {
+	cache := NewSqlCache(0)
+	for i, vars := range []Vars{
+		testCacheVars("alice", 1),
+		testCacheVars("bob", "2"),
+		testCacheVars("carol", 3, 4),
+		testCacheVars("dave_%", 5, 6),
+		func() Vars {
+			vars := testCacheVars("erin", 7)
+			vars.Query.Values[2].Value = "expired"
+			vars.Sort = []string{"cn ASC", "id ASC"}
+			vars.After = []string{"erin", "10"}
+			return vars
+		}(),
+	} {
+		expected, err := vars.Sql(testCert{})
+		if err != nil {
+			t.Fatalf("%d: Unexpected error: %s", i, err)
+		}
+		for _, pass := range []string{"miss", "hit"} {
+			sql, err := cache.Sql(vars, testCert{})
+			if err != nil {
+				t.Fatalf("%d %s: Unexpected error: %s", i, pass, err)
+			}
+			if !reflect.DeepEqual(sql, expected) {
+				t.Errorf("%d %s: Expected %#v, got %#v", i, pass, expected, sql)
+			}
+		}
+	}
+	if len(cache.entries) != 3 {
+		t.Errorf("Expected a shape per list length, virtual value and sort, got %d shapes", len(cache.entries))
+	}
+
+	vars := testCacheVars("frank", "not a number")
+	if _, err := cache.Sql(vars, testCert{}); err == nil {
+		t.Errorf("Expected the values of a cached shape to be validated")
+	}
+}
+
+func BenchmarkSql(b *testing.B) {
+	vars := testCacheVars("alice", 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := vars.Sql(testCert{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSqlCache(b *testing.B) {
+	cache := NewSqlCache(0)
+	vars := testCacheVars("alice", 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.Sql(vars, testCert{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
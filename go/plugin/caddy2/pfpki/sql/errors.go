@@ -0,0 +1,136 @@
+package sql
+
+import "strconv"
+
+type (
+	// ErrUnknownField is returned when a field is not part of the class
+	ErrUnknownField struct {
+		Field     string
+		Aggregate string
+	}
+
+	// ErrFieldRequired is returned when a search on a field has no field name
+	ErrFieldRequired struct {
+		Op string
+	}
+
+	// ErrOperatorRequired is returned when a search on a field has no operator and the field no default one
+	ErrOperatorRequired struct {
+		Field string
+	}
+
+	// ErrUnknownOperator is returned when a search operator is not supported
+	ErrUnknownOperator struct {
+		Op string
+	}
+
+	// ErrInvalidValue is returned when the value of a search is not usable by its operator
+	ErrInvalidValue struct {
+		Field  string
+		Op     string
+		Reason string
+	}
+
+	// ErrSearchLimit is returned when a search exceeds MaxSearchDepth or MaxSearchNodes
+	ErrSearchLimit struct {
+		Limit string
+		Max   int
+	}
+
+	// ErrOperatorNotAllowed is returned when an operator is not allowed on a restricted field
+	ErrOperatorNotAllowed struct {
+		Field string
+		Op    string
+	}
+
+	// ErrInvalidJSONPath is returned when the path of a JSONField is not supported
+	ErrInvalidJSONPath struct {
+		Column string
+		Path   string
+	}
+
+	// ErrUnknownCollation is returned when a collation is not part of SqlCollations
+	ErrUnknownCollation struct {
+		Collation string
+	}
+
+	// ErrInvalidSortDirection is returned when the direction of a sort is neither asc nor desc,
+	// optionally followed by nulls first or nulls last
+	ErrInvalidSortDirection struct {
+		Field     string
+		Direction string
+	}
+
+	// ErrOffsetLimit is returned when the offset exceeds MaxOffset
+	ErrOffsetLimit struct {
+		Offset int
+		Max    int
+	}
+
+	// ErrVarsLimit is returned when the fields or the sort of a Vars exceed MaxSelectFields or MaxSortTerms
+	ErrVarsLimit struct {
+		Limit string
+		Max   int
+	}
+
+	// ErrFieldType is returned when a field does not have the type required by its use
+	ErrFieldType struct {
+		Field    string
+		Expected string
+	}
+)
+
+func (e *ErrUnknownField) Error() string {
+	if e.Aggregate != "" {
+		return "Unknown field `" + e.Field + "` for aggregate " + e.Aggregate
+	}
+	return "Unknown field `" + e.Field + "`"
+}
+
+func (e *ErrFieldRequired) Error() string {
+	return "Field is required for operator `" + e.Op + "`"
+}
+
+func (e *ErrOperatorRequired) Error() string {
+	return "Operator is required for field `" + e.Field + "`"
+}
+
+func (e *ErrUnknownOperator) Error() string {
+	return "Unknown operator `" + e.Op + "`"
+}
+
+func (e *ErrInvalidValue) Error() string {
+	return "Invalid value for operator `" + e.Op + "`, " + e.Reason
+}
+
+func (e *ErrSearchLimit) Error() string {
+	return "Search exceeds the maximum " + e.Limit + " of " + strconv.Itoa(e.Max)
+}
+
+func (e *ErrOperatorNotAllowed) Error() string {
+	return "Operator `" + e.Op + "` is not allowed on field `" + e.Field + "`"
+}
+
+func (e *ErrInvalidJSONPath) Error() string {
+	return "Invalid JSON path `" + e.Path + "` for field `" + e.Column + "`"
+}
+
+func (e *ErrUnknownCollation) Error() string {
+	return "Unknown collation `" + e.Collation + "`"
+}
+
+func (e *ErrInvalidSortDirection) Error() string {
+	return "Invalid sort direction `" + e.Direction + "` for field `" + e.Field + "`, expected asc or desc, optionally followed by nulls first or nulls last"
+}
+
+func (e *ErrOffsetLimit) Error() string {
+	return "Offset " + strconv.Itoa(e.Offset) + " exceeds the maximum of " + strconv.Itoa(e.Max) + ", use keyset pagination (after) to read further"
+}
+
+func (e *ErrVarsLimit) Error() string {
+	return "Request exceeds the maximum " + e.Limit + " of " + strconv.Itoa(e.Max)
+}
+
+func (e *ErrFieldType) Error() string {
+	return "Field `" + e.Field + "` is not " + e.Expected
+}
@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,16 +11,24 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type (
 	// SQL struct
 	Sql struct {
 		Select string
-		Order  string
-		Offset int
-		Limit  int
-		Where  Where
+		// SelectValues are the parameters of the matched fields in Select
+		SelectValues []interface{}
+		Group        string
+		Order        string
+		// OrderValues are the parameters of the score sort keys in Order
+		OrderValues []interface{}
+		Offset      int
+		Limit       int
+		Where       Where
+		// MaxExecutionTime caps the runtime of the statement with a MySQL optimizer hint, 0 adds none
+		MaxExecutionTime time.Duration
 	}
 
 	// Where struct
@@ -28,11 +37,57 @@ type (
 		Values []interface{}
 	}
 	Vars struct {
-		Cursor int      `schema:"cursor" json:"cursor" default:"0"`
-		Limit  int      `schema:"limit" json:"limit" default:"100"`
-		Fields []string `schema:"fields" json:"fields" default:"id"`
-		Sort   []string `schema:"sort" json:"sort" default:"id ASC"`
-		Query  Search   `schema:"query" json:"query"`
+		Cursor  int      `schema:"cursor" json:"cursor" default:"0"`
+		Limit   int      `schema:"limit" json:"limit" default:"100"`
+		Fields  []string `schema:"fields" json:"fields" default:"id"`
+		Sort    []string `schema:"sort" json:"sort" default:"id ASC"`
+		GroupBy []string `schema:"group_by" json:"group_by"`
+		After   []string `schema:"after" json:"after"`
+		Query   Search   `schema:"query" json:"query"`
+		// Operators restricts the search operators allowed on a field,
+		// the fields missing from the map allow all the operators
+		Operators map[string][]string `schema:"-" json:"-"`
+		// DefaultOperators sets the operator of the searches on a field without one,
+		// e.g. equals for a serial number and contains for a common name
+		DefaultOperators map[string]string `schema:"-" json:"-"`
+		// JSONFields registers the virtual fields extracted from JSON columns,
+		// they are usable in the search and the select list
+		JSONFields map[string]JSONField `schema:"-" json:"-"`
+		// Collations sets the collation of the comparisons on a field,
+		// a search with its own collation overrides it
+		Collations map[string]string `schema:"-" json:"-"`
+		// VirtualFields registers the computed fields usable in the search
+		VirtualFields map[string]VirtualField `schema:"-" json:"-"`
+		// Scores registers the virtual sort keys computed by the server, e.g. Relevance
+		Scores map[string]Score `schema:"-" json:"-"`
+		// Scope is a mandatory predicate set by the server, e.g. the authorized CA IDs,
+		// it is always ANDed with the search so it cannot be bypassed by the client
+		Scope Where `schema:"-" json:"-"`
+		// MatchedFields adds a `matched_<field>` column per field of a top level OR search,
+		// set to the name of the field when the row matched its predicate and NULL otherwise.
+		// Their values are in Sql.SelectValues, bound first by Statement.
+		MatchedFields bool `schema:"-" json:"-"`
+		// MaxExecutionTime is set by the server to abort the statements running longer
+		// (MAX_EXECUTION_TIME hint), so a pathological search cannot hold a connection
+		// forever. 0 does not limit them.
+		MaxExecutionTime time.Duration `schema:"-" json:"-"`
+	}
+
+	// VirtualField maps each value of a computed field to its predicate,
+	// e.g. the status of a certificate computed from its validity dates.
+	// Only equals (with a value or a list of values) and not_equals are supported.
+	VirtualField map[string]Where
+
+	// Score is a parameterized expression usable as a sort key
+	Score struct {
+		Query  string
+		Values []interface{}
+	}
+
+	// JSONField is a virtual field extracting the value at Path of the JSON Column, e.g. `$.subject.cn`
+	JSONField struct {
+		Column string
+		Path   string
 	}
 
 	// Search struct
@@ -41,74 +96,476 @@ type (
 		Op     string      `schema:"op" json:"op"`
 		Value  interface{} `schema:"value" json:"value,omitempty"`
 		Values []Search    `schema:"values" json:"values,omitempty"`
+		// Collation of the comparison, one of SqlCollations
+		Collation string `schema:"collation" json:"collation,omitempty"`
 	}
 )
 
-func (vars Vars) Sql(class interface{}) (Sql, error) {
+// Limits of a Search tree, protect against deeply nested or huge queries
+var (
+	MaxSearchDepth = 10
+	MaxSearchNodes = 100
+)
+
+// Limits of the fields and the sort of a Vars, protect against oversized
+// requests. 0 disables the limit.
+var (
+	MaxSelectFields = 100
+	MaxSortTerms    = 10
+)
+
+// Largest offset accepted, deeper pages must use keyset pagination (Vars.After)
+// since the database scans all the skipped rows. 0 disables the limit.
+var MaxOffset = 10000
+
+// SqlOperatorAliases maps the short forms of the search operators to the
+// canonical ones, e.g. eq to equals. The aliases are set by the server, the
+// clients can only use the ones registered here.
+var SqlOperatorAliases = map[string]string{
+	"eq":  "equals",
+	"neq": "not_equals",
+	"gt":  "greater_than",
+	"gte": "greater_than_equals",
+	"lt":  "less_than",
+	"lte": "less_than_equals",
+}
+
+// Collations allowed in a search, the names are interpolated in the statement
+var SqlCollations = []string{
+	"binary",
+	"utf8mb4_bin",
+	"utf8mb4_general_ci",
+	"utf8mb4_unicode_ci",
+	"utf8mb4_0900_ai_ci",
+	"utf8mb4_0900_as_cs",
+}
+
+// JSON paths allowed in a JSONField, member names and array indexes only
+var sqlJSONPath = regexp.MustCompile(`^\$(\.[A-Za-z0-9_]+|\[[0-9]+\])*$`)
+
+// Aggregate functions allowed in the select list, e.g. `COUNT(*)` or `MAX(not_before)`
+var sqlAggregate = regexp.MustCompile(`^(?i)(count|max|min)\(\s*([^()\s]+)\s*\)$`)
+
+// Sql builds the statement parts for the class, the optional defaultSort is used
+// instead of the struct tag default when the client does not send any sort
+func (vars Vars) Sql(class interface{}, defaultSort ...string) (Sql, error) {
 	var sql Sql
 	var err error
+	sql.MaxExecutionTime = vars.MaxExecutionTime
 	if sql.Select, err = vars.SqlSelect(class); err != nil {
 		return Sql{}, err
 	}
-	if sql.Order, err = vars.SqlOrder(class); err != nil {
+	if vars.MatchedFields {
+		matches, values, err := vars.sqlMatches(class)
+		if err != nil {
+			return Sql{}, err
+		}
+		if matches != "" {
+			sql.Select += "," + matches
+			sql.SelectValues = values
+		}
+	}
+	if sql.Group, err = vars.SqlGroup(class); err != nil {
 		return Sql{}, err
 	}
+	if sql.Order, sql.OrderValues, err = vars.sqlOrder(class, defaultSort...); err != nil {
+		return Sql{}, err
+	}
+	if len(vars.After) > 0 {
+		// keyset pagination replaces the offset
+		vars.Cursor = 0
+	}
 	if sql.Offset, err = vars.SqlOffset(); err != nil {
 		return Sql{}, err
 	}
 	if sql.Limit, err = vars.SqlLimit(); err != nil {
 		return Sql{}, err
 	}
-	if sql.Where, err = vars.Query.SqlWhere(class); err != nil {
+	if sql.Where, err = vars.Query.sqlWhereOptions(class, vars.whereOptions()); err != nil {
 		return Sql{}, err
 	}
+	sql.Where = sql.Where.And(vars.Scope)
+	if len(vars.After) > 0 {
+		keyset, err := vars.SqlKeyset(class, defaultSort...)
+		if err != nil {
+			return Sql{}, err
+		}
+		sql.Where = sql.Where.And(keyset)
+	}
 
 	return sql, nil
 }
 
+// whereOptions returns the options of the search registered in vars
+func (vars Vars) whereOptions() sqlWhereOptions {
+	return sqlWhereOptions{operators: vars.Operators, defaultOperators: vars.DefaultOperators, jsonFields: vars.JSONFields, collations: vars.Collations, virtualFields: vars.VirtualFields}
+}
+
+// SqlExists returns the statement telling if any row of the table of the class
+// matches the search, along with its where clause holding the values.
+// It is cheaper than a count since the database stops at the first match.
+// The class must have a TableName method.
+func (vars Vars) SqlExists(class interface{}) (string, Where, error) {
+	tabler, ok := class.(interface{ TableName() string })
+	if !ok {
+		err := fmt.Errorf("No table name for %T", class)
+		return "", Where{}, err
+	}
+	where, err := vars.Query.sqlWhereOptions(class, vars.whereOptions())
+	if err != nil {
+		return "", Where{}, err
+	}
+	where = where.And(vars.Scope)
+	query := "SELECT 1 FROM " + sqlIdentifier(tabler.TableName())
+	if where.Query != "" {
+		query += " WHERE " + where.Query
+	}
+	return "SELECT " + sqlHint(vars.MaxExecutionTime) + "EXISTS(" + query + ")", where, nil
+}
+
+// SqlCountDistinct returns the statement counting the distinct values of the field
+// in the rows of the table of the class matching the search, along with its where
+// clause holding the values. The class must have a TableName method.
+func (vars Vars) SqlCountDistinct(field string, class interface{}) (string, Where, error) {
+	tabler, ok := class.(interface{ TableName() string })
+	if !ok {
+		err := fmt.Errorf("No table name for %T", class)
+		return "", Where{}, err
+	}
+	column, err := sqlClassField(class, field)
+	if err != nil {
+		return "", Where{}, err
+	}
+	where, err := vars.Query.sqlWhereOptions(class, vars.whereOptions())
+	if err != nil {
+		return "", Where{}, err
+	}
+	where = where.And(vars.Scope)
+	query := "SELECT " + sqlHint(vars.MaxExecutionTime) + "COUNT(DISTINCT " + column + ") FROM " + sqlIdentifier(tabler.TableName())
+	if where.Query != "" {
+		query += " WHERE " + where.Query
+	}
+	return query, where, nil
+}
+
+// Statement returns the parameterized statement selecting from table and its values
+func (sql Sql) Statement(table string) (string, []interface{}) {
+	query := "SELECT " + sqlHint(sql.MaxExecutionTime) + sql.Select + " FROM " + sqlIdentifier(table)
+	if sql.Where.Query != "" {
+		query += " WHERE " + sql.Where.Query
+	}
+	if sql.Group != "" {
+		query += " GROUP BY " + sql.Group
+	}
+	if sql.Order != "" {
+		query += " ORDER BY " + sql.Order
+	}
+	if sql.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(sql.Limit)
+	}
+	if sql.Offset > 0 {
+		query += " OFFSET " + strconv.Itoa(sql.Offset)
+	}
+	// the select list comes before the WHERE clause, which comes before the ORDER BY
+	values := append(append(append([]interface{}{}, sql.SelectValues...), sql.Where.Values...), sql.OrderValues...)
+	return query, values
+}
+
+// sqlHint returns the optimizer hint limiting the execution time of a statement,
+// in milliseconds rounded up, empty when there is no limit
+func sqlHint(maxExecutionTime time.Duration) string {
+	if maxExecutionTime <= 0 {
+		return ""
+	}
+	ms := (maxExecutionTime + time.Millisecond - 1) / time.Millisecond
+	return "/*+ MAX_EXECUTION_TIME(" + strconv.FormatInt(int64(ms), 10) + ") */ "
+}
+
+// Explain returns the statement with its values interpolated as quoted literals
+// alongside the parameterized statement and its values.
+// The interpolated statement is for display only and must never be executed.
+func (sql Sql) Explain(table string) (string, string, []interface{}) {
+	query, values := sql.Statement(table)
+	var display strings.Builder
+	display.WriteString("/* for display only, not executed */ ")
+	i := 0
+	for _, c := range query {
+		if c == '?' && i < len(values) {
+			display.WriteString(sqlLiteral(values[i]))
+			i++
+			continue
+		}
+		display.WriteRune(c)
+	}
+	return display.String(), query, values
+}
+
+var literalEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\x00", `\0`, "\x1a", `\Z`)
+
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprintf("%v", v)
+	case json.Number:
+		return v.String()
+	case time.Time:
+		return "'" + v.Format("2006-01-02 15:04:05") + "'"
+	default:
+		return "'" + literalEscaper.Replace(fmt.Sprintf("%v", v)) + "'"
+	}
+}
+
+// sqlIdentifier quotes the name of a table, a column or an alias, its backticks
+// are doubled so a json tag cannot break out of the quotes
+func sqlIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// SqlFields returns the fields of the class that can be selected and searched,
+// the fields of embedded structs are included with their gorm embeddedPrefix
 func SqlFields(class interface{}) []string {
 	jsonTags := make([]string, 0)
-	jsonTags = append(jsonTags, "id")
-	fields := reflect.TypeOf(class)
+	for _, field := range sqlClassFields(class) {
+		jsonTags = append(jsonTags, field.Name)
+	}
+	return jsonTags
+}
+
+// sqlField is a field of the class with its Go type, nil when unknown
+type sqlField struct {
+	Name string
+	Type reflect.Type
+}
+
+func sqlClassFields(class interface{}) []sqlField {
+	t := reflect.TypeOf(class)
+	id := sqlField{Name: "id"}
+	if field, found := t.FieldByName("ID"); found {
+		id.Type = field.Type
+	}
+	return sqlFields([]sqlField{id}, t, "")
+}
+
+// sqlFieldType returns the Go type of the field of the class, nil when unknown
+func sqlFieldType(class interface{}, name string) reflect.Type {
+	for _, field := range sqlClassFields(class) {
+		if field.Name == name {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// sqlClassField returns the quoted column of the field of the class
+func sqlClassField(class interface{}, name string) (string, error) {
+	for _, field := range SqlFields(class) {
+		if strings.ToLower(field) == strings.ToLower(name) {
+			return sqlIdentifier(field), nil
+		}
+	}
+	err := &ErrUnknownField{Field: name}
+	return "", err
+}
+
+func sqlFields(jsonTags []sqlField, fields reflect.Type, prefix string) []sqlField {
 	numFields := fields.NumField()
 	for i := 0; i < numFields; i++ {
-		if jsonTag := fields.Field(i).Tag.Get("json"); jsonTag != "" && jsonTag != "-" {
+		field := fields.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "-" {
+			continue
+		}
+		if embedded, ok := sqlEmbedded(field, jsonTag); ok {
+			jsonTags = sqlFields(jsonTags, embedded, prefix+gormSetting(field, "embeddedPrefix"))
+			continue
+		}
+		if jsonTag != "" {
 			if commaIdx := strings.Index(jsonTag, ","); commaIdx > 0 {
 				jsonTag = jsonTag[:commaIdx]
 			}
-			jsonTags = append(jsonTags, jsonTag)
+			jsonTags = append(jsonTags, sqlField{Name: prefix + jsonTag, Type: field.Type})
 		}
 	}
 	return jsonTags
 }
 
+// sqlCoerce converts a numeric value to the type of an integer or float field so
+// large integers are not bound as float64 and a boolean value to 0 or 1 for a bool
+// field as its tinyint column compares inconsistently to true and false, other
+// values are returned as is
+func sqlCoerce(value interface{}, t reflect.Type) (interface{}, error) {
+	if values, ok := sqlSlice(value); ok {
+		for i, v := range values {
+			c, err := sqlCoerce(v, t)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = c
+		}
+		return values, nil
+	}
+	if t != nil && (t.Kind() == reflect.Bool || t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Bool) {
+		return sqlCoerceBool(value)
+	}
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return value, nil
+	}
+	if t == nil {
+		t = reflect.TypeOf(value)
+	} else if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return nil, errors.New("expected an integer")
+		}
+		return i, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return nil, errors.New("expected an unsigned integer")
+		}
+		return u, nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return nil, errors.New("expected a number")
+		}
+		return f, nil
+	}
+	if n, ok := value.(json.Number); ok {
+		return n.String(), nil
+	}
+	return value, nil
+}
+
+// sqlCoerceBool converts true, false and their string or numeric forms to 1 or 0
+func sqlCoerceBool(value interface{}) (interface{}, error) {
+	var s string
+	switch v := value.(type) {
+	case bool:
+		s = strconv.FormatBool(v)
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		s = strconv.Itoa(v)
+	default:
+		return nil, errors.New("expected a boolean")
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, errors.New("expected a boolean")
+	}
+	if b {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// sqlEmbedded returns the struct type of the field when its columns are stored in the
+// table of the class: an anonymous struct without json name or a gorm embedded struct
+func sqlEmbedded(field reflect.StructField, jsonTag string) (reflect.Type, bool) {
+	t := field.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	if _, embedded := gormSettings(field)["embedded"]; embedded {
+		return t, true
+	}
+	if field.Anonymous && (jsonTag == "" || strings.HasPrefix(jsonTag, ",")) {
+		return t, true
+	}
+	return nil, false
+}
+
+func gormSetting(field reflect.StructField, name string) string {
+	return gormSettings(field)[strings.ToLower(name)]
+}
+
+// gormSettings parses the `gorm:"embedded;embeddedPrefix:ca_"` tag of the field
+func gormSettings(field reflect.StructField) map[string]string {
+	settings := make(map[string]string)
+	for _, setting := range strings.Split(field.Tag.Get("gorm"), ";") {
+		if setting = strings.TrimSpace(setting); setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, ":", 2)
+		if len(kv) == 2 {
+			settings[strings.ToLower(kv[0])] = kv[1]
+		} else {
+			settings[strings.ToLower(kv[0])] = ""
+		}
+	}
+	return settings
+}
+
 func (vars Vars) SqlSelect(class interface{}) (string, error) {
+	if MaxSelectFields > 0 && len(vars.Fields) > MaxSelectFields {
+		err := &ErrVarsLimit{Limit: "select field count", Max: MaxSelectFields}
+		return "", err
+	}
 	classFields := SqlFields(class)
 	if len(vars.Fields) == 0 { // SELECT *
 		selectFields := make([]string, 0)
 		for _, field := range classFields {
-			selectFields = append(selectFields, "`"+field+"`")
+			selectFields = append(selectFields, sqlIdentifier(field))
 		}
 		return strings.Join(selectFields[:], ","), nil
 	} else {
 		selectFields := make([]string, 0)
 		var valid bool = false
 		for _, field := range vars.Fields {
-			if strings.ToLower(field) == "id" {
-				selectFields = append(selectFields, "`id`")
+			if matches := sqlAggregate.FindStringSubmatch(field); matches != nil {
+				aggregate, err := SqlAggregate(class, matches[1], matches[2])
+				if err != nil {
+					return "", err
+				}
+				selectFields = append(selectFields, aggregate)
 			} else {
+				// id is part of the class fields, keep the order requested by the client
 				valid = false
 				for c, classField := range classFields {
 					if strings.ToLower(classField) == strings.ToLower(field) {
-						selectFields = append(selectFields, "`"+classField+"`")
+						selectFields = append(selectFields, sqlIdentifier(classField))
 						classFields = append(classFields[:c], classFields[c+1:]...) // pop to avoid reuse (unique)
 						valid = true
 						break
 					}
 				}
 				if valid == false {
-					err := errors.New("Unknown field `" + field + "`")
-					return "", err
+					name, column, ok, err := sqlJSONField(class, vars.JSONFields, field)
+					if err != nil {
+						return "", err
+					}
+					if !ok {
+						err := &ErrUnknownField{Field: field}
+						return "", err
+					}
+					selectFields = append(selectFields, column+" AS "+sqlIdentifier(name))
 				}
 			}
 		}
@@ -116,42 +573,368 @@ func (vars Vars) SqlSelect(class interface{}) (string, error) {
 	}
 }
 
-func (vars Vars) SqlOrder(class interface{}) (string, error) {
-	if len(vars.Sort) == 0 {
-		f, _ := reflect.TypeOf(vars).FieldByName("Sort")
-		vars.Sort = append(vars.Sort, f.Tag.Get("default"))
+// SqlAggregate returns the aggregate function applied to a known field of the class,
+// only `*` is accepted in place of a field and only for COUNT
+func SqlAggregate(class interface{}, function string, field string) (string, error) {
+	function = strings.ToUpper(function)
+	if field == "*" {
+		if function != "COUNT" {
+			err := &ErrUnknownField{Field: field, Aggregate: function}
+			return "", err
+		}
+		return "COUNT(*)", nil
+	}
+	for _, classField := range SqlFields(class) {
+		if strings.ToLower(classField) == strings.ToLower(field) {
+			return function + "(" + sqlIdentifier(classField) + ")", nil
+		}
 	}
+	err := &ErrUnknownField{Field: field}
+	return "", err
+}
+
+func (vars Vars) SqlGroup(class interface{}) (string, error) {
 	classFields := SqlFields(class)
+	groupFields := make([]string, 0)
+	var valid bool = false
+	for _, field := range vars.GroupBy {
+		valid = false
+		for c, classField := range classFields {
+			if strings.ToLower(classField) == strings.ToLower(field) {
+				groupFields = append(groupFields, sqlIdentifier(classField))
+				classFields = append(classFields[:c], classFields[c+1:]...) // pop to avoid reuse (unique)
+				valid = true
+				break
+			}
+		}
+		if valid == false {
+			err := &ErrUnknownField{Field: field}
+			return "", err
+		}
+	}
+	return strings.Join(groupFields, ","), nil
+}
+
+// SqlOrder returns the order clause, the parameters of the scores are only returned by Sql
+func (vars Vars) SqlOrder(class interface{}, defaultSort ...string) (string, error) {
+	order, _, err := vars.sqlOrder(class, defaultSort...)
+	return order, err
+}
+
+func (vars Vars) sqlOrder(class interface{}, defaultSort ...string) (string, []interface{}, error) {
+	sorts, err := vars.sqlSorts(class, defaultSort...)
+	if err != nil {
+		return "", nil, err
+	}
 	orderFields := make([]string, 0)
+	var values []interface{}
+	for _, sort := range sorts {
+		if sort.Score != nil {
+			orderFields = append(orderFields, sort.Score.Query+" "+sort.Order)
+			values = append(values, sort.Score.Values...)
+			continue
+		}
+		// portable equivalent of NULLS FIRST and NULLS LAST, false sorts before true
+		switch sort.Nulls {
+		case "FIRST":
+			orderFields = append(orderFields, sqlIdentifier(sort.Field)+" IS NOT NULL")
+		case "LAST":
+			orderFields = append(orderFields, sqlIdentifier(sort.Field)+" IS NULL")
+		}
+		orderFields = append(orderFields, sqlIdentifier(sort.Field)+" "+sort.Order)
+	}
+	return strings.Join(orderFields, ","), values, nil
+}
+
+// sqlSort is a validated sort field with its direction (ASC or DESC) and the
+// placement of its NULLs (FIRST, LAST or empty for the database default),
+// Score is set when the field is a score registered in Vars.Scores
+type sqlSort struct {
+	Field string
+	Order string
+	Nulls string
+	Score *Score
+}
+
+// sqlSortDirection parses the direction of a sort term, e.g. `desc` or `asc nulls last`
+func sqlSortDirection(direction string) (string, string, bool) {
+	order, nulls := "ASC", ""
+	words := strings.Split(strings.ToUpper(direction), " ")
+	if words[0] == "ASC" || words[0] == "DESC" {
+		order = words[0]
+		words = words[1:]
+	}
+	if len(words) == 2 && words[0] == "NULLS" && (words[1] == "FIRST" || words[1] == "LAST") {
+		nulls = words[1]
+		words = nil
+	}
+	return order, nulls, len(words) == 0
+}
+
+func (vars Vars) sqlSorts(class interface{}, defaultSort ...string) ([]sqlSort, error) {
+	if MaxSortTerms > 0 && len(vars.Sort) > MaxSortTerms {
+		err := &ErrVarsLimit{Limit: "sort term count", Max: MaxSortTerms}
+		return nil, err
+	}
+	if len(vars.Sort) == 0 {
+		if len(defaultSort) > 0 {
+			vars.Sort = append(vars.Sort, defaultSort...)
+		} else {
+			f, _ := reflect.TypeOf(vars).FieldByName("Sort")
+			vars.Sort = append(vars.Sort, f.Tag.Get("default"))
+		}
+	}
+	classFields := SqlFields(class)
+	sorts := make([]sqlSort, 0)
 	var valid bool = false
 	for _, sort := range vars.Sort {
 		s := strings.Split(sort, " ")
 		field := s[0]
-		order := "ASC"
+		order, nulls := "ASC", ""
 		if len(s) > 1 {
-			if matched, _ := regexp.MatchString(`(?i)desc`, s[1]); matched {
-				order = "DESC"
+			direction := strings.Join(s[1:], " ")
+			var ok bool
+			if order, nulls, ok = sqlSortDirection(direction); !ok {
+				err := &ErrInvalidSortDirection{Field: field, Direction: direction}
+				return nil, err
 			}
 		}
 		if strings.ToLower(field) == "id" {
-			orderFields = append(orderFields, "`id` "+order)
+			sorts = append(sorts, sqlSort{Field: "id", Order: order, Nulls: nulls})
 		} else {
 			valid = false
 			for c, classField := range classFields {
 				if strings.ToLower(classField) == strings.ToLower(field) {
-					orderFields = append(orderFields, "`"+classField+"` "+order)
+					sorts = append(sorts, sqlSort{Field: classField, Order: order, Nulls: nulls})
 					classFields = append(classFields[:c], classFields[c+1:]...) // pop to avoid reuse (unique)
 					valid = true
 					break
 				}
 			}
 			if valid == false {
-				err := errors.New("Unknown field `" + field + "`")
-				return "", err
+				for name, score := range vars.Scores {
+					if strings.ToLower(name) == strings.ToLower(field) {
+						if nulls != "" {
+							err := errors.New("The score `" + name + "` cannot be sorted with NULLS " + nulls)
+							return nil, err
+						}
+						score := score
+						sorts = append(sorts, sqlSort{Field: name, Order: order, Score: &score})
+						valid = true
+						break
+					}
+				}
+			}
+			if valid == false {
+				err := &ErrUnknownField{Field: field}
+				return nil, err
 			}
 		}
 	}
-	return strings.Join(orderFields, ","), nil
+	return sorts, nil
+}
+
+// Stream reads all the rows of the search in batches of size rows with keyset pagination,
+// so an export neither holds the whole result nor makes the database scan a huge OFFSET.
+// batch runs the statement of vars.Sql for each batch and returns its rows, the rows
+// are streamed until a batch is shorter than size. The id is appended to the sort
+// when missing so the key of each row is unique and no row is skipped or repeated.
+func Stream[T any](vars Vars, size int, batch func(vars Vars) ([]T, error), defaultSort ...string) error {
+	var class T
+	if size <= 0 {
+		err := errors.New("Stream requires a positive batch size")
+		return err
+	}
+	sorts, err := vars.sqlSorts(class, defaultSort...)
+	if err != nil {
+		return err
+	}
+	unique := false
+	vars.Sort = make([]string, 0, len(sorts)+1)
+	for _, sort := range sorts {
+		if sort.Score != nil {
+			err = errors.New("Keyset pagination cannot sort on the score `" + sort.Field + "`")
+			return err
+		}
+		if sort.Nulls != "" {
+			err = errors.New("Keyset pagination cannot sort `" + sort.Field + "` with NULLS " + sort.Nulls)
+			return err
+		}
+		unique = unique || sort.Field == "id"
+		vars.Sort = append(vars.Sort, sort.Field+" "+sort.Order)
+	}
+	if !unique {
+		sorts = append(sorts, sqlSort{Field: "id", Order: "ASC"})
+		vars.Sort = append(vars.Sort, "id ASC")
+	}
+	vars.Cursor = 0
+	vars.Limit = size
+	vars.After = nil
+	for {
+		rows, err := batch(vars)
+		if err != nil {
+			return err
+		}
+		if len(rows) < size {
+			return nil
+		}
+		if vars.After, err = sqlKeysetValues(rows[len(rows)-1], sorts); err != nil {
+			return err
+		}
+	}
+}
+
+// sqlKeysetValues returns the values of the sort fields of the row in the format of vars.After
+func sqlKeysetValues(row interface{}, sorts []sqlSort) ([]string, error) {
+	v := reflect.Indirect(reflect.ValueOf(row))
+	values := make([]string, 0, len(sorts))
+	for _, sort := range sorts {
+		value, ok := sqlFieldValue(v, sort.Field, "")
+		if !ok {
+			err := &ErrUnknownField{Field: sort.Field}
+			return nil, err
+		}
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				err := errors.New("Keyset pagination cannot resume after the NULL `" + sort.Field + "`")
+				return nil, err
+			}
+			value = value.Elem()
+		}
+		switch v := value.Interface().(type) {
+		case time.Time:
+			values = append(values, v.Format("2006-01-02 15:04:05.999999"))
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	return values, nil
+}
+
+// sqlFieldValue returns the value of the field of the row, the fields are named like in sqlClassFields
+func sqlFieldValue(v reflect.Value, name string, prefix string) (reflect.Value, bool) {
+	if prefix == "" && name == "id" {
+		if id := v.FieldByName("ID"); id.IsValid() {
+			return id, true
+		}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "-" {
+			continue
+		}
+		if _, ok := sqlEmbedded(field, jsonTag); ok {
+			embedded := v.Field(i)
+			if embedded.Kind() == reflect.Ptr {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if value, ok := sqlFieldValue(embedded, name, prefix+gormSetting(field, "embeddedPrefix")); ok {
+				return value, true
+			}
+			continue
+		}
+		if commaIdx := strings.Index(jsonTag, ","); commaIdx > 0 {
+			jsonTag = jsonTag[:commaIdx]
+		}
+		if jsonTag != "" && prefix+jsonTag == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// SqlKeyset returns the keyset (cursor) pagination predicate for the rows following
+// vars.After, the last seen values of the sort fields in the same order as the sort.
+// Unlike OFFSET, which makes the database scan and discard all the previous rows,
+// the predicate can use an index on the sort fields so deep pages stay cheap.
+// The tradeoff is that pages can only be walked forward from a known row and the
+// sort must be unique (add `id` as the last sort field) to avoid skipping rows.
+func (vars Vars) SqlKeyset(class interface{}, defaultSort ...string) (Where, error) {
+	var where Where
+	if len(vars.After) == 0 {
+		return where, nil
+	}
+	sorts, err := vars.sqlSorts(class, defaultSort...)
+	if err != nil {
+		return Where{}, err
+	}
+	if len(vars.After) != len(sorts) {
+		err = errors.New("Keyset pagination requires one value per sort field")
+		return Where{}, err
+	}
+	for _, sort := range sorts {
+		if sort.Score != nil {
+			err = errors.New("Keyset pagination cannot sort on the score `" + sort.Field + "`")
+			return Where{}, err
+		}
+		if sort.Nulls != "" {
+			err = errors.New("Keyset pagination cannot sort `" + sort.Field + "` with NULLS " + sort.Nulls)
+			return Where{}, err
+		}
+	}
+	// (a > ?) OR (a = ? AND b > ?) OR ...
+	children := make([]string, 0)
+	for i, sort := range sorts {
+		conditions := make([]string, 0)
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, sqlIdentifier(sorts[j].Field)+" = ?")
+			where.Values = append(where.Values, vars.After[j])
+		}
+		if sort.Order == "DESC" {
+			conditions = append(conditions, sqlIdentifier(sort.Field)+" < ?")
+		} else {
+			conditions = append(conditions, sqlIdentifier(sort.Field)+" > ?")
+		}
+		where.Values = append(where.Values, vars.After[i])
+		children = append(children, "("+strings.Join(conditions, " AND ")+")")
+	}
+	where.Query = fmt.Sprintf("(%s)", strings.Join(children, " OR "))
+	return where, nil
+}
+
+// UpdatedSince returns vars restricted to the rows whose time field is after since,
+// sorted on the field ascending so a sync can resume from the last value it read.
+// The search of vars is kept and ANDed with the restriction.
+func (vars Vars) UpdatedSince(class interface{}, field string, since time.Time) (Vars, error) {
+	t := sqlFieldType(class, field)
+	if t == nil {
+		err := &ErrUnknownField{Field: field}
+		return Vars{}, err
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != reflect.TypeOf(time.Time{}) {
+		err := &ErrFieldType{Field: field, Expected: "a time"}
+		return Vars{}, err
+	}
+	updated := Search{Field: field, Op: "greater_than", Value: since}
+	if reflect.DeepEqual(vars.Query, Search{}) {
+		vars.Query = updated
+	} else {
+		vars.Query = Search{Op: "and", Values: []Search{vars.Query, updated}}
+	}
+	vars.Sort = []string{field + " ASC"}
+	return vars, nil
+}
+
+// And combines both where clauses, an empty clause is ignored
+func (where Where) And(other Where) Where {
+	if other.Query == "" {
+		return where
+	}
+	if where.Query == "" {
+		return other
+	}
+	return Where{
+		Query:  fmt.Sprintf("(%s) AND (%s)", where.Query, other.Query),
+		Values: append(append([]interface{}{}, where.Values...), other.Values...),
+	}
 }
 
 func (vars Vars) SqlOffset() (int, error) {
@@ -164,6 +947,9 @@ func (vars Vars) SqlOffset() (int, error) {
 			return 0, err
 		}
 		return defaultCursor, nil
+	} else if MaxOffset > 0 && vars.Cursor > MaxOffset {
+		err = &ErrOffsetLimit{Offset: vars.Cursor, Max: MaxOffset}
+		return 0, err
 	} else {
 		return vars.Cursor, nil
 	}
@@ -183,21 +969,60 @@ func (vars Vars) SqlLimit() (int, error) {
 	}
 }
 
+// sqlWhereOptions are the server side settings of the Vars applied to the search
+type sqlWhereOptions struct {
+	operators        map[string][]string
+	defaultOperators map[string]string
+	jsonFields       map[string]JSONField
+	collations       map[string]string
+	virtualFields    map[string]VirtualField
+}
+
 func (search Search) SqlWhere(class interface{}) (Where, error) {
+	return search.sqlWhereOptions(class, sqlWhereOptions{})
+}
+
+func (search Search) sqlWhereOptions(class interface{}, options sqlWhereOptions) (Where, error) {
+	nodes := 0
+	return search.sqlWhere(class, 0, &nodes, options)
+}
+
+func (search Search) sqlWhere(class interface{}, depth int, nodes *int, options sqlWhereOptions) (Where, error) {
 	if reflect.DeepEqual(search, Search{}) {
 		return Where{}, nil
 	}
+	if depth > MaxSearchDepth {
+		return Where{}, &ErrSearchLimit{Limit: "depth", Max: MaxSearchDepth}
+	}
+	*nodes++
+	if *nodes > MaxSearchNodes {
+		return Where{}, &ErrSearchLimit{Limit: "node count", Max: MaxSearchNodes}
+	}
 	var where Where
 	var err error
+	if strings.ToLower(search.Op) == "not" {
+		if len(search.Values) != 1 {
+			err = &ErrInvalidValue{Op: search.Op, Reason: "expected exactly one value"}
+			return Where{}, err
+		}
+		child, err := search.Values[0].sqlWhere(class, depth+1, nodes, options)
+		if err != nil {
+			return Where{}, err
+		}
+		if child.Query != "" {
+			where.Query = fmt.Sprintf("NOT (%s)", child.Query)
+			where.Values = child.Values
+		}
+		return where, nil
+	}
 	if len(search.Values) > 0 {
 		if len(search.Values) == 1 {
-			where, err = search.Values[0].SqlWhere(class)
-			return where, nil
+			return search.Values[0].sqlWhere(class, depth+1, nodes, options)
 		} else if search.Op != "" {
 			if matched, _ := regexp.MatchString(`(?i)(and|or)`, search.Op); matched {
 				children := make([]string, 0)
 				for _, value := range search.Values {
-					w, err := value.SqlWhere(class)
+					w, err := value.sqlWhere(class, depth+1, nodes, options)
 					if err != nil {
 						return Where{}, err
 					}
@@ -215,70 +1040,487 @@ func (search Search) SqlWhere(class interface{}) (Where, error) {
 					case "or":
 						where.Query = fmt.Sprintf("(%s)", strings.Join(children[:], " OR "))
 					default:
-						err = errors.New("Unknown operator `" + search.Op + "`")
+						err = &ErrUnknownOperator{Op: search.Op}
 						return Where{}, err
 					}
 				}
+			} else {
+				err = &ErrUnknownOperator{Op: search.Op}
+				return Where{}, err
 			}
 		}
 	} else {
+		if strings.TrimSpace(search.Field) == "" {
+			err = &ErrFieldRequired{Op: search.Op}
+			return Where{}, err
+		}
 		classFields := SqlFields(class)
 		var valid bool = false
+		var column string
+		var virtual VirtualField
 		for _, classField := range classFields {
 			if strings.ToLower(classField) == strings.ToLower(search.Field) {
 				search.Field = classField
+				column = sqlIdentifier(classField)
 				valid = true
 				break
 			}
 		}
 		if valid == false {
-			err = errors.New("Unknown field `" + search.Field + "`")
+			var name string
+			if name, column, valid, err = sqlJSONField(class, options.jsonFields, search.Field); err != nil {
+				return Where{}, err
+			}
+			if valid == false {
+				name, virtual, valid = sqlVirtualField(options.virtualFields, search.Field)
+			}
+			if valid == false {
+				err = &ErrUnknownField{Field: search.Field}
+				return Where{}, err
+			}
+			search.Field = name
+		}
+		if search.Op == "" {
+			op, ok := sqlDefaultOperator(options.defaultOperators, search.Field)
+			if !ok {
+				err = &ErrOperatorRequired{Field: search.Field}
+				return Where{}, err
+			}
+			search.Op = op
+		}
+		search.Op = sqlOperatorAlias(search.Op)
+		if !sqlOperatorAllowed(options.operators, search.Field, search.Op) {
+			err = &ErrOperatorNotAllowed{Field: search.Field, Op: search.Op}
+			return Where{}, err
+		}
+		if virtual != nil {
+			return virtual.sqlWhere(search)
+		}
+		collation, err := sqlCollation(search, options.collations)
+		if err != nil {
 			return Where{}, err
 		}
+		placeholder := "?"
+		if collation != "" {
+			placeholder = "? COLLATE " + collation
+		}
 		if search.Value != "" {
+			values, err := search.sqlValues(sqlFieldType(class, search.Field))
+			if err != nil {
+				return Where{}, err
+			}
 			switch strings.ToLower(search.Op) {
 			case "equals":
-				where.Query = "`" + search.Field + "` = ?"
-				where.Values = append(where.Values, search.Value)
+				if _, ok := sqlSlice(search.Value); ok {
+					where.Query = column + " IN (" + placeholder + strings.Repeat(","+placeholder, len(values)-1) + ")"
+				} else {
+					where.Query = column + " = " + placeholder
+				}
+			case "iequals":
+				// Collation independent, but LOWER() on the column prevents the use of an index
+				where.Query = "LOWER(" + column + ") = LOWER(" + placeholder + ")"
 			case "not_equals":
-				where.Query = "`" + search.Field + "` != ?"
-				where.Values = append(where.Values, search.Value)
-			case "starts_with":
-				where.Query = "`" + search.Field + "` LIKE ?"
-				where.Values = append(where.Values, search.Value.(string)+"%")
-			case "ends_with":
-				where.Query = "`" + search.Field + "` LIKE ?"
-				where.Values = append(where.Values, "%"+search.Value.(string))
-			case "contains":
-				where.Query = "`" + search.Field + "` LIKE ?"
-				where.Values = append(where.Values, "%"+search.Value.(string)+"%")
+				// Standard SQL, the rows where the column is NULL never match
+				where.Query = column + " != " + placeholder
+			case "not_equals_or_null":
+				// Unlike not_equals, the rows where the column is NULL match as well
+				where.Query = "(" + column + " != " + placeholder + " OR " + column + " IS NULL)"
+			case "field_equals":
+				// The value names another field of the class, compared without any bound value
+				other, ok := search.Value.(string)
+				if !ok {
+					err = &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected a field name"}
+					return Where{}, err
+				}
+				otherColumn, err := sqlClassField(class, other)
+				if err != nil {
+					return Where{}, err
+				}
+				where.Query = column + " = " + otherColumn
+				if collation != "" {
+					where.Query += " COLLATE " + collation
+				}
+			case "starts_with", "ends_with", "contains", "like":
+				where.Query = column + " LIKE " + placeholder
+			case "not_contains", "not_starts_with", "not_ends_with":
+				where.Query = column + " NOT LIKE " + placeholder
 			case "greater_than":
-				where.Query = "`" + search.Field + "` > ?"
-				where.Values = append(where.Values, search.Value)
+				where.Query = column + " > " + placeholder
 			case "greater_than_equals":
-				where.Query = "`" + search.Field + "` >= ?"
-				where.Values = append(where.Values, search.Value)
+				where.Query = column + " >= " + placeholder
 			case "less_than":
-				where.Query = "`" + search.Field + "` < ?"
-				where.Values = append(where.Values, search.Value)
+				where.Query = column + " < " + placeholder
 			case "less_than_equals":
-				where.Query = "`" + search.Field + "` <= ?"
-				where.Values = append(where.Values, search.Value)
-			default:
-				err = errors.New("Unknown operator `" + search.Op + "`")
-				return Where{}, err
+				where.Query = column + " <= " + placeholder
+			case "between":
+				where.Query = column + " BETWEEN " + placeholder + " AND " + placeholder
+			case "not_between":
+				where.Query = column + " NOT BETWEEN " + placeholder + " AND " + placeholder
+			}
+			where.Values = append(where.Values, values...)
+		}
+	}
+	return where, nil
+}
+
+// sqlValues returns the values bound by the leaf search on a column of the Go type t
+func (search Search) sqlValues(t reflect.Type) ([]interface{}, error) {
+	var err error
+	switch strings.ToLower(search.Op) {
+	case "equals", "not_equals", "not_equals_or_null", "greater_than", "greater_than_equals", "less_than", "less_than_equals", "between", "not_between":
+		if search.Value, err = sqlCoerce(search.Value, t); err != nil {
+			err = &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: err.Error()}
+			return nil, err
+		}
+	}
+	switch strings.ToLower(search.Op) {
+	case "equals":
+		if values, ok := sqlSlice(search.Value); ok {
+			if len(values) == 0 {
+				err = &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected at least one value"}
+				return nil, err
+			}
+			return values, nil
+		}
+		return []interface{}{search.Value}, nil
+	case "iequals", "not_equals", "not_equals_or_null", "greater_than", "greater_than_equals", "less_than", "less_than_equals":
+		return []interface{}{search.Value}, nil
+	case "field_equals":
+		return nil, nil
+	case "starts_with", "ends_with", "contains", "not_contains", "not_starts_with", "not_ends_with":
+		value, ok := search.Value.(string)
+		if !ok {
+			err = &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected a string"}
+			return nil, err
+		}
+		value = escapeLike(value)
+		switch strings.ToLower(search.Op) {
+		case "starts_with", "not_starts_with":
+			return []interface{}{value + "%"}, nil
+		case "ends_with", "not_ends_with":
+			return []interface{}{"%" + value}, nil
+		}
+		return []interface{}{"%" + value + "%"}, nil
+	case "like":
+		// The pattern is used as is, the caller is responsible for the % and _ wildcards.
+		// It is still bound as a parameter so it cannot inject SQL.
+		value, ok := search.Value.(string)
+		if !ok {
+			err = &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected a string"}
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	case "between", "not_between":
+		return sqlRange(search)
+	}
+	err = &ErrUnknownOperator{Op: search.Op}
+	return nil, err
+}
+
+// sqlMatches returns the select expressions reporting the fields of the top level OR
+// search matched by a row, along with their values
+func (vars Vars) sqlMatches(class interface{}) (string, []interface{}, error) {
+	fields, groups := vars.Query.sqlMatchGroups()
+	options := vars.whereOptions()
+	columns := make([]string, 0, len(fields))
+	var values []interface{}
+	for _, field := range fields {
+		predicates := make([]string, 0)
+		for _, search := range groups[field] {
+			where, err := search.sqlWhereOptions(class, options)
+			if err != nil {
+				return "", nil, err
+			}
+			if where.Query != "" {
+				predicates = append(predicates, where.Query)
+				values = append(values, where.Values...)
+			}
+		}
+		if len(predicates) > 0 {
+			columns = append(columns, "CASE WHEN "+strings.Join(predicates, " OR ")+" THEN "+sqlLiteral(field)+" END AS "+sqlIdentifier("matched_"+field))
+		}
+	}
+	return strings.Join(columns, ","), values, nil
+}
+
+// sqlMatchGroups returns the fields of the leaves of a top level OR search, in the order
+// of their first appearance, along with the leaves of each field
+func (search Search) sqlMatchGroups() ([]string, map[string][]Search) {
+	fields := make([]string, 0)
+	groups := make(map[string][]Search)
+	if strings.ToLower(search.Op) != "or" {
+		return fields, groups
+	}
+	for _, value := range search.Values {
+		if len(value.Values) > 0 || strings.TrimSpace(value.Field) == "" {
+			continue
+		}
+		field := strings.ToLower(value.Field)
+		if _, found := groups[field]; !found {
+			fields = append(fields, field)
+		}
+		groups[field] = append(groups[field], value)
+	}
+	return fields, groups
+}
+
+// SearchAny returns the search matching the rows where any of the fields contains the term
+func SearchAny(term string, fields ...string) Search {
+	search := Search{Op: "or"}
+	for _, field := range fields {
+		search.Values = append(search.Values, Search{Field: field, Op: "contains", Value: term})
+	}
+	return search
+}
+
+// Relevance returns the score ranking the exact matches of the term on the field first,
+// then the prefix matches and then the other matches, sort it DESC.
+// The field is a trusted column name of the class.
+func Relevance(field string, term string) Score {
+	value := escapeLike(term)
+	column := sqlIdentifier(field)
+	return Score{
+		Query:  "CASE WHEN " + column + " = ? THEN 3 WHEN " + column + " LIKE ? THEN 2 WHEN " + column + " LIKE ? THEN 1 ELSE 0 END",
+		Values: []interface{}{term, value + "%", "%" + value + "%"},
+	}
+}
+
+// SqlWhereAny returns the where clause matching the rows where any of the fields contains the term
+func SqlWhereAny(class interface{}, term string, fields ...string) (Where, error) {
+	return SearchAny(term, fields...).SqlWhere(class)
+}
+
+// sqlJSONField returns the name and the expression of the JSON field registered as field
+func sqlJSONField(class interface{}, jsonFields map[string]JSONField, field string) (string, string, bool, error) {
+	for name, jsonField := range jsonFields {
+		if strings.ToLower(name) != strings.ToLower(field) {
+			continue
+		}
+		column, err := jsonField.sql(class)
+		if err != nil {
+			return "", "", false, err
+		}
+		return name, column, true, nil
+	}
+	return "", "", false, nil
+}
+
+// sql returns the expression extracting the unquoted value of the JSON field
+func (jsonField JSONField) sql(class interface{}) (string, error) {
+	if !sqlJSONPath.MatchString(jsonField.Path) {
+		err := &ErrInvalidJSONPath{Column: jsonField.Column, Path: jsonField.Path}
+		return "", err
+	}
+	for _, classField := range SqlFields(class) {
+		if strings.ToLower(classField) == strings.ToLower(jsonField.Column) {
+			return "JSON_UNQUOTE(JSON_EXTRACT(" + sqlIdentifier(classField) + ", '" + jsonField.Path + "'))", nil
+		}
+	}
+	err := &ErrUnknownField{Field: jsonField.Column}
+	return "", err
+}
+
+// sqlOperatorAllowed reports if the operator can be used on the field
+func sqlOperatorAllowed(operators map[string][]string, field string, op string) bool {
+	for restricted, allowed := range operators {
+		if strings.ToLower(restricted) != strings.ToLower(field) {
+			continue
+		}
+		for _, a := range allowed {
+			if strings.ToLower(a) == strings.ToLower(op) {
+				return true
 			}
 		}
+		return false
+	}
+	return true
+}
+
+// sqlOperatorAlias returns the canonical operator of the alias op, op itself when it is not one
+func sqlOperatorAlias(op string) string {
+	if canonical, ok := SqlOperatorAliases[strings.ToLower(op)]; ok {
+		return canonical
+	}
+	return op
+}
+
+// sqlDefaultOperator returns the operator of the searches on the field without one
+func sqlDefaultOperator(defaultOperators map[string]string, field string) (string, bool) {
+	for name, op := range defaultOperators {
+		if strings.ToLower(name) == strings.ToLower(field) {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// sqlVirtualField returns the name and the predicates of the virtual field registered as field
+func sqlVirtualField(virtualFields map[string]VirtualField, field string) (string, VirtualField, bool) {
+	for name, virtual := range virtualFields {
+		if strings.ToLower(name) == strings.ToLower(field) {
+			return name, virtual, true
+		}
+	}
+	return "", nil, false
+}
+
+func (virtual VirtualField) sqlWhere(search Search) (Where, error) {
+	var where Where
+	if search.Value == "" {
+		return where, nil
+	}
+	values, ok := sqlSlice(search.Value)
+	if !ok {
+		values = []interface{}{search.Value}
+	}
+	if len(values) == 0 {
+		err := &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected at least one value"}
+		return Where{}, err
+	}
+	children := make([]string, 0)
+	for _, value := range values {
+		predicate, found := Where{}, false
+		if s, ok := value.(string); ok {
+			for v, w := range virtual {
+				if strings.ToLower(v) == strings.ToLower(s) {
+					predicate, found = w, true
+					break
+				}
+			}
+		}
+		if !found {
+			err := &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "unknown value " + searchLiteral(value)}
+			return Where{}, err
+		}
+		children = append(children, "("+predicate.Query+")")
+		where.Values = append(where.Values, predicate.Values...)
+	}
+	switch strings.ToLower(search.Op) {
+	case "equals":
+		where.Query = fmt.Sprintf("(%s)", strings.Join(children, " OR "))
+	case "not_equals":
+		if len(children) != 1 {
+			err := &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected exactly one value"}
+			return Where{}, err
+		}
+		where.Query = fmt.Sprintf("NOT %s", children[0])
+	default:
+		err := &ErrOperatorNotAllowed{Field: search.Field, Op: search.Op}
+		return Where{}, err
 	}
 	return where, nil
 }
 
+// sqlCollation returns the collation of the search, or of its field when the search has none
+func sqlCollation(search Search, collations map[string]string) (string, error) {
+	collation := search.Collation
+	if collation == "" {
+		for field, c := range collations {
+			if strings.ToLower(field) == strings.ToLower(search.Field) {
+				collation = c
+				break
+			}
+		}
+	}
+	if collation == "" {
+		return "", nil
+	}
+	for _, allowed := range SqlCollations {
+		if strings.ToLower(allowed) == strings.ToLower(collation) {
+			return allowed, nil
+		}
+	}
+	err := &ErrUnknownCollation{Collation: collation}
+	return "", err
+}
+
+// sqlRange returns the lower and upper bounds of a between search
+func sqlRange(search Search) ([]interface{}, error) {
+	values, ok := sqlSlice(search.Value)
+	if !ok || len(values) != 2 {
+		err := &ErrInvalidValue{Field: search.Field, Op: search.Op, Reason: "expected exactly two values"}
+		return nil, err
+	}
+	return values, nil
+}
+
+// sqlSlice returns the elements of value when it is a slice or an array
+func sqlSlice(value interface{}) ([]interface{}, bool) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, false
+	}
+	values := make([]interface{}, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		values[i] = v.Index(i).Interface()
+	}
+	return values, true
+}
+
+// escapeLike escapes the LIKE wildcards so the value is matched literally
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// String returns the canonical human readable form of the search,
+// e.g. `(cn contains "foo" AND mail equals "bar")`, it is only meant for display
+func (search Search) String() string {
+	if reflect.DeepEqual(search, Search{}) {
+		return ""
+	}
+	if strings.ToLower(search.Op) == "not" {
+		children := make([]string, 0)
+		for _, value := range search.Values {
+			children = append(children, value.String())
+		}
+		return "NOT (" + strings.Join(children, ", ") + ")"
+	}
+	if len(search.Values) == 1 {
+		return search.Values[0].String()
+	}
+	if len(search.Values) > 0 {
+		children := make([]string, 0)
+		for _, value := range search.Values {
+			if child := value.String(); child != "" {
+				children = append(children, child)
+			}
+		}
+		return "(" + strings.Join(children, " "+strings.ToUpper(search.Op)+" ") + ")"
+	}
+	return search.Field + " " + strings.ToLower(search.Op) + " " + searchLiteral(search.Value)
+}
+
+func searchLiteral(value interface{}) string {
+	if values, ok := sqlSlice(value); ok {
+		literals := make([]string, 0)
+		for _, v := range values {
+			literals = append(literals, searchLiteral(v))
+		}
+		return "[" + strings.Join(literals, ", ") + "]"
+	}
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return strconv.Quote(v.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
 func (vars *Vars) DecodeBodyJson(req *http.Request) error {
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(body, &vars); err != nil {
+	// keep the numbers as json.Number, large integers do not fit in a float64
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&vars); err != nil {
 		return err
 	}
 	return nil
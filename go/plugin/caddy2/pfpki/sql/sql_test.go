@@ -0,0 +1,1354 @@
+package sql
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	ID           uint      `gorm:"primarykey"`
+	CreatedAt    time.Time `json:"-"`
+	Cn           string    `json:"cn,omitempty"`
+	Mail         string    `json:"mail,omitempty"`
+	CaID         uint      `json:"ca_id,omitempty"`
+	ProfileID    uint      `json:"profile_id,omitempty,string"`
+	ValidUntil   time.Time `json:"valid_until,omitempty"`
+	NotBefore    time.Time `json:"not_before,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+}
+
+func (testCert) TableName() string {
+	return "pki_certs"
+}
+
+func TestSqlGroupCount(t *testing.T) {
+	vars := Vars{
+		Fields:  []string{"ca_id", "count(*)", "MAX(not_before)"},
+		GroupBy: []string{"ca_id"},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Select != "`ca_id`,COUNT(*),MAX(`not_before`)" {
+		t.Errorf("Unexpected select %s", sql.Select)
+	}
+	if sql.Group != "`ca_id`" {
+		t.Errorf("Unexpected group %s", sql.Group)
+	}
+}
+
+func TestSqlSelectOrder(t *testing.T) {
+	tests := []struct {
+		fields   []string
+		expected string
+	}{
+		{fields: []string{"serial_number", "id", "cn"}, expected: "`serial_number`,`id`,`cn`"},
+		{fields: []string{"cn", "serial_number", "id"}, expected: "`cn`,`serial_number`,`id`"},
+		{fields: []string{"not_before", "COUNT(*)", "ca_id"}, expected: "`not_before`,COUNT(*),`ca_id`"},
+	}
+	for _, test := range tests {
+		vars := Vars{Fields: test.fields}
+		selectFields, err := vars.SqlSelect(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", test.fields, err)
+		}
+		if selectFields != test.expected {
+			t.Errorf("Expected %s for %v, got %s", test.expected, test.fields, selectFields)
+		}
+	}
+}
+
+func TestSqlGroupInvalid(t *testing.T) {
+	tests := []Vars{
+		{Fields: []string{"ca_id"}, GroupBy: []string{"unknown"}},
+		{Fields: []string{"SUM(ca_id)"}},
+		{Fields: []string{"MAX(*)"}},
+		{Fields: []string{"COUNT(unknown)"}},
+		{Fields: []string{"COUNT(ca_id) FROM certs; --"}},
+	}
+	for _, vars := range tests {
+		if _, err := vars.Sql(testCert{}); err == nil {
+			t.Errorf("Expected an error for %v", vars)
+		}
+	}
+}
+
+func TestSqlWhereNotContains(t *testing.T) {
+	search := Search{Field: "cn", Op: "not_contains", Value: "te%st"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`cn` NOT LIKE ?" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 1 || where.Values[0] != `%te\%st%` {
+		t.Errorf("Unexpected values %v", where.Values)
+	}
+
+	search = Search{Field: "cn", Op: "not_contains", Value: 1}
+	if _, err := search.SqlWhere(testCert{}); err == nil {
+		t.Errorf("Expected an error for a non string value")
+	}
+
+	search = Search{Field: "unknown", Op: "not_contains", Value: "test"}
+	if _, err := search.SqlWhere(testCert{}); err == nil {
+		t.Errorf("Expected an error for an unknown field")
+	}
+}
+
+func TestSqlWhereNotStartsEndsWith(t *testing.T) {
+	for op, expected := range map[string]string{"not_starts_with": `te\_st%`, "not_ends_with": `%te\_st`} {
+		search := Search{Field: "CN", Op: op, Value: "te_st"}
+		where, err := search.SqlWhere(testCert{})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", op, err)
+		}
+		if where.Query != "`cn` NOT LIKE ?" || len(where.Values) != 1 || where.Values[0] != expected {
+			t.Errorf("%s: Expected the rows matching %s to be excluded, got %s %v", op, expected, where.Query, where.Values)
+		}
+
+		search = Search{Field: "cn", Op: op, Value: 1}
+		var invalid *ErrInvalidValue
+		if _, err := search.SqlWhere(testCert{}); !errors.As(err, &invalid) {
+			t.Errorf("%s: Expected an invalid value error for a non string value, got %v", op, err)
+		}
+
+		search = Search{Field: "unknown", Op: op, Value: "test"}
+		var unknown *ErrUnknownField
+		if _, err := search.SqlWhere(testCert{}); !errors.As(err, &unknown) {
+			t.Errorf("%s: Expected an unknown field error, got %v", op, err)
+		}
+	}
+}
+
+func TestSqlMatchedFields(t *testing.T) {
+	vars := Vars{
+		Fields: []string{"id", "cn"},
+		Query: Search{Op: "or", Values: []Search{
+			{Field: "cn", Op: "contains", Value: "alice"},
+			{Field: "Mail", Op: "starts_with", Value: "alice"},
+			{Field: "cn", Op: "equals", Value: "bob"},
+			{Op: "and", Values: []Search{{Field: "ca_id", Op: "equals", Value: 1}, {Field: "profile_id", Op: "equals", Value: 2}}},
+		}},
+		MatchedFields: true,
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "`id`,`cn`,CASE WHEN `cn` LIKE ? OR `cn` = ? THEN 'cn' END AS `matched_cn`,CASE WHEN `mail` LIKE ? THEN 'mail' END AS `matched_mail`"
+	if sql.Select != expected {
+		t.Errorf("Expected the match indicators %s, got %s", expected, sql.Select)
+	}
+	if !reflect.DeepEqual(sql.SelectValues, []interface{}{"%alice%", "bob", "alice%"}) {
+		t.Errorf("Unexpected select values %#v", sql.SelectValues)
+	}
+	query, values := sql.Statement("certs")
+	if strings.Count(query, "?") != len(values) || values[0] != "%alice%" || values[3] != "%alice%" {
+		t.Errorf("Expected the select values before the where values, got %s %#v", query, values)
+	}
+
+	cache := NewSqlCache(0)
+	for i := 0; i < 2; i++ {
+		cached, err := cache.Sql(vars, testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(cached, sql) {
+			t.Errorf("Expected the same statement from the cache, got %#v", cached)
+		}
+	}
+
+	vars.MatchedFields = false
+	if sql, err := vars.Sql(testCert{}); err != nil || sql.Select != "`id`,`cn`" || sql.SelectValues != nil {
+		t.Errorf("Expected no match indicators unless enabled, got %s %#v (%v)", sql.Select, sql.SelectValues, err)
+	}
+}
+
+func TestSqlWhereNot(t *testing.T) {
+	search := Search{
+		Op: "and",
+		Values: []Search{
+			{Field: "mail", Op: "not_equals", Value: "revoked"},
+			{
+				Op: "not",
+				Values: []Search{
+					{
+						Op: "and",
+						Values: []Search{
+							{Field: "cn", Op: "starts_with", Value: "test"},
+							{Field: "ca_id", Op: "equals", Value: 1},
+						},
+					},
+				},
+			},
+		},
+	}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "(`mail` != ? AND NOT ((`cn` LIKE ? AND `ca_id` = ?)))" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 3 || where.Values[0] != "revoked" || where.Values[1] != "test%" || where.Values[2] != 1 {
+		t.Errorf("Unexpected values %v", where.Values)
+	}
+
+	for _, values := range [][]Search{
+		nil,
+		{{Field: "cn", Op: "equals", Value: "a"}, {Field: "cn", Op: "equals", Value: "b"}},
+	} {
+		search := Search{Op: "not", Values: values}
+		if _, err := search.SqlWhere(testCert{}); err == nil {
+			t.Errorf("Expected an error for `not` with %d values", len(values))
+		}
+	}
+}
+
+func TestSqlOrderDefault(t *testing.T) {
+	vars := Vars{}
+	order, err := vars.SqlOrder(testCert{}, "not_before DESC")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if order != "`not_before` DESC" {
+		t.Errorf("Unexpected order %s", order)
+	}
+
+	order, err = vars.SqlOrder(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if order != "`id` ASC" {
+		t.Errorf("Unexpected tag default order %s", order)
+	}
+
+	vars.Sort = []string{"cn desc"}
+	order, err = vars.SqlOrder(testCert{}, "not_before DESC")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if order != "`cn` DESC" {
+		t.Errorf("Unexpected client order %s", order)
+	}
+}
+
+func TestSqlOrderDirection(t *testing.T) {
+	tests := []struct {
+		sort     string
+		expected string
+	}{
+		{sort: "cn", expected: "`cn` ASC"},
+		{sort: "cn asc", expected: "`cn` ASC"},
+		{sort: "cn ASC", expected: "`cn` ASC"},
+		{sort: "cn desc", expected: "`cn` DESC"},
+		{sort: "cn Desc", expected: "`cn` DESC"},
+	}
+	for _, test := range tests {
+		vars := Vars{Sort: []string{test.sort}}
+		order, err := vars.SqlOrder(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", test.sort, err)
+		}
+		if order != test.expected {
+			t.Errorf("Expected %s for %q, got %s", test.expected, test.sort, order)
+		}
+	}
+
+	for _, sort := range []string{"cn descending", "cn ascc", "cn desc asc"} {
+		var invalidDirection *ErrInvalidSortDirection
+		vars := Vars{Sort: []string{sort}}
+		_, err := vars.SqlOrder(testCert{})
+		if !errors.As(err, &invalidDirection) || invalidDirection.Field != "cn" {
+			t.Errorf("Expected an invalid sort direction error for %q, got %v", sort, err)
+		}
+	}
+}
+
+func TestSqlOrderNulls(t *testing.T) {
+	tests := []struct {
+		sort     []string
+		expected string
+	}{
+		{sort: []string{"valid_until asc nulls last"}, expected: "`valid_until` IS NULL,`valid_until` ASC"},
+		{sort: []string{"valid_until NULLS LAST", "id"}, expected: "`valid_until` IS NULL,`valid_until` ASC,`id` ASC"},
+		{sort: []string{"valid_until desc nulls first"}, expected: "`valid_until` IS NOT NULL,`valid_until` DESC"},
+	}
+	for _, test := range tests {
+		vars := Vars{Sort: test.sort}
+		order, err := vars.SqlOrder(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", test.sort, err)
+		}
+		if order != test.expected {
+			t.Errorf("Expected %s for %q, got %s", test.expected, test.sort, order)
+		}
+	}
+
+	for _, sort := range []string{"valid_until nulls", "valid_until nulls middle", "valid_until nulls last desc"} {
+		var invalidDirection *ErrInvalidSortDirection
+		vars := Vars{Sort: []string{sort}}
+		_, err := vars.SqlOrder(testCert{})
+		if !errors.As(err, &invalidDirection) || invalidDirection.Field != "valid_until" {
+			t.Errorf("Expected an invalid sort direction error for %q, got %v", sort, err)
+		}
+	}
+
+	vars := Vars{Sort: []string{"valid_until nulls last", "id"}, After: []string{"2024-01-01 00:00:00", "42"}}
+	if _, err := vars.SqlKeyset(testCert{}); err == nil {
+		t.Errorf("Expected keyset pagination to reject the NULLS placement")
+	}
+}
+
+func TestSqlKeyset(t *testing.T) {
+	vars := Vars{
+		Cursor: 500,
+		Sort:   []string{"not_before DESC", "id"},
+		After:  []string{"2024-01-01 00:00:00", "42"},
+		Query:  Search{Field: "ca_id", Op: "equals", Value: 1},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Offset != 0 {
+		t.Errorf("Keyset pagination should not use an offset, got %d", sql.Offset)
+	}
+	expected := "(`ca_id` = ?) AND (((`not_before` < ?) OR (`not_before` = ? AND `id` > ?)))"
+	if sql.Where.Query != expected {
+		t.Errorf("Unexpected query %s", sql.Where.Query)
+	}
+	if len(sql.Where.Values) != 4 || sql.Where.Values[0] != 1 || sql.Where.Values[1] != "2024-01-01 00:00:00" || sql.Where.Values[3] != "42" {
+		t.Errorf("Unexpected values %v", sql.Where.Values)
+	}
+
+	vars.After = []string{"2024-01-01 00:00:00"}
+	if _, err := vars.Sql(testCert{}); err == nil {
+		t.Errorf("Expected an error when the keyset does not match the sort fields")
+	}
+}
+
+func TestSqlErrors(t *testing.T) {
+	var unknownField *ErrUnknownField
+	vars := Vars{Fields: []string{"cn", "unknown"}}
+	_, err := vars.Sql(testCert{})
+	if !errors.As(err, &unknownField) || unknownField.Field != "unknown" {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+
+	vars = Vars{Sort: []string{"nope DESC"}}
+	_, err = vars.Sql(testCert{})
+	if !errors.As(err, &unknownField) || unknownField.Field != "nope" {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+
+	var unknownOperator *ErrUnknownOperator
+	search := Search{Field: "cn", Op: "matches", Value: "test"}
+	_, err = search.SqlWhere(testCert{})
+	if !errors.As(err, &unknownOperator) || unknownOperator.Op != "matches" {
+		t.Errorf("Expected an unknown operator error, got %v", err)
+	}
+	if err.Error() != "Unknown operator `matches`" {
+		t.Errorf("Unexpected message %s", err)
+	}
+
+	search = Search{
+		Op: "xor",
+		Values: []Search{
+			{Field: "cn", Op: "equals", Value: "a"},
+			{Field: "cn", Op: "equals", Value: "b"},
+		},
+	}
+	_, err = search.SqlWhere(testCert{})
+	if !errors.As(err, &unknownOperator) || unknownOperator.Op != "xor" {
+		t.Errorf("Expected an unknown operator error, got %v", err)
+	}
+
+	var invalidValue *ErrInvalidValue
+	search = Search{Field: "cn", Op: "contains", Value: 12}
+	_, err = search.SqlWhere(testCert{})
+	if !errors.As(err, &invalidValue) || invalidValue.Field != "cn" {
+		t.Errorf("Expected an invalid value error, got %v", err)
+	}
+}
+
+func TestSqlWhereLimits(t *testing.T) {
+	search := Search{Field: "cn", Op: "equals", Value: "test"}
+	for i := 0; i < 1000; i++ {
+		search = Search{
+			Op:     "and",
+			Values: []Search{search, {Field: "ca_id", Op: "equals", Value: i}},
+		}
+	}
+	var limit *ErrSearchLimit
+	_, err := search.SqlWhere(testCert{})
+	if !errors.As(err, &limit) || limit.Limit != "depth" {
+		t.Errorf("Expected a depth limit error, got %v", err)
+	}
+
+	values := make([]Search, 0)
+	for i := 0; i < MaxSearchNodes; i++ {
+		values = append(values, Search{Field: "ca_id", Op: "equals", Value: i})
+	}
+	search = Search{Op: "or", Values: values}
+	_, err = search.SqlWhere(testCert{})
+	if !errors.As(err, &limit) || limit.Limit != "node count" {
+		t.Errorf("Expected a node count limit error, got %v", err)
+	}
+
+	search = Search{Op: "or", Values: values[:MaxSearchNodes-1]}
+	if _, err = search.SqlWhere(testCert{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSqlWhereIEquals(t *testing.T) {
+	search := Search{Field: "CN", Op: "iequals", Value: "Foo"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "LOWER(`cn`) = LOWER(?)" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 1 || where.Values[0] != "Foo" {
+		t.Errorf("Unexpected values %v", where.Values)
+	}
+}
+
+func TestSqlWhereEqualsSlice(t *testing.T) {
+	search := Search{Field: "cn", Op: "equals", Value: "a"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`cn` = ?" || len(where.Values) != 1 {
+		t.Errorf("Unexpected scalar where %s %v", where.Query, where.Values)
+	}
+
+	search = Search{Field: "cn", Op: "equals", Value: []interface{}{"a", "b", "c"}}
+	where, err = search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`cn` IN (?,?,?)" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 3 || where.Values[0] != "a" || where.Values[2] != "c" {
+		t.Errorf("Unexpected values %v", where.Values)
+	}
+
+	search = Search{Field: "cn", Op: "equals", Value: []interface{}{}}
+	if _, err = search.SqlWhere(testCert{}); err == nil {
+		t.Errorf("Expected an error for an empty slice")
+	}
+}
+
+func TestSqlExplain(t *testing.T) {
+	vars := Vars{
+		Fields: []string{"id", "cn"},
+		Sort:   []string{"cn"},
+		Limit:  10,
+		Query: Search{
+			Op: "or",
+			Values: []Search{
+				{Field: "cn", Op: "equals", Value: `it's a \ test`},
+				{Field: "ca_id", Op: "equals", Value: 3},
+			},
+		},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	display, query, values := sql.Explain("pki_certs")
+	expectedQuery := "SELECT `id`,`cn` FROM `pki_certs` WHERE (`cn` = ? OR `ca_id` = ?) ORDER BY `cn` ASC LIMIT 10"
+	if query != expectedQuery {
+		t.Errorf("Unexpected query %s", query)
+	}
+	if len(values) != 2 {
+		t.Errorf("Unexpected values %v", values)
+	}
+	expectedDisplay := "/* for display only, not executed */ SELECT `id`,`cn` FROM `pki_certs` WHERE (`cn` = 'it\\'s a \\\\ test' OR `ca_id` = 3) ORDER BY `cn` ASC LIMIT 10"
+	if display != expectedDisplay {
+		t.Errorf("Unexpected display %s", display)
+	}
+}
+
+func TestSqlWhereEmptyField(t *testing.T) {
+	var required *ErrFieldRequired
+	for _, field := range []string{"", "  "} {
+		search := Search{Field: field, Op: "equals", Value: "x"}
+		_, err := search.SqlWhere(testCert{})
+		if !errors.As(err, &required) {
+			t.Errorf("Expected a field required error for %q, got %v", field, err)
+		}
+	}
+}
+
+func TestSearchString(t *testing.T) {
+	tests := []struct {
+		search   Search
+		expected string
+	}{
+		{Search{}, ""},
+		{Search{Field: "cn", Op: "contains", Value: "foo"}, `cn contains "foo"`},
+		{Search{Field: "cn", Op: "equals", Value: `say "hi"`}, `cn equals "say \"hi\""`},
+		{Search{Op: "and", Values: []Search{{Field: "cn", Op: "equals", Value: "foo"}}}, `cn equals "foo"`},
+		{
+			Search{Op: "and", Values: []Search{
+				{Field: "cn", Op: "contains", Value: "foo"},
+				{Op: "or", Values: []Search{
+					{Field: "ca_id", Op: "equals", Value: []interface{}{1, 2}},
+					{Op: "not", Values: []Search{{Field: "mail", Op: "ends_with", Value: "@example.com"}}},
+				}},
+			}},
+			`(cn contains "foo" AND (ca_id equals [1, 2] OR NOT (mail ends_with "@example.com")))`,
+		},
+	}
+	for _, test := range tests {
+		if got := test.search.String(); got != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, got)
+		}
+	}
+}
+
+type testIssuer struct {
+	IssuerCn  string `json:"issuer_cn,omitempty"`
+	IssuerKey string `json:"-"`
+}
+
+type testValidity struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type testEmbeddedCert struct {
+	testCert
+	*testIssuer
+	Validity testValidity `json:"validity" gorm:"embedded;embeddedPrefix:validity_"`
+	Profile  testIssuer   `json:"-"`
+}
+
+func TestSqlFieldsEmbedded(t *testing.T) {
+	fields := SqlFields(testEmbeddedCert{})
+	expected := []string{"id", "cn", "mail", "ca_id", "profile_id", "valid_until", "not_before", "serial_number", "issuer_cn", "validity_from", "validity_to"}
+	if len(fields) != len(expected) {
+		t.Fatalf("Expected fields %v, got %v", expected, fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("Expected field %s, got %s", expected[i], fields[i])
+		}
+	}
+
+	search := Search{Field: "issuer_cn", Op: "equals", Value: "ca"}
+	if _, err := search.SqlWhere(testEmbeddedCert{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSqlVarsLimits(t *testing.T) {
+	fields := make([]string, MaxSelectFields)
+	sorts := make([]string, MaxSortTerms)
+	for i := range fields {
+		fields[i] = "count(*)"
+	}
+	for i := range sorts {
+		sorts[i] = "id"
+	}
+
+	vars := Vars{Fields: fields, Sort: sorts}
+	if _, err := vars.Sql(testCert{}); err != nil {
+		t.Errorf("Unexpected error at the limits: %s", err)
+	}
+
+	var limit *ErrVarsLimit
+	vars = Vars{Fields: append(fields, "count(*)"), Sort: sorts}
+	_, err := vars.Sql(testCert{})
+	if !errors.As(err, &limit) || limit.Limit != "select field count" {
+		t.Errorf("Expected a select field count limit error, got %v", err)
+	}
+
+	vars = Vars{Fields: fields, Sort: append(sorts, "id")}
+	_, err = vars.Sql(testCert{})
+	if !errors.As(err, &limit) || limit.Limit != "sort term count" {
+		t.Errorf("Expected a sort term count limit error, got %v", err)
+	}
+}
+
+func TestSqlOffsetLimit(t *testing.T) {
+	vars := Vars{Cursor: MaxOffset}
+	if offset, err := vars.SqlOffset(); err != nil || offset != MaxOffset {
+		t.Errorf("Expected offset %d, got %d (%v)", MaxOffset, offset, err)
+	}
+
+	var offsetLimit *ErrOffsetLimit
+	vars = Vars{Cursor: MaxOffset + 1}
+	_, err := vars.Sql(testCert{})
+	if !errors.As(err, &offsetLimit) || offsetLimit.Offset != MaxOffset+1 {
+		t.Errorf("Expected an offset limit error, got %v", err)
+	}
+
+	vars = Vars{Cursor: 2000000000, Sort: []string{"id"}, After: []string{"42"}}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Offset != 0 {
+		t.Errorf("Expected no offset with keyset pagination, got %d", sql.Offset)
+	}
+}
+
+func TestSqlWhereAny(t *testing.T) {
+	where, err := SqlWhereAny(testCert{}, "10%", "cn", "serial_number", "mail")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "(`cn` LIKE ? OR `serial_number` LIKE ? OR `mail` LIKE ?)" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 3 {
+		t.Fatalf("Expected 3 values, got %v", where.Values)
+	}
+	for _, value := range where.Values {
+		if value != `%10\%%` {
+			t.Errorf("Unexpected value %v", value)
+		}
+	}
+
+	var unknownField *ErrUnknownField
+	if _, err = SqlWhereAny(testCert{}, "test", "cn", "unknown"); !errors.As(err, &unknownField) {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+}
+
+func TestSqlWhereOperators(t *testing.T) {
+	operators := map[string][]string{"serial_number": {"equals"}}
+	vars := Vars{
+		Operators: operators,
+		Query:     Search{Field: "serial_number", Op: "equals", Value: []string{"1", "2"}},
+	}
+	if _, err := vars.Sql(testCert{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	var notAllowed *ErrOperatorNotAllowed
+	vars.Query = Search{
+		Op: "and",
+		Values: []Search{
+			{Field: "cn", Op: "contains", Value: "test"},
+			{Field: "Serial_Number", Op: "contains", Value: "12"},
+		},
+	}
+	_, err := vars.Sql(testCert{})
+	if !errors.As(err, &notAllowed) || notAllowed.Field != "serial_number" || notAllowed.Op != "contains" {
+		t.Errorf("Expected an operator not allowed error, got %v", err)
+	}
+
+	vars.Operators = nil
+	if _, err := vars.Sql(testCert{}); err != nil {
+		t.Errorf("Unexpected error without restrictions: %s", err)
+	}
+}
+
+type testJSONCert struct {
+	ID         uint   `gorm:"primarykey"`
+	Cn         string `json:"cn,omitempty"`
+	Attributes string `json:"attributes,omitempty"`
+}
+
+func TestSqlWhereJSONField(t *testing.T) {
+	vars := Vars{
+		Fields:     []string{"id", "Subject_CN"},
+		JSONFields: map[string]JSONField{"subject_cn": {Column: "attributes", Path: "$.subject.cn"}},
+		Query:      Search{Field: "subject_cn", Op: "equals", Value: "test"},
+	}
+	sql, err := vars.Sql(testJSONCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "JSON_UNQUOTE(JSON_EXTRACT(`attributes`, '$.subject.cn')) = ?"
+	if sql.Where.Query != expected || len(sql.Where.Values) != 1 || sql.Where.Values[0] != "test" {
+		t.Errorf("Expected %q, got %q %v", expected, sql.Where.Query, sql.Where.Values)
+	}
+	expected = "`id`,JSON_UNQUOTE(JSON_EXTRACT(`attributes`, '$.subject.cn')) AS `subject_cn`"
+	if sql.Select != expected {
+		t.Errorf("Expected %q, got %q", expected, sql.Select)
+	}
+
+	var unknown *ErrUnknownField
+	vars.JSONFields = nil
+	if _, err := vars.Query.SqlWhere(testJSONCert{}); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown field error for an unregistered path, got %v", err)
+	}
+
+	var invalid *ErrInvalidJSONPath
+	vars.JSONFields = map[string]JSONField{"subject_cn": {Column: "attributes", Path: "$.subject') OR 1=1 --"}}
+	if _, err := vars.Sql(testJSONCert{}); !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid path error, got %v", err)
+	}
+}
+
+func TestSqlWhereBetween(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	search := Search{Field: "valid_until", Op: "not_between", Value: []time.Time{from, to}}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// the rows inside the window are excluded
+	if where.Query != "`valid_until` NOT BETWEEN ? AND ?" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+	if len(where.Values) != 2 || where.Values[0] != from || where.Values[1] != to {
+		t.Errorf("Unexpected values %v", where.Values)
+	}
+
+	search.Op = "between"
+	if where, _ = search.SqlWhere(testCert{}); where.Query != "`valid_until` BETWEEN ? AND ?" {
+		t.Errorf("Unexpected query %s", where.Query)
+	}
+
+	for _, op := range []string{"between", "not_between"} {
+		for _, value := range []interface{}{from, []time.Time{from}, []time.Time{from, to, to}} {
+			var invalid *ErrInvalidValue
+			search = Search{Field: "valid_until", Op: op, Value: value}
+			if _, err = search.SqlWhere(testCert{}); !errors.As(err, &invalid) {
+				t.Errorf("Expected an invalid value error for %s %v, got %v", op, value, err)
+			}
+		}
+	}
+}
+
+func TestSqlWhereCollation(t *testing.T) {
+	vars := Vars{
+		Collations: map[string]string{"mail": "utf8mb4_bin"},
+		Query: Search{
+			Op: "and",
+			Values: []Search{
+				{Field: "Mail", Op: "equals", Value: "Foo@example.com"},
+				{Field: "cn", Op: "equals", Value: "foo"},
+			},
+		},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "(`mail` = ? COLLATE utf8mb4_bin AND `cn` = ?)"
+	if sql.Where.Query != expected {
+		t.Errorf("Expected %q, got %q", expected, sql.Where.Query)
+	}
+
+	search := Search{Field: "mail", Op: "equals", Value: []string{"a", "b"}, Collation: "UTF8MB4_GENERAL_CI"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = "`mail` IN (? COLLATE utf8mb4_general_ci,? COLLATE utf8mb4_general_ci)"
+	if where.Query != expected {
+		t.Errorf("Expected %q, got %q", expected, where.Query)
+	}
+
+	var unknown *ErrUnknownCollation
+	search = Search{Field: "mail", Op: "equals", Value: "a", Collation: "utf8mb4_bin; DROP TABLE certs"}
+	if _, err = search.SqlWhere(testCert{}); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown collation error, got %v", err)
+	}
+}
+
+func TestSqlOrderScore(t *testing.T) {
+	vars := Vars{
+		Sort:   []string{"relevance DESC", "id"},
+		Scores: map[string]Score{"relevance": Relevance("cn", "foo_")},
+		Query:  Search{Field: "mail", Op: "equals", Value: "a@example.com"},
+		Limit:  10,
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	query, values := sql.Statement("certs")
+	expected := "SELECT `id`,`cn`,`mail`,`ca_id`,`profile_id`,`valid_until`,`not_before`,`serial_number` FROM `certs` WHERE `mail` = ? ORDER BY CASE WHEN `cn` = ? THEN 3 WHEN `cn` LIKE ? THEN 2 WHEN `cn` LIKE ? THEN 1 ELSE 0 END DESC,`id` ASC LIMIT 10"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	// the parameters follow the placeholders, WHERE first then ORDER BY
+	expectedValues := []interface{}{"a@example.com", "foo_", `foo\_%`, `%foo\_%`}
+	if !reflect.DeepEqual(values, expectedValues) {
+		t.Errorf("Expected %v, got %v", expectedValues, values)
+	}
+
+	vars.After = []string{"3", "1"}
+	if _, err := vars.Sql(testCert{}); err == nil {
+		t.Errorf("Expected an error for keyset pagination on a score")
+	}
+}
+
+func TestSqlWhereVirtualField(t *testing.T) {
+	status := VirtualField{
+		"valid":   {Query: "`not_before` <= NOW() AND `valid_until` >= NOW()"},
+		"expired": {Query: "`valid_until` < ?", Values: []interface{}{"2024-01-01"}},
+	}
+	tests := []struct {
+		op       string
+		value    interface{}
+		expected string
+		values   int
+	}{
+		{op: "equals", value: "valid", expected: "((`not_before` <= NOW() AND `valid_until` >= NOW()))"},
+		{op: "equals", value: "Expired", expected: "((`valid_until` < ?))", values: 1},
+		{op: "equals", value: []string{"valid", "expired"}, expected: "((`not_before` <= NOW() AND `valid_until` >= NOW()) OR (`valid_until` < ?))", values: 1},
+		{op: "not_equals", value: "expired", expected: "NOT (`valid_until` < ?)", values: 1},
+	}
+	for _, test := range tests {
+		vars := Vars{
+			VirtualFields: map[string]VirtualField{"status": status},
+			Query:         Search{Field: "Status", Op: test.op, Value: test.value},
+		}
+		sql, err := vars.Sql(testCert{})
+		if err != nil {
+			t.Errorf("Unexpected error for %s %v: %s", test.op, test.value, err)
+			continue
+		}
+		if sql.Where.Query != test.expected || len(sql.Where.Values) != test.values {
+			t.Errorf("Expected %q for %s %v, got %q %v", test.expected, test.op, test.value, sql.Where.Query, sql.Where.Values)
+		}
+	}
+
+	vars := Vars{
+		VirtualFields: map[string]VirtualField{"status": status},
+		Query:         Search{Field: "status", Op: "equals", Value: "revoked"},
+	}
+	var invalid *ErrInvalidValue
+	if _, err := vars.Sql(testCert{}); !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid value error for an unknown status, got %v", err)
+	}
+	var notAllowed *ErrOperatorNotAllowed
+	vars.Query = Search{Field: "status", Op: "contains", Value: "valid"}
+	if _, err := vars.Sql(testCert{}); !errors.As(err, &notAllowed) {
+		t.Errorf("Expected an operator not allowed error, got %v", err)
+	}
+}
+
+type testSerialCert struct {
+	ID     uint   `gorm:"primarykey"`
+	Serial int64  `json:"serial"`
+	Cn     string `json:"cn"`
+}
+
+func TestSqlWhereNumericCoercion(t *testing.T) {
+	body := `{"query": {"op": "and", "values": [{"field": "serial", "op": "greater_than", "value": 9007199254740993}, {"field": "cn", "op": "equals", "value": 12}]}}`
+	var vars Vars
+	if err := vars.DecodeBodyJson(httptest.NewRequest("POST", "/search", strings.NewReader(body))); err != nil {
+		t.Fatalf("Cannot decode the body: %s", err)
+	}
+	where, err := vars.Query.SqlWhere(testSerialCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// 2^53+1 is rounded to 2^53 by a float64
+	if len(where.Values) != 2 || where.Values[0] != int64(9007199254740993) {
+		t.Errorf("Expected the exact int64 serial, got %#v", where.Values)
+	}
+	if where.Values[1] != "12" {
+		t.Errorf("Expected a string for a string field, got %#v", where.Values[1])
+	}
+
+	search := Search{Field: "id", Op: "equals", Value: []interface{}{"1", float64(2)}}
+	if where, err = search.SqlWhere(testSerialCert{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(where.Values, []interface{}{uint64(1), uint64(2)}) {
+		t.Errorf("Expected unsigned values, got %#v", where.Values)
+	}
+
+	var invalid *ErrInvalidValue
+	for _, value := range []interface{}{"-1", 1.5, "abc"} {
+		search = Search{Field: "id", Op: "less_than", Value: value}
+		if _, err = search.SqlWhere(testSerialCert{}); !errors.As(err, &invalid) {
+			t.Errorf("Expected an invalid value error for %#v, got %v", value, err)
+		}
+	}
+}
+
+func TestSqlWhereLike(t *testing.T) {
+	search := Search{Field: "mail", Op: "like", Value: "admin_%@example.com"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// the wildcards of the pattern are kept, unlike contains
+	if where.Query != "`mail` LIKE ?" || len(where.Values) != 1 || where.Values[0] != "admin_%@example.com" {
+		t.Errorf("Unexpected where %s %v", where.Query, where.Values)
+	}
+
+	var invalid *ErrInvalidValue
+	search.Value = 12
+	if _, err = search.SqlWhere(testCert{}); !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid value error for a number, got %v", err)
+	}
+	var unknown *ErrUnknownField
+	search = Search{Field: "password", Op: "like", Value: "%"}
+	if _, err = search.SqlWhere(testCert{}); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+}
+
+func TestSqlWhereNotEqualsOrNull(t *testing.T) {
+	// a row with a NULL mail is excluded by not_equals and included by not_equals_or_null
+	search := Search{Field: "mail", Op: "not_equals", Value: "admin@example.com"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`mail` != ?" || len(where.Values) != 1 || where.Values[0] != "admin@example.com" {
+		t.Errorf("Unexpected where %s %v", where.Query, where.Values)
+	}
+
+	search.Op = "not_equals_or_null"
+	where, err = search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "(`mail` != ? OR `mail` IS NULL)" || len(where.Values) != 1 || where.Values[0] != "admin@example.com" {
+		t.Errorf("Unexpected where %s %v", where.Query, where.Values)
+	}
+
+	search = Search{Field: "ca_id", Op: "not_equals_or_null", Value: "3"}
+	where, err = search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "(`ca_id` != ? OR `ca_id` IS NULL)" || len(where.Values) != 1 || where.Values[0] != uint64(3) {
+		t.Errorf("Expected the value to be coerced, got %s %#v", where.Query, where.Values)
+	}
+}
+
+// testRevokedCert has the boolean column of the revoked certificates
+type testRevokedCert struct {
+	ID      uint
+	Revoked bool `json:"revoked"`
+}
+
+func TestSqlWhereBool(t *testing.T) {
+	var search Search
+	if err := json.Unmarshal([]byte(`{"field":"revoked","op":"equals","value":true}`), &search); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	where, err := search.SqlWhere(testRevokedCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`revoked` = ?" || len(where.Values) != 1 || where.Values[0] != 1 {
+		t.Errorf("Expected true to be bound as 1, got %s %#v", where.Query, where.Values)
+	}
+
+	for value, expected := range map[interface{}]interface{}{false: 0, "true": 1, "0": 0, float64(1): 1} {
+		search := Search{Field: "revoked", Op: "not_equals", Value: value}
+		where, err := search.SqlWhere(testRevokedCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", value, err)
+		}
+		if len(where.Values) != 1 || where.Values[0] != expected {
+			t.Errorf("Expected %v to be bound as %v, got %#v", value, expected, where.Values)
+		}
+	}
+
+	search = Search{Field: "revoked", Op: "equals", Value: "maybe"}
+	var invalid *ErrInvalidValue
+	if _, err := search.SqlWhere(testRevokedCert{}); !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid value error, got %v", err)
+	}
+}
+
+func TestSqlWhereFieldEquals(t *testing.T) {
+	search := Search{Field: "valid_until", Op: "field_equals", Value: "NOT_BEFORE"}
+	where, err := search.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`valid_until` = `not_before`" || len(where.Values) != 0 {
+		t.Errorf("Unexpected where %s %v", where.Query, where.Values)
+	}
+
+	var unknown *ErrUnknownField
+	search.Value = "not_before`; DROP TABLE certs; --"
+	if _, err = search.SqlWhere(testCert{}); !errors.As(err, &unknown) || unknown.Field != search.Value {
+		t.Errorf("Expected an unknown field error for the compared field, got %v", err)
+	}
+	var invalid *ErrInvalidValue
+	search.Value = 12
+	if _, err = search.SqlWhere(testCert{}); !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid value error for a number, got %v", err)
+	}
+}
+
+func TestSqlExists(t *testing.T) {
+	vars := Vars{
+		Sort:  []string{"cn DESC"},
+		Limit: 10,
+		Query: Search{Op: "and", Values: []Search{
+			{Field: "ca_id", Op: "equals", Value: 1},
+			{Field: "cn", Op: "starts_with", Value: "foo"},
+		}},
+	}
+	query, where, err := vars.SqlExists(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "SELECT EXISTS(SELECT 1 FROM `pki_certs` WHERE (`ca_id` = ? AND `cn` LIKE ?))"
+	if query != expected {
+		t.Errorf("Unexpected query %s", query)
+	}
+	search, err := vars.Query.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != search.Query || !reflect.DeepEqual(where.Values, search.Values) {
+		t.Errorf("Expected the where clause of the search, got %s %v", where.Query, where.Values)
+	}
+
+	query, where, err = Vars{}.SqlExists(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if query != "SELECT EXISTS(SELECT 1 FROM `pki_certs`)" || len(where.Values) != 0 {
+		t.Errorf("Unexpected query without search %s %v", query, where.Values)
+	}
+
+	if _, _, err = vars.SqlExists(struct{ Cn string }{}); err == nil {
+		t.Errorf("Expected an error for a class without a table name")
+	}
+}
+
+func TestUpdatedSince(t *testing.T) {
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	vars := Vars{Query: Search{Field: "cn", Op: "equals", Value: "bob"}, Sort: []string{"cn DESC"}}
+	vars, err := vars.UpdatedSince(testCert{}, "not_before", since)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Where.Query != "(`cn` = ? AND `not_before` > ?)" {
+		t.Errorf("Unexpected where %s", sql.Where.Query)
+	}
+	if len(sql.Where.Values) != 2 || sql.Where.Values[0] != "bob" || sql.Where.Values[1] != since {
+		t.Errorf("Unexpected values %v", sql.Where.Values)
+	}
+	if sql.Order != "`not_before` ASC" {
+		t.Errorf("Unexpected order %s", sql.Order)
+	}
+
+	vars, err = Vars{}.UpdatedSince(testCert{}, "valid_until", since)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql, _ := vars.Sql(testCert{}); sql.Where.Query != "`valid_until` > ?" {
+		t.Errorf("Unexpected where without search %s", sql.Where.Query)
+	}
+
+	var unknown *ErrUnknownField
+	if _, err := (Vars{}).UpdatedSince(testCert{}, "updated", since); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+	var fieldType *ErrFieldType
+	if _, err := (Vars{}).UpdatedSince(testCert{}, "cn", since); !errors.As(err, &fieldType) {
+		t.Errorf("Expected a field type error, got %v", err)
+	}
+}
+
+func TestSqlScope(t *testing.T) {
+	scope := Where{Query: "`ca_id` IN (SELECT `id` FROM `pki_cas` WHERE `owner` = ?)", Values: []interface{}{"bob"}}
+	for _, search := range []Search{
+		{},
+		{Field: "cn", Op: "equals", Value: "alice"},
+		{Op: "or", Values: []Search{
+			{Field: "ca_id", Op: "equals", Value: 2},
+			{Field: "ca_id", Op: "not_equals", Value: 2},
+		}},
+	} {
+		vars := Vars{Query: search, Scope: scope}
+		sql, err := vars.Sql(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		user, err := search.SqlWhere(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expected := user.And(scope)
+		if sql.Where.Query != expected.Query || !reflect.DeepEqual(sql.Where.Values, expected.Values) {
+			t.Errorf("Expected the scope ANDed with %s, got %s %v", search, sql.Where.Query, sql.Where.Values)
+		}
+		if !strings.HasSuffix(sql.Where.Query, scope.Query) && !strings.HasSuffix(sql.Where.Query, "("+scope.Query+")") {
+			t.Errorf("Expected the scope in the where clause, got %s", sql.Where.Query)
+		}
+
+		_, where, err := vars.SqlExists(testCert{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if where.Query != expected.Query {
+			t.Errorf("Expected the scope in the exists clause, got %s", where.Query)
+		}
+	}
+
+	vars := Vars{Sort: []string{"id"}, After: []string{"42"}, Scope: scope}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Where.Query != "("+scope.Query+") AND (((`id` > ?)))" {
+		t.Errorf("Expected the scope with keyset pagination, got %s", sql.Where.Query)
+	}
+}
+
+func TestStream(t *testing.T) {
+	// 25 rows sorted on cn then id, several rows share a cn
+	rows := make([]testCert, 0)
+	for i := 1; i <= 25; i++ {
+		rows = append(rows, testCert{ID: uint(i), Cn: "cn" + strconv.Itoa(i%4)})
+	}
+	sorted := append([]testCert{}, rows...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Cn < sorted[j].Cn || (sorted[i].Cn == sorted[j].Cn && sorted[i].ID < sorted[j].ID)
+	})
+
+	streamed := make([]testCert, 0)
+	batches := 0
+	err := Stream(Vars{Sort: []string{"cn"}}, 10, func(vars Vars) ([]testCert, error) {
+		batches++
+		sql, err := vars.Sql(testCert{})
+		if err != nil {
+			return nil, err
+		}
+		if sql.Order != "`cn` ASC,`id` ASC" || sql.Limit != 10 || sql.Offset != 0 {
+			t.Errorf("Unexpected batch statement %s %d %d", sql.Order, sql.Limit, sql.Offset)
+		}
+		if (len(vars.After) > 0) != strings.Contains(sql.Where.Query, "`cn` > ?") {
+			t.Errorf("Expected the keyset predicate after the first batch, got %q", sql.Where.Query)
+		}
+		// run the keyset pagination of the statement on the rows
+		batch := make([]testCert, 0)
+		for _, row := range sorted {
+			if len(vars.After) > 0 {
+				id, _ := strconv.Atoi(vars.After[1])
+				if row.Cn < vars.After[0] || (row.Cn == vars.After[0] && int(row.ID) <= id) {
+					continue
+				}
+			}
+			if len(batch) < sql.Limit {
+				batch = append(batch, row)
+			}
+		}
+		streamed = append(streamed, batch...)
+		return batch, nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if batches != 3 {
+		t.Errorf("Expected 3 batches, got %d", batches)
+	}
+	if !reflect.DeepEqual(streamed, sorted) {
+		t.Errorf("Expected every row once in order, got %v", streamed)
+	}
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	values, err := sqlKeysetValues(testCert{ID: 7, NotBefore: since}, []sqlSort{{Field: "not_before"}, {Field: "id"}})
+	if err != nil || !reflect.DeepEqual(values, []string{"2024-01-02 03:04:05.6", "7"}) {
+		t.Errorf("Unexpected keyset values %v %v", values, err)
+	}
+
+	failed := errors.New("failed")
+	if err = Stream(Vars{}, 10, func(vars Vars) ([]testCert, error) { return nil, failed }); err != failed {
+		t.Errorf("Expected the error of the batch, got %v", err)
+	}
+	if err = Stream(Vars{}, 0, func(vars Vars) ([]testCert, error) { return nil, nil }); err == nil {
+		t.Errorf("Expected an error for an empty batch size")
+	}
+}
+
+func TestSqlWhereDefaultOperators(t *testing.T) {
+	vars := Vars{
+		DefaultOperators: map[string]string{"serial_number": "equals", "CN": "contains"},
+		Query: Search{Op: "and", Values: []Search{
+			{Field: "serial_number", Value: "1A"},
+			{Field: "cn", Value: "bob"},
+			{Field: "cn", Op: "starts_with", Value: "b"},
+		}},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Where.Query != "(`serial_number` = ? AND `cn` LIKE ? AND `cn` LIKE ?)" {
+		t.Errorf("Unexpected where %s", sql.Where.Query)
+	}
+	if !reflect.DeepEqual(sql.Where.Values, []interface{}{"1A", "%bob%", "b%"}) {
+		t.Errorf("Unexpected values %v", sql.Where.Values)
+	}
+
+	var required *ErrOperatorRequired
+	vars.Query = Search{Field: "mail", Value: "bob@example.com"}
+	if _, err = vars.Sql(testCert{}); !errors.As(err, &required) || required.Field != "mail" {
+		t.Errorf("Expected an operator required error without default, got %v", err)
+	}
+
+	// the default operator is restricted like the others
+	var notAllowed *ErrOperatorNotAllowed
+	vars.Operators = map[string][]string{"cn": {"equals"}}
+	vars.Query = Search{Field: "cn", Value: "bob"}
+	if _, err = vars.Sql(testCert{}); !errors.As(err, &notAllowed) {
+		t.Errorf("Expected an operator not allowed error, got %v", err)
+	}
+}
+
+func TestSqlWhereOperatorAliases(t *testing.T) {
+	where, err := Search{Field: "cn", Op: "eq", Value: "bob"}.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != "`cn` = ?" || !reflect.DeepEqual(where.Values, []interface{}{"bob"}) {
+		t.Errorf("Expected eq to resolve to equals, got %s %v", where.Query, where.Values)
+	}
+
+	// the aliases are restricted like their canonical operator
+	vars := Vars{
+		Operators: map[string][]string{"serial_number": {"equals"}},
+		Query: Search{Op: "and", Values: []Search{
+			{Field: "serial_number", Op: "EQ", Value: "1A"},
+			{Field: "valid_until", Op: "gte", Value: "2024-01-01"},
+		}},
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Where.Query != "(`serial_number` = ? AND `valid_until` >= ?)" {
+		t.Errorf("Unexpected where %s", sql.Where.Query)
+	}
+	cached, err := NewSqlCache(0).Sql(vars, testCert{})
+	if err != nil || !reflect.DeepEqual(cached.Where, sql.Where) {
+		t.Errorf("Expected the cache to resolve the aliases, got %v %v", cached.Where, err)
+	}
+
+	var notAllowed *ErrOperatorNotAllowed
+	vars.Query = Search{Field: "serial_number", Op: "neq", Value: "1A"}
+	if _, err = vars.Sql(testCert{}); !errors.As(err, &notAllowed) || notAllowed.Op != "not_equals" {
+		t.Errorf("Expected an operator not allowed error, got %v", err)
+	}
+
+	var unknown *ErrUnknownOperator
+	if _, err = (Search{Field: "cn", Op: "eqq", Value: "bob"}).SqlWhere(testCert{}); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown operator error, got %v", err)
+	}
+}
+
+func TestSqlCountDistinct(t *testing.T) {
+	vars := Vars{Query: Search{Op: "and", Values: []Search{
+		{Field: "cn", Op: "starts_with", Value: "foo"},
+		{Field: "valid_until", Op: "greater_than", Value: "2024-01-01"},
+	}}}
+	query, where, err := vars.SqlCountDistinct("CA_ID", testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "SELECT COUNT(DISTINCT `ca_id`) FROM `pki_certs` WHERE (`cn` LIKE ? AND `valid_until` > ?)"
+	if query != expected {
+		t.Errorf("Unexpected query %s", query)
+	}
+	search, err := vars.Query.SqlWhere(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if where.Query != search.Query || !reflect.DeepEqual(where.Values, search.Values) {
+		t.Errorf("Expected the where clause of the search, got %s %v", where.Query, where.Values)
+	}
+
+	query, _, err = Vars{}.SqlCountDistinct("ca_id", testCert{})
+	if err != nil || query != "SELECT COUNT(DISTINCT `ca_id`) FROM `pki_certs`" {
+		t.Errorf("Unexpected query without search %s %v", query, err)
+	}
+
+	var unknown *ErrUnknownField
+	if _, _, err = vars.SqlCountDistinct("ca_id`) FROM users; --", testCert{}); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+}
+
+// testBacktickCert has a json tag closing the quotes of its column
+type testBacktickCert struct {
+	ID   uint
+	Evil string "json:\"x`;DROP\""
+}
+
+func TestSqlIdentifierBacktick(t *testing.T) {
+	vars := Vars{
+		Sort:  []string{"x`;DROP desc"},
+		Query: Search{Field: "x`;DROP", Op: "equals", Value: "a"},
+	}
+	sql, err := vars.Sql(testBacktickCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sql.Select != "`id`,`x``;DROP`" {
+		t.Errorf("Expected the backtick of the select to be doubled, got %s", sql.Select)
+	}
+	if sql.Order != "`x``;DROP` DESC" {
+		t.Errorf("Expected the backtick of the order to be doubled, got %s", sql.Order)
+	}
+	if !strings.Contains(sql.Where.Query, "`x``;DROP` = ?") {
+		t.Errorf("Expected the backtick of the where clause to be doubled, got %s", sql.Where.Query)
+	}
+	if query, _ := sql.Statement("pki`certs"); !strings.Contains(query, "FROM `pki``certs`") {
+		t.Errorf("Expected the backtick of the table to be doubled, got %s", query)
+	}
+}
+
+func TestSqlMaxExecutionTime(t *testing.T) {
+	vars := Vars{
+		Fields:           []string{"cn"},
+		Query:            Search{Field: "cn", Op: "contains", Value: "bob"},
+		MaxExecutionTime: 1500 * time.Millisecond,
+	}
+	sql, err := vars.Sql(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	query, _ := sql.Statement("pki_certs")
+	if !strings.HasPrefix(query, "SELECT /*+ MAX_EXECUTION_TIME(1500) */ `cn` FROM `pki_certs`") {
+		t.Errorf("Expected the execution time hint, got %s", query)
+	}
+	exists, _, err := vars.SqlExists(testCert{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(exists, "SELECT /*+ MAX_EXECUTION_TIME(1500) */ EXISTS(") {
+		t.Errorf("Expected the execution time hint in the exists statement, got %s", exists)
+	}
+
+	vars.MaxExecutionTime = 0
+	if sql, err = vars.Sql(testCert{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if query, _ := sql.Statement("pki_certs"); strings.Contains(query, "MAX_EXECUTION_TIME") {
+		t.Errorf("Expected no hint without a maximum execution time, got %s", query)
+	}
+}